@@ -30,6 +30,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
@@ -43,6 +44,9 @@ type App struct {
 	config        *Configuration
 	db            *gorm.DB
 	cookieEncoder *securecookie.SecureCookie
+
+	// State of the scan of the repository run at startup
+	scanProgress ScanProgress
 }
 
 // configureLogging sets up the Logrus library in order to use the
@@ -134,10 +138,41 @@ func (app *App) CreateDefaultUser() error {
 func (app *App) refresh(db *gorm.DB) {
 	// Refresh the contents of the database
 	log.WithFields(log.Fields{
-		"repository": app.config.RepositoryPath,
+		"repositories": app.config.Repositories,
 	}).Info("Refreshing the database")
-	if err := RefreshDbContents(db, app.config.RepositoryPath); err != nil {
-		panic(fmt.Sprintf("Unable to refresh the database: %s", err))
+	err := ScanRepositories(db, app.config.Repositories, app.config.ScanWorkers, &app.scanProgress)
+	if err != nil {
+		// The server can still provide the acquisitions that are already in
+		// the database
+		log.WithFields(log.Fields{
+			"repositories": app.config.Repositories,
+			"error":        err,
+		}).Error("Unable to refresh the database")
+	}
+}
+
+// watch starts one Watcher per repository, which keeps the database in sync
+// with the repository until the program exits
+func (app *App) watch(db *gorm.DB) {
+	for _, repo := range app.config.Repositories {
+		watcher, err := NewWatcher(db, repo,
+			time.Duration(app.config.WatchDelay*int64(time.Second)))
+		if err != nil {
+			// The other repositories can still be watched
+			log.WithFields(log.Fields{
+				"repository": repo.Name,
+				"path":       repo.Path,
+				"error":      err,
+			}).Error("Unable to watch the repository")
+			continue
+		}
+
+		watcher.Start()
+		log.WithFields(log.Fields{
+			"repository": repo.Name,
+			"path":       repo.Path,
+			"delay":      app.config.WatchDelay,
+		}).Info("Watching the repository for new acquisitions")
 	}
 }
 
@@ -146,7 +181,7 @@ func (app *App) Run() {
 	log.WithFields(log.Fields{
 		"database_file": app.config.DatabaseFile,
 	}).Info("Going to establish a connection to database")
-	db, err := gorm.Open("sqlite3", app.config.DatabaseFile)
+	db, err := OpenDb(app.config.DatabaseFile)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"database_file": app.config.DatabaseFile,
@@ -165,7 +200,14 @@ func (app *App) Run() {
 		log.Fatalf("Unable to create default user")
 	}
 
-	app.refresh(db)
+	// The watchers are started before the scan, so that folders added while
+	// the scan is running are not missed; a folder ingested by both is
+	// simply found unchanged the second time. The scan runs in the
+	// background, so that the server can answer requests in the meantime.
+	if app.config.WatchRepository {
+		app.watch(db)
+	}
+	go app.refresh(db)
 
 	log.WithFields(log.Fields{
 		"server":      app.config.ServerName,
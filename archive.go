@@ -0,0 +1,554 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that sends the files of acquisitions to clients
+// in ZIP or tar archives
+
+package qutedb
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxBundleSize is the maximum size in bytes of the files put in an
+// archive containing several acquisitions, if the configuration file does not
+// specify it
+const DefaultMaxBundleSize = 10 * 1024 * 1024 * 1024
+
+// An archiveWriter adds directories and files to an archive, which is written
+// as soon as possible
+type archiveWriter interface {
+	// addDir creates a directory; its parent must already exist
+	addDir(name string) error
+	// addFile copies the file "fileName" in the repository into the archive
+	addFile(name string, fileName string, comment string) error
+	// addData creates a file containing "data"
+	addData(name string, data []byte) error
+	// Close writes whatever is needed to complete the archive
+	Close() error
+}
+
+// A zipArchiveWriter writes ZIP archives. The archive/zip package switches to
+// Zip64 automatically when files or archives are larger than 4 GiB or there
+// are more than 65535 files.
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func newZipArchiveWriter(w io.Writer) archiveWriter {
+	ziparchive := zip.NewWriter(w)
+
+	// We strive for speed here, so we use the lowest possible compression
+	// level. This usually achieves good performance nevertheless, so it is not a
+	// big loss
+	ziparchive.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.BestSpeed)
+	})
+
+	return zipArchiveWriter{ziparchive}
+}
+
+func (z zipArchiveWriter) addDir(name string) error {
+	_, err := z.CreateHeader(&zip.FileHeader{
+		Name:     name + "/",
+		Method:   zip.Store,
+		Modified: time.Now(),
+	})
+	return err
+}
+
+func (z zipArchiveWriter) addFile(name string, fileName string, comment string) error {
+	datafile, err := os.Open(fileName)
+	if err != nil {
+		return fileOpenError(err, fileName)
+	}
+	defer datafile.Close()
+
+	fileInfo, err := datafile.Stat()
+	if err != nil {
+		return fileOpenError(err, fileName)
+	}
+
+	fileHeader, err := zip.FileInfoHeader(fileInfo)
+	if err != nil {
+		return err
+	}
+	fileHeader.Name = name
+	fileHeader.Comment = comment
+	fileHeader.Method = zip.Deflate
+	if compressionOf(fileName) != compressionNone {
+		// Compressing the file again would only waste time
+		fileHeader.Method = zip.Store
+	}
+
+	f, err := z.CreateHeader(fileHeader)
+	if err != nil {
+		return Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to add file \"%s\" to ZIP archive", name),
+		}
+	}
+
+	if _, err := io.Copy(f, datafile); err != nil {
+		return Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to compress file \"%s\"", fileName),
+		}
+	}
+
+	return nil
+}
+
+func (z zipArchiveWriter) addData(name string, data []byte) error {
+	f, err := z.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	return err
+}
+
+// A tarArchiveWriter writes tar archives, optionally compressed with gzip
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	// Nil if the archive is not compressed
+	gz *gzip.Writer
+}
+
+func newTarArchiveWriter(w io.Writer) archiveWriter {
+	return tarArchiveWriter{tw: tar.NewWriter(w)}
+}
+
+func newTarGzArchiveWriter(w io.Writer) archiveWriter {
+	// See newZipArchiveWriter for the choice of the compression level
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return tarArchiveWriter{tw: tar.NewWriter(gz), gz: gz}
+}
+
+func (t tarArchiveWriter) addDir(name string) error {
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  time.Now(),
+	})
+}
+
+func (t tarArchiveWriter) addFile(name string, fileName string, comment string) error {
+	datafile, err := os.Open(fileName)
+	if err != nil {
+		return fileOpenError(err, fileName)
+	}
+	defer datafile.Close()
+
+	fileInfo, err := datafile.Stat()
+	if err != nil {
+		return fileOpenError(err, fileName)
+	}
+
+	header, err := tar.FileInfoHeader(fileInfo, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// Do not leak the names of the users and groups of the server
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+	if err := t.tw.WriteHeader(header); err != nil {
+		return Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to add file \"%s\" to tar archive", name),
+		}
+	}
+
+	// The size has already been written in the header, so the file must
+	// not be copied beyond it even if it is growing
+	if _, err := io.CopyN(t.tw, datafile, header.Size); err != nil {
+		return Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to copy file \"%s\"", fileName),
+		}
+	}
+
+	return nil
+}
+
+func (t tarArchiveWriter) addData(name string, data []byte) error {
+	if err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	_, err := t.tw.Write(data)
+	return err
+}
+
+func (t tarArchiveWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gz != nil {
+		return t.gz.Close()
+	}
+	return nil
+}
+
+// An archiveFormat is one of the formats accepted by the parameter "format"
+// of the archive endpoints
+type archiveFormat struct {
+	extension   string
+	contentType string
+	newWriter   func(io.Writer) archiveWriter
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip":    {".zip", "application/zip", newZipArchiveWriter},
+	"tar":    {".tar", "application/x-tar", newTarArchiveWriter},
+	"tar.gz": {".tar.gz", "application/gzip", newTarGzArchiveWriter},
+}
+
+// An archiveSelection tells which files of an acquisition must be put in an
+// archive. The zero value selects all the files.
+type archiveSelection struct {
+	// Either "raw", "sum", "hk" (all the files listed by /files), or the
+	// name of a FileKind. If nil, all the files are selected.
+	parts map[string]bool
+	// ASICs of the raw and science files. If nil, all the ASICs are selected.
+	asics map[int]bool
+}
+
+// parseArchiveSelection reads the parameters "content" and "asic", e.g.,
+// "?content=raw,sum&asic=1"
+func parseArchiveSelection(values url.Values, fileKinds []FileKind) (archiveSelection, error) {
+	var selection archiveSelection
+
+	for _, part := range splitValues(values, "content") {
+		valid := part == "raw" || part == "sum" || part == "hk"
+		for _, kind := range fileKinds {
+			valid = valid || part == kind.Name
+		}
+		if !valid {
+			return selection, fmt.Errorf("invalid content %q, use raw, sum, hk, or the name of a kind of file", part)
+		}
+
+		if selection.parts == nil {
+			selection.parts = map[string]bool{}
+		}
+		selection.parts[part] = true
+	}
+
+	for _, str := range splitValues(values, "asic") {
+		asic, err := strconv.Atoi(str)
+		if err != nil || asic < 1 {
+			return selection, fmt.Errorf("invalid ASIC number %q", str)
+		}
+
+		if selection.asics == nil {
+			selection.asics = map[int]bool{}
+		}
+		selection.asics[asic] = true
+	}
+
+	return selection, nil
+}
+
+// includes returns true if the file described by "file" is selected
+func (selection archiveSelection) includes(file ManifestFile) bool {
+	isAsicFile := file.Kind == "raw" || file.Kind == "sum"
+	if selection.parts != nil && !selection.parts[file.Kind] &&
+		(isAsicFile || !selection.parts["hk"]) {
+		return false
+	}
+
+	return !isAsicFile || selection.asics == nil || selection.asics[file.AsicNumber]
+}
+
+// An archiveEntry is a file to be put in an archive
+type archiveEntry struct {
+	// Path of the file within the archive
+	name string
+	// Path of the file in the repository
+	fileName string
+	comment  string
+	manifest ManifestFile
+}
+
+// acquisitionArchiveEntries returns the files of "acq" that are put in
+// archives, within the folder "root", if they are included in "selection".
+// The raw and science files and the files of the acquisition must have
+// already been loaded.
+func acquisitionArchiveEntries(acq *Acquisition, root string, fileKinds []FileKind,
+	selection archiveSelection) []archiveEntry {
+	acqURL := acq.SelfURL()
+
+	var entries []archiveEntry
+	for _, raw := range acq.RawFiles {
+		entries = append(entries, archiveEntry{
+			name:     path.Join(root, "Raws", path.Base(raw.FileName)),
+			fileName: raw.FileName,
+			comment:  "FITS file containing raw ASIC data",
+			manifest: ManifestFile{
+				Kind:       "raw",
+				AsicNumber: raw.AsicNumber,
+				URL:        fmt.Sprintf("%s/rawdata/%d", acqURL, raw.AsicNumber),
+				Missing:    raw.Missing,
+				FileInfo:   raw.FileInfo,
+			},
+		})
+	}
+
+	for _, sum := range acq.SumFiles {
+		entries = append(entries, archiveEntry{
+			name:     path.Join(root, "Sums", path.Base(sum.FileName)),
+			fileName: sum.FileName,
+			comment:  "FITS file containing scientific ASIC data",
+			manifest: ManifestFile{
+				Kind:       "sum",
+				AsicNumber: sum.AsicNumber,
+				URL:        fmt.Sprintf("%s/sumdata/%d", acqURL, sum.AsicNumber),
+				Missing:    sum.Missing,
+				FileInfo:   sum.FileInfo,
+			},
+		})
+	}
+
+	for _, kind := range fileKinds {
+		for index, file := range acq.FilesOfKind(kind.Name) {
+			entries = append(entries, archiveEntry{
+				name:     path.Join(root, kind.Directory, file.BaseName()),
+				fileName: file.FileName,
+				comment:  kind.Description,
+				manifest: ManifestFile{
+					Kind:     kind.Name,
+					URL:      fmt.Sprintf("%s/files/%s/%d", acqURL, kind.Name, index),
+					Missing:  file.Missing,
+					FileInfo: file.FileInfo,
+				},
+			})
+		}
+	}
+
+	var selected []archiveEntry
+	for _, entry := range entries {
+		if selection.includes(entry.manifest) {
+			entry.manifest.FileName = entry.name
+			selected = append(selected, entry)
+		}
+	}
+
+	return selected
+}
+
+// An archiveBuilder adds the files of acquisitions to an archive, creating
+// the directories that contain them
+type archiveBuilder struct {
+	writer      archiveWriter
+	fileKinds   []FileKind
+	selection   archiveSelection
+	createdDirs map[string]bool
+}
+
+// mkdirAll creates the directory "dirname" in the archive, together with its
+// parents, unless they have already been created
+func (b *archiveBuilder) mkdirAll(dirname string) error {
+	// Parent directories must be created first
+	var parents []string
+	for dir := path.Clean(dirname); !b.createdDirs[dir]; dir = path.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+
+	for _, dir := range parents {
+		if err := b.writer.addDir(dir); err != nil {
+			return Error{err: err, msg: "Unable to create directory structure in the archive"}
+		}
+		b.createdDirs[dir] = true
+	}
+
+	return nil
+}
+
+// addManifest adds "manifest" to the archive in JSON format, with name
+// "name". Manifests should be added before the files they describe, so that
+// clients reading the archive as a stream get them first.
+func (b *archiveBuilder) addManifest(name string, manifest interface{}) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the manifest"}
+	}
+
+	return b.addData(name, data)
+}
+
+// bundleManifest describes the files of "acqs" that addAcquisitions puts in
+// the archive
+func (b *archiveBuilder) bundleManifest(acqs []Acquisition, rootOf func(*Acquisition) string) BundleManifest {
+	return bundleManifest(acqs, rootOf, b.fileKinds, b.selection)
+}
+
+// addAcquisitions adds the selected files of "acqs" to the archive, each in
+// the folder returned by "rootOf"
+func (b *archiveBuilder) addAcquisitions(acqs []Acquisition, rootOf func(*Acquisition) string) error {
+	for i := range acqs {
+		if err := b.addAcquisition(&acqs[i], rootOf(&acqs[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addAcquisition adds the selected files of "acq" to the archive, within the
+// folder "root". Files that are no longer in the repository are skipped.
+func (b *archiveBuilder) addAcquisition(acq *Acquisition, root string) error {
+	if err := b.mkdirAll(root); err != nil {
+		return err
+	}
+
+	for _, entry := range acquisitionArchiveEntries(acq, root, b.fileKinds, b.selection) {
+		if entry.manifest.Missing {
+			continue
+		}
+
+		if err := b.mkdirAll(path.Dir(entry.name)); err != nil {
+			return err
+		}
+		if err := b.writer.addFile(entry.name, entry.fileName, entry.comment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// selectedSize returns the total size of the files of "acqs" that
+// addAcquisition would put in the archive
+func (b *archiveBuilder) selectedSize(acqs []Acquisition) int64 {
+	var size int64
+	for i := range acqs {
+		for _, entry := range acquisitionArchiveEntries(&acqs[i], "", b.fileKinds, b.selection) {
+			if !entry.manifest.Missing {
+				size += entry.manifest.Size
+			}
+		}
+	}
+
+	return size
+}
+
+// addData adds a file containing "data" to the archive
+func (b *archiveBuilder) addData(name string, data []byte) error {
+	if err := b.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	if err := b.writer.addData(name, data); err != nil {
+		return Error{err: err, msg: fmt.Sprintf("Unable to add %s to the archive", name)}
+	}
+	return nil
+}
+
+// serveArchive sends an archive whose contents are added by "fill" over the
+// HTTP connection, while it is being built. The name of the archive is
+// "baseName" followed by the extension of the format. The format and the
+// files to include are read from the parameters of the request ("format",
+// "content" and "asic").
+func serveArchive(w http.ResponseWriter, r *http.Request, baseName string, fileKinds []FileKind,
+	fill func(*archiveBuilder) error) error {
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "zip"
+	}
+	format, ok := archiveFormats[formatName]
+	if !ok {
+		return Error{
+			msg:  fmt.Sprintf("Unknown archive format %q, use one of zip, tar, tar.gz", formatName),
+			code: http.StatusBadRequest,
+		}
+	}
+
+	selection, err := parseArchiveSelection(r.URL.Query(), fileKinds)
+	if err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	// The size of the archive is not known in advance, so it is sent in
+	// chunks and ranges are not supported
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", contentDisposition(baseName+format.extension))
+	w.Header().Set("Accept-Ranges", "none")
+
+	writer := trackingWriter{w: w}
+	builder := archiveBuilder{
+		writer:      format.newWriter(&writer),
+		fileKinds:   fileKinds,
+		selection:   selection,
+		createdDirs: map[string]bool{"": true, ".": true, "/": true},
+	}
+	err = fill(&builder)
+	if err == nil {
+		err = builder.writer.Close()
+	}
+	if err == nil {
+		return nil
+	}
+
+	if !writer.written {
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Accept-Ranges")
+		return err
+	}
+
+	// It is too late to send an error to the client: break the connection,
+	// so that the client does not take the truncated archive for a complete
+	// one
+	log.WithFields(log.Fields{
+		"archive": baseName + format.extension,
+		"error":   err,
+	}).Error("Unable to complete the archive")
+	panic(http.ErrAbortHandler)
+}
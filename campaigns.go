@@ -0,0 +1,339 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that groups acquisitions into campaigns
+
+package qutedb
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A Campaign is a group of acquisitions, e.g., the tests done in the same
+// laboratory over some weeks. Each acquisition belongs to one campaign at
+// most.
+//
+// Acquisitions can be assigned to a campaign manually or through its rules:
+// an acquisition matches the rules if its time falls between StartTime and
+// EndTime and its name matches NameMask.
+type Campaign struct {
+	ID          uint      `json:"-" gorm:"primary_key"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name" gorm:"unique_index"`
+	Description string    `json:"description"`
+	// Time span of the campaign, in the same format as
+	// Acquisition.AcquisitionTime. Empty strings mean that the span is open.
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	// Pattern matched by the names of the acquisitions, using POSIX
+	// wildcards. An empty pattern matches all the names.
+	NameMask string `json:"name_mask"`
+	// If true, new acquisitions matching the rules are assigned to the
+	// campaign as soon as they are added to the database
+	AutoAssign bool `json:"auto_assign"`
+
+	NumOfAcquisitions int `json:"num_of_acquisitions" gorm:"-"`
+}
+
+// campaignNameRe matches valid campaign names, which are used in URLs
+var campaignNameRe = regexp.MustCompile("^[A-Za-z0-9][-_.A-Za-z0-9]{0,63}$")
+
+// parseTimeBound converts "str", one of the ends of a time span, into the
+// format used by Acquisition.AcquisitionTime. Dates without a time refer to the beginning of
+// the day, or to its end if "endOfDay" is true.
+func parseTimeBound(str string, endOfDay bool) (string, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return "", nil
+	}
+
+	if t, err := time.Parse("2006-01-02T15:04:05", str); err == nil {
+		return TimeToCanonicalStr(t), nil
+	}
+
+	t, err := time.Parse("2006-01-02", str)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q, it should be either YYYY-MM-DD or YYYY-MM-DDThh:mm:ss", str)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return TimeToCanonicalStr(t), nil
+}
+
+// validate checks the fields of the campaign
+func (campaign *Campaign) validate() error {
+	if !campaignNameRe.MatchString(campaign.Name) {
+		return fmt.Errorf("invalid name %q for the campaign: use only letters, digits, '-', '_' and '.'",
+			campaign.Name)
+	}
+
+	if campaign.StartTime != "" && campaign.EndTime != "" && campaign.StartTime > campaign.EndTime {
+		return fmt.Errorf("the campaign ends (%s) before it starts (%s)", campaign.EndTime, campaign.StartTime)
+	}
+
+	if _, err := filepath.Match(campaign.NameMask, ""); err != nil {
+		return fmt.Errorf("invalid mask %q: %s", campaign.NameMask, err)
+	}
+
+	return nil
+}
+
+// matches returns true if "acq" satisfies the rules of the campaign
+func (campaign *Campaign) matches(acq *Acquisition) bool {
+	if campaign.StartTime != "" && acq.AcquisitionTime < campaign.StartTime {
+		return false
+	}
+	if campaign.EndTime != "" && acq.AcquisitionTime > campaign.EndTime {
+		return false
+	}
+
+	if campaign.NameMask == "" {
+		return true
+	}
+	matched, err := filepath.Match(campaign.NameMask, acq.Name)
+	return err == nil && matched
+}
+
+// CreateCampaign saves a new campaign in the database
+func CreateCampaign(db *gorm.DB, campaign *Campaign) error {
+	if err := campaign.validate(); err != nil {
+		return err
+	}
+
+	if other, err := QueryCampaign(db, campaign.Name); err != nil {
+		return err
+	} else if other != nil {
+		return fmt.Errorf("a campaign named %q already exists", campaign.Name)
+	}
+
+	return db.Create(campaign).Error
+}
+
+// UpdateCampaign saves the changes to the description, the time span and the
+// rules of the campaign. Acquisitions already assigned to the campaign are
+// not affected.
+func UpdateCampaign(db *gorm.DB, campaign *Campaign) error {
+	if err := campaign.validate(); err != nil {
+		return err
+	}
+
+	return db.Model(campaign).Updates(map[string]interface{}{
+		"description": campaign.Description,
+		"start_time":  campaign.StartTime,
+		"end_time":    campaign.EndTime,
+		"name_mask":   campaign.NameMask,
+		"auto_assign": campaign.AutoAssign,
+	}).Error
+}
+
+// DeleteCampaign removes the campaign from the database. Its acquisitions are
+// not removed, but they no longer belong to any campaign.
+func DeleteCampaign(db *gorm.DB, campaign *Campaign) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Acquisition{}).
+			Where("campaign = ?", campaign.Name).
+			UpdateColumn("campaign", "").Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(campaign).Error
+	})
+}
+
+// countAcquisitions fills the field NumOfAcquisitions of the campaigns
+func countAcquisitions(db *gorm.DB, campaigns []Campaign) error {
+	var counts []struct {
+		Campaign string
+		Count    int
+	}
+	if err := db.Model(&Acquisition{}).
+		Select("campaign, COUNT(*) AS count").
+		Where("campaign <> ''").
+		Group("campaign").
+		Scan(&counts).Error; err != nil {
+		return err
+	}
+
+	countOf := map[string]int{}
+	for _, c := range counts {
+		countOf[c.Campaign] = c.Count
+	}
+	for i := range campaigns {
+		campaigns[i].NumOfAcquisitions = countOf[campaigns[i].Name]
+	}
+
+	return nil
+}
+
+// QueryCampaigns returns all the campaigns in the database, most recent first
+func QueryCampaigns(db *gorm.DB) ([]Campaign, error) {
+	campaigns := []Campaign{}
+	if err := db.Order("start_time desc, name").Find(&campaigns).Error; err != nil {
+		return nil, err
+	}
+
+	if err := countAcquisitions(db, campaigns); err != nil {
+		return nil, err
+	}
+
+	return campaigns, nil
+}
+
+// QueryCampaign returns the campaign named "name", or nil if there is no such
+// campaign
+func QueryCampaign(db *gorm.DB, name string) (*Campaign, error) {
+	var campaign Campaign
+	result := db.Where("name = ?", name).First(&campaign)
+	if result.RecordNotFound() {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	campaigns := []Campaign{campaign}
+	if err := countAcquisitions(db, campaigns); err != nil {
+		return nil, err
+	}
+
+	return &campaigns[0], nil
+}
+
+// QueryCampaignAcquisitions returns the acquisitions belonging to the
+// campaign, sorted by time. If "withFiles" is true, their raw, science and
+// data files are loaded as well.
+func QueryCampaignAcquisitions(db *gorm.DB, campaign *Campaign, withFiles bool) ([]Acquisition, error) {
+	if withFiles {
+		db = preloadFiles(db)
+	}
+
+	acqs := []Acquisition{}
+	if err := preloadTags(db).
+		Where("campaign = ?", campaign.Name).
+		Order("acquisition_time").
+		Find(&acqs).Error; err != nil {
+		return nil, err
+	}
+
+	return acqs, nil
+}
+
+// preloadFiles makes "db" load the raw, science and data files of the
+// acquisitions, in the same order as QueryAcquisition
+func preloadFiles(db *gorm.DB) *gorm.DB {
+	return db.
+		Preload("RawFiles", func(db *gorm.DB) *gorm.DB { return db.Order("asic_number") }).
+		Preload("SumFiles", func(db *gorm.DB) *gorm.DB { return db.Order("asic_number") }).
+		Preload("Files", func(db *gorm.DB) *gorm.DB { return db.Order("file_name") })
+}
+
+// AssignToCampaign assigns the acquisitions listed in "acqIDs" to the
+// campaign, even if they belong to another one. See findAcquisition for the
+// values accepted in "acqIDs"; nothing is changed if some of them does not
+// identify exactly one acquisition.
+func AssignToCampaign(db *gorm.DB, campaign *Campaign, acqIDs []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, acqID := range acqIDs {
+			acq, err := findAcquisition(tx, acqID)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Acquisition{}).
+				Where("id = ?", acq.ID).
+				UpdateColumn("campaign", campaign.Name).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// RemoveFromCampaign removes "acq" from the campaign
+func RemoveFromCampaign(db *gorm.DB, campaign *Campaign, acq *Acquisition) error {
+	return db.Model(&Acquisition{}).
+		Where("id = ? AND campaign = ?", acq.ID, campaign.Name).
+		UpdateColumn("campaign", "").Error
+}
+
+// ApplyCampaignRules assigns to the campaign the acquisitions that match its
+// rules and do not belong to any campaign yet. It returns the number of
+// acquisitions that have been assigned.
+func ApplyCampaignRules(db *gorm.DB, campaign *Campaign) (int, error) {
+	var acqs []Acquisition
+	query := db.Where("campaign = ''")
+	if campaign.StartTime != "" {
+		query = query.Where("acquisition_time >= ?", campaign.StartTime)
+	}
+	if campaign.EndTime != "" {
+		query = query.Where("acquisition_time <= ?", campaign.EndTime)
+	}
+	if err := query.Find(&acqs).Error; err != nil {
+		return 0, err
+	}
+
+	var ids []uint
+	for i := range acqs {
+		if campaign.matches(&acqs[i]) {
+			ids = append(ids, acqs[i].ID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if err := db.Model(&Acquisition{}).
+		Where("id IN (?)", ids).
+		UpdateColumn("campaign", campaign.Name).Error; err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
+
+// campaignByRules returns the name of the first campaign whose rules are
+// matched by a new acquisition, among those with AutoAssign set. It returns
+// an empty string if there is no such campaign.
+func campaignByRules(db *gorm.DB, acq *Acquisition) (string, error) {
+	var campaigns []Campaign
+	if err := db.Where("auto_assign = ?", true).Order("id").Find(&campaigns).Error; err != nil {
+		return "", err
+	}
+
+	for i := range campaigns {
+		if campaigns[i].matches(acq) {
+			return campaigns[i].Name, nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,230 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that records and verifies the size and the
+// checksum of the files in the repository
+
+package qutedb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// FileInfo contains the information needed to check that a file in the
+// repository has not been modified since it was added to the database
+type FileInfo struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// SHA-256 hash of the contents of the file, encoded as a hexadecimal string
+	Sha256 string `json:"sha256"`
+	// Either "" (no compression), "gzip", or "tiled"
+	Compression string `json:"compression"`
+}
+
+// computeFileInfo reads the whole file "filename" and returns its size,
+// modification time, checksum and compression
+func computeFileInfo(filename string) (FileInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime().UTC(),
+		Sha256:      hex.EncodeToString(hash.Sum(nil)),
+		Compression: compressionOf(filename),
+	}, nil
+}
+
+// fillMissingFileInfo computes the size and checksum of those files belonging
+// to "acq" that were added to the database by older versions of QuTeDB, and
+// it reads their FITS headers as well. The raw and science files must have
+// already been loaded in "acq".
+func fillMissingFileInfo(db *gorm.DB, acq *Acquisition) error {
+	for i := range acq.RawFiles {
+		raw := &acq.RawFiles[i]
+		if raw.Sha256 != "" || !fileExists(raw.FileName) {
+			continue
+		}
+
+		info, err := computeFileInfo(raw.FileName)
+		if err != nil {
+			return err
+		}
+		raw.FileInfo = info
+		if err := db.Model(raw).UpdateColumns(info).Error; err != nil {
+			return err
+		}
+
+		if hdus := loadFitsHeaders(raw.FileName); len(hdus) > 0 {
+			if err := db.Model(raw).Association("Hdus").Append(hdus).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range acq.SumFiles {
+		sum := &acq.SumFiles[i]
+		if sum.Sha256 != "" || !fileExists(sum.FileName) {
+			continue
+		}
+
+		info, err := computeFileInfo(sum.FileName)
+		if err != nil {
+			return err
+		}
+		sum.FileInfo = info
+		if err := db.Model(sum).UpdateColumns(info).Error; err != nil {
+			return err
+		}
+
+		if hdus := loadFitsHeaders(sum.FileName); len(hdus) > 0 {
+			if err := db.Model(sum).Association("Hdus").Append(hdus).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// A ChecksumMismatch describes a file whose contents do not match the
+// information recorded in the database
+type ChecksumMismatch struct {
+	FileName string `json:"file_name"`
+	// Either "missing", "size", or "checksum"
+	Reason   string   `json:"reason"`
+	Expected FileInfo `json:"expected"`
+	Actual   FileInfo `json:"actual"`
+}
+
+// A VerificationReport summarizes the result of a call to VerifyChecksums
+type VerificationReport struct {
+	NumOfFiles int                `json:"num_of_files"`
+	Mismatches []ChecksumMismatch `json:"mismatches"`
+}
+
+// verifyFile compares the file "filename" with the information recorded in
+// "expected". It returns nil if the two match.
+func verifyFile(filename string, expected FileInfo) *ChecksumMismatch {
+	mismatch := ChecksumMismatch{FileName: filename, Expected: expected}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		mismatch.Reason = "missing"
+		return &mismatch
+	}
+
+	// Do not bother computing the checksum if the size has changed
+	if stat.Size() != expected.Size {
+		mismatch.Reason = "size"
+		mismatch.Actual = FileInfo{Size: stat.Size(), ModTime: stat.ModTime().UTC()}
+		return &mismatch
+	}
+
+	actual, err := computeFileInfo(filename)
+	if err != nil {
+		mismatch.Reason = "missing"
+		return &mismatch
+	}
+
+	if actual.Sha256 != expected.Sha256 {
+		mismatch.Reason = "checksum"
+		mismatch.Actual = actual
+		return &mismatch
+	}
+
+	return nil
+}
+
+// VerifyChecksums reads every file in the database and checks that its size
+// and checksum match the ones computed when the file was added. Files for
+// which no checksum is available are skipped.
+func VerifyChecksums(db *gorm.DB) (*VerificationReport, error) {
+	report := VerificationReport{Mismatches: []ChecksumMismatch{}}
+	check := func(filename string, info FileInfo) {
+		if info.Sha256 == "" {
+			return
+		}
+
+		report.NumOfFiles++
+		if mismatch := verifyFile(filename, info); mismatch != nil {
+			log.WithFields(log.Fields{
+				"file_name": filename,
+				"reason":    mismatch.Reason,
+			}).Warning("File does not match the information in the database")
+			report.Mismatches = append(report.Mismatches, *mismatch)
+		}
+	}
+
+	var rawFiles []RawDataFile
+	if err := db.Find(&rawFiles).Error; err != nil {
+		return nil, err
+	}
+	for _, raw := range rawFiles {
+		check(raw.FileName, raw.FileInfo)
+	}
+
+	var sumFiles []SumDataFile
+	if err := db.Find(&sumFiles).Error; err != nil {
+		return nil, err
+	}
+	for _, sum := range sumFiles {
+		check(sum.FileName, sum.FileInfo)
+	}
+
+	var dataFiles []DataFile
+	if err := db.Find(&dataFiles).Error; err != nil {
+		return nil, err
+	}
+	for _, file := range dataFiles {
+		check(file.FileName, file.FileInfo)
+	}
+
+	log.WithFields(log.Fields{
+		"num_of_files":      report.NumOfFiles,
+		"num_of_mismatches": len(report.Mismatches),
+	}).Info("Checksums have been verified")
+
+	return &report, nil
+}
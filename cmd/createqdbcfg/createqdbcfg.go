@@ -27,6 +27,12 @@ func main() {
 		"Path to the folder containing the static files to be served")
 	var repositorypath = flag.String("repositorypath", "./",
 		"Path to the folder containing the repository with the FITS files")
+	var watch = flag.Bool("watch", true,
+		"Watch the repository for new acquisitions while the server is running")
+	var watchdelay = flag.Int64("watchdelay", 10,
+		"Seconds to wait after the last change in a folder before ingesting it")
+	var scanworkers = flag.Int("scanworkers", qdb.DefaultScanWorkers,
+		"Number of folders to scan concurrently when the server starts")
 	var dbfile = flag.String("dbfile", "./db.sqlite3",
 		"Full name (with path) to the SQLite3 database file")
 	var servername = flag.String("servername", "127.0.0.1",
@@ -39,18 +45,22 @@ func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	conf := qdb.Configuration{
-		DatabaseFile:   *dbfile,
-		LogOutput:      *logoutput,
-		LogFormat:      *logformat,
-		LogLevel:       *loglevel,
-		PortNumber:     *portnum,
-		ServerName:     *servername,
-		StaticPath:     *staticpath,
-		RepositoryPath: *repositorypath,
-		ReadTimeout:    15,
-		WriteTimeout:   60,
-		CookieHashKey:  securecookie.GenerateRandomKey(*hashlength),
-		CookieBlockKey: securecookie.GenerateRandomKey(*blocklength),
+		DatabaseFile:    *dbfile,
+		LogOutput:       *logoutput,
+		LogFormat:       *logformat,
+		LogLevel:        *loglevel,
+		PortNumber:      *portnum,
+		ServerName:      *servername,
+		StaticPath:      *staticpath,
+		RepositoryPath:  *repositorypath,
+		WatchRepository: *watch,
+		WatchDelay:      *watchdelay,
+		ScanWorkers:     *scanworkers,
+		ReadTimeout:     15,
+		WriteTimeout:    60,
+		CookieHashKey:   securecookie.GenerateRandomKey(*hashlength),
+		CookieBlockKey:  securecookie.GenerateRandomKey(*blocklength),
+		FileKinds:       qdb.DefaultFileKinds,
 	}
 
 	json, err := json.MarshalIndent(conf, "", "    ")
@@ -0,0 +1,164 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file implements the electronic logbook, i.e., the comments that users
+// write about acquisitions
+
+package qutedb
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// maxCommentLength is the maximum length of the body of a comment, in bytes
+const maxCommentLength = 64 * 1024
+
+// A Comment is an entry in the logbook of an acquisition. Its body is
+// written using Markdown.
+type Comment struct {
+	ID            uint      `json:"id" gorm:"primary_key"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	AcquisitionID uint      `json:"-" gorm:"index"`
+	UserID        uint      `json:"-"`
+	// E-mail of the user who wrote the comment. It is kept even if the user
+	// is deleted.
+	Author string `json:"author"`
+	Body   string `json:"body" gorm:"type:text"`
+}
+
+// markdown converts the body of comments into HTML. Raw HTML and links to
+// dangerous URLs (e.g., "javascript:") are dropped, so that users cannot
+// inject scripts in the pages.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// renderMarkdown converts "source" into HTML that is safe to include in a
+// page
+func renderMarkdown(source string) template.HTML {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+
+	return template.HTML(buf.String())
+}
+
+// HTML returns the body of the comment converted into HTML
+func (comment *Comment) HTML() template.HTML {
+	return renderMarkdown(comment.Body)
+}
+
+// Edited returns true if the comment has been modified after it was written
+func (comment *Comment) Edited() bool {
+	return comment.UpdatedAt.Sub(comment.CreatedAt) > time.Second
+}
+
+// CanBeModifiedBy returns true if "user" can edit or delete the comment: this
+// is allowed only to its author and to superusers
+func (comment *Comment) CanBeModifiedBy(user *User) bool {
+	return user != nil && (user.Superuser || user.ID == comment.UserID)
+}
+
+// checkCommentBody returns an error if "body" cannot be used as the body of a
+// comment
+func checkCommentBody(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return fmt.Errorf("the comment is empty")
+	}
+	if len(body) > maxCommentLength {
+		return fmt.Errorf("the comment is too long (%d bytes, the maximum is %d)",
+			len(body), maxCommentLength)
+	}
+
+	return nil
+}
+
+// AddComment adds a comment written by "user" to the logbook of the
+// acquisition
+func AddComment(db *gorm.DB, acq *Acquisition, user *User, body string) (*Comment, error) {
+	if err := checkCommentBody(body); err != nil {
+		return nil, err
+	}
+
+	comment := Comment{
+		AcquisitionID: acq.ID,
+		UserID:        user.ID,
+		Author:        user.Email,
+		Body:          body,
+	}
+	if err := db.Create(&comment).Error; err != nil {
+		return nil, err
+	}
+
+	return &comment, nil
+}
+
+// UpdateComment replaces the body of the comment
+func UpdateComment(db *gorm.DB, comment *Comment, body string) error {
+	if err := checkCommentBody(body); err != nil {
+		return err
+	}
+
+	return db.Model(comment).Update("body", body).Error
+}
+
+// DeleteComment removes the comment from the logbook
+func DeleteComment(db *gorm.DB, comment *Comment) error {
+	return db.Delete(comment).Error
+}
+
+// QueryComments returns the comments of the acquisition, oldest first
+func QueryComments(db *gorm.DB, acq *Acquisition) ([]Comment, error) {
+	comments := []Comment{}
+	if err := db.Where("acquisition_id = ?", acq.ID).
+		Order("created_at, id").
+		Find(&comments).Error; err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+// QueryComment returns the comment with ID "commentID" in the logbook of the
+// acquisition, or nil if there is no such comment
+func QueryComment(db *gorm.DB, acq *Acquisition, commentID int) (*Comment, error) {
+	var comment Comment
+	result := db.Where("acquisition_id = ? AND id = ?", acq.ID, commentID).First(&comment)
+	if result.RecordNotFound() {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &comment, nil
+}
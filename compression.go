@@ -0,0 +1,141 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that handles compressed FITS files
+
+package qutedb
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of compression recognized by QuTeDB. The value is saved in
+// FileInfo.Compression.
+const (
+	compressionNone = ""
+	// The whole file has been compressed using gzip (".fits.gz")
+	compressionGzip = "gzip"
+	// The images in the file have been compressed using the tiled image
+	// convention, e.g., by fpack (".fits.fz")
+	compressionTiled = "tiled"
+)
+
+// compressedSuffixes associates the extensions of compressed files with the
+// kind of compression
+var compressedSuffixes = map[string]string{
+	".gz": compressionGzip,
+	".fz": compressionTiled,
+}
+
+// compressionOf returns the kind of compression used by "filename", judging
+// from its extension
+func compressionOf(filename string) string {
+	return compressedSuffixes[strings.ToLower(filepath.Ext(filename))]
+}
+
+// uncompressedName returns the name that "filename" would have if it were not
+// compressed
+func uncompressedName(filename string) string {
+	if compressionOf(filename) == compressionNone {
+		return filename
+	}
+
+	return strings.TrimSuffix(filename, filepath.Ext(filename))
+}
+
+// matchesMask returns true if the name of the file matches "mask", either
+// directly or once the extension of the compression has been removed. In this
+// way, masks like "*.fits" match compressed files like "a.fits.gz" as well.
+func matchesMask(mask string, name string) bool {
+	if matched, err := filepath.Match(mask, name); err == nil && matched {
+		return true
+	}
+
+	if compressionOf(name) == compressionNone {
+		return false
+	}
+
+	matched, err := filepath.Match(mask, uncompressedName(name))
+	return err == nil && matched
+}
+
+// A gzipFile reads the decompressed contents of a gzipped file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
+
+// openFitsFile opens a FITS file for reading. Gzipped files are decompressed
+// while they are read, while files using tiled compression are returned as
+// they are, because they are valid FITS files.
+func openFitsFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if compressionOf(filename) != compressionGzip {
+		return f, nil
+	}
+
+	reader, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &gzipFile{Reader: reader, file: f}, nil
+}
+
+// decompressFitsFile writes the decompressed contents of the FITS file
+// "filename" into "w". Files that are not compressed are copied as they are.
+func decompressFitsFile(w io.Writer, filename string) error {
+	if compressionOf(filename) == compressionTiled {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return decompressTiledFits(w, f)
+	}
+
+	f, err := openFitsFile(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
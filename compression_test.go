@@ -0,0 +1,414 @@
+package qutedb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/astrogo/fitsio"
+)
+
+func TestMatchesMask(t *testing.T) {
+	for _, c := range []struct {
+		mask     string
+		name     string
+		expected bool
+	}{
+		{"raw-asic*.fits", "raw-asic1.fits", true},
+		{"raw-asic*.fits", "raw-asic1.fits.gz", true},
+		{"raw-asic*.fits", "raw-asic1.fits.fz", true},
+		{"raw-asic*.fits", "raw-asic1.fits.bz2", false},
+		{"raw-asic*.fits", "raw-asic1.txt.gz", false},
+		{"*.gz", "notes.gz", true},
+	} {
+		if matchesMask(c.mask, c.name) != c.expected {
+			t.Errorf("matchesMask(%q, %q) is not %v", c.mask, c.name, c.expected)
+		}
+	}
+
+	if uncompressedName("a/b.fits.fz") != "a/b.fits" || uncompressedName("b.fits") != "b.fits" {
+		t.Errorf("Wrong result from uncompressedName")
+	}
+}
+
+// A bitWriter writes a stream of bits, starting from the most significant bit
+// of each byte
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) writeBits(value uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if (value>>i)&1 == 1 {
+			w.data[len(w.data)-1] |= 1 << (7 - w.pos%8)
+		}
+		w.pos++
+	}
+}
+
+// riceCompress encodes "values" using the RICE_1 algorithm, as CFITSIO does
+func riceCompress(values []uint64, blockSize int, bytePix int) []byte {
+	params := riceParameters[bytePix]
+	bbits := 8 * bytePix
+	mask := uint64(1)<<bbits - 1
+
+	var w bitWriter
+	w.writeBits(values[0], bbits)
+	lastPix := values[0]
+	for start := 0; start < len(values); start += blockSize {
+		end := start + blockSize
+		if end > len(values) {
+			end = len(values)
+		}
+
+		// Map the differences to non-negative numbers: 0, -1, 1, -2, 2...
+		var mapped []uint64
+		var sum uint64
+		for _, value := range values[start:end] {
+			diff := int64(((value-lastPix)&mask)<<(64-bbits)) >> (64 - bbits)
+			lastPix = value
+
+			var m uint64
+			if diff < 0 {
+				m = uint64(^(diff << 1))
+			} else {
+				m = uint64(diff << 1)
+			}
+			mapped = append(mapped, m)
+			sum += m
+		}
+
+		fs := bits.Len64(sum/uint64(len(mapped))) - 1
+		switch {
+		case sum == 0:
+			w.writeBits(0, params.fsBits)
+
+		case fs >= params.fsMax-1:
+			w.writeBits(uint64(params.fsMax+1), params.fsBits)
+			for _, m := range mapped {
+				w.writeBits(m, bbits)
+			}
+
+		default:
+			if fs < 0 {
+				fs = 0
+			}
+			w.writeBits(uint64(fs+1), params.fsBits)
+			for _, m := range mapped {
+				w.writeBits(1, int(m>>fs)+1)
+				w.writeBits(m&(1<<fs-1), fs)
+			}
+		}
+	}
+
+	return w.data
+}
+
+func TestRiceDecompress(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, bytePix := range []int{1, 2, 4} {
+		mask := uint64(1)<<(8*bytePix) - 1
+
+		var values []uint64
+		// Low-entropy block
+		for i := 0; i < 32; i++ {
+			values = append(values, 17)
+		}
+		// Normal blocks
+		for i := 0; i < 64; i++ {
+			values = append(values, uint64(100+rng.Intn(20)-10)&mask)
+		}
+		// High-entropy block, followed by an incomplete block
+		for i := 0; i < 40; i++ {
+			values = append(values, rng.Uint64()&mask)
+		}
+
+		result, err := riceDecompress(riceCompress(values, 32, bytePix), len(values), 32, bytePix)
+		if err != nil {
+			t.Fatalf("Unable to decompress data with BYTEPIX=%d: %s", bytePix, err)
+		}
+		for i := range values {
+			if result[i] != values[i] {
+				t.Fatalf("Wrong value #%d with BYTEPIX=%d: %d instead of %d",
+					i, bytePix, result[i], values[i])
+			}
+		}
+	}
+
+	if _, err := riceDecompress([]byte{1, 2, 3, 4}, 100, 32, 2); err == nil {
+		t.Errorf("No error for truncated data")
+	}
+}
+
+// fitsCard returns a card with the given keyword and value. Strings must be
+// enclosed in quotes.
+func fitsCard(keyword string, value string) string {
+	if value[0] == '\'' {
+		return fmt.Sprintf("%-8s= %-70s", keyword, value)
+	}
+	return fmt.Sprintf("%-8s= %20s%50s", keyword, value, "")
+}
+
+// fitsHdu returns the header and the data of a HDU, padded to the size of a
+// FITS block
+func fitsHdu(cards []string, data []byte) []byte {
+	var buf bytes.Buffer
+	writeRawFitsHeader(&buf, cards)
+	buf.Write(data)
+	buf.Write(make([]byte, paddedSize(len(data))-len(data)))
+	return buf.Bytes()
+}
+
+// compressedImageHdu returns a HDU containing a 2D image of 16-bit integers,
+// compressed using "compress"
+func compressedImageHdu(algorithm string, pixels []int16, axes [2]int, tileAxes [2]int,
+	compress func(tile []int16) []byte) []byte {
+	var table, heap bytes.Buffer
+	numOfTiles := 0
+	for y := 0; y < axes[1]; y += tileAxes[1] {
+		for x := 0; x < axes[0]; x += tileAxes[0] {
+			var tile []int16
+			for j := y; j < y+tileAxes[1] && j < axes[1]; j++ {
+				for i := x; i < x+tileAxes[0] && i < axes[0]; i++ {
+					tile = append(tile, pixels[j*axes[0]+i])
+				}
+			}
+
+			data := compress(tile)
+			binary.Write(&table, binary.BigEndian, []uint32{uint32(len(data)), uint32(heap.Len())})
+			heap.Write(data)
+			numOfTiles++
+		}
+	}
+
+	cards := []string{
+		fitsCard("XTENSION", "'BINTABLE'"),
+		fitsCard("BITPIX", "8"),
+		fitsCard("NAXIS", "2"),
+		fitsCard("NAXIS1", "8"),
+		fitsCard("NAXIS2", fmt.Sprint(numOfTiles)),
+		fitsCard("PCOUNT", fmt.Sprint(heap.Len())),
+		fitsCard("GCOUNT", "1"),
+		fitsCard("TFIELDS", "1"),
+		fitsCard("TTYPE1", "'COMPRESSED_DATA'"),
+		fitsCard("TFORM1", "'1PB'"),
+		fitsCard("ZIMAGE", "T"),
+		fitsCard("ZBITPIX", "16"),
+		fitsCard("ZNAXIS", "2"),
+		fitsCard("ZNAXIS1", fmt.Sprint(axes[0])),
+		fitsCard("ZNAXIS2", fmt.Sprint(axes[1])),
+		fitsCard("ZTILE1", fmt.Sprint(tileAxes[0])),
+		fitsCard("ZTILE2", fmt.Sprint(tileAxes[1])),
+		fitsCard("ZCMPTYPE", fmt.Sprintf("'%s'", algorithm)),
+		fitsCard("EXTNAME", fmt.Sprintf("'%s'", algorithm)),
+	}
+
+	return fitsHdu(cards, append(table.Bytes(), heap.Bytes()...))
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestDecompressTiledFits(t *testing.T) {
+	// The size of the image is not a multiple of the size of the tiles
+	axes := [2]int{7, 5}
+	pixels := make([]int16, axes[0]*axes[1])
+	for i := range pixels {
+		pixels[i] = int16(1000 - 97*i)
+	}
+
+	rice := func(tile []int16) []byte {
+		values := make([]uint64, len(tile))
+		for i, pixel := range tile {
+			values[i] = uint64(uint16(pixel))
+		}
+		return riceCompress(values, 32, 2)
+	}
+	gzip1 := func(tile []int16) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, tile)
+		return gzipBytes(buf.Bytes())
+	}
+	gzip2 := func(tile []int16) []byte {
+		// Most significant bytes come first
+		data := make([]byte, 2*len(tile))
+		for i, pixel := range tile {
+			data[i] = byte(uint16(pixel) >> 8)
+			data[len(tile)+i] = byte(pixel)
+		}
+		return gzipBytes(data)
+	}
+
+	var file bytes.Buffer
+	file.Write(fitsHdu([]string{
+		fitsCard("SIMPLE", "T"),
+		fitsCard("BITPIX", "8"),
+		fitsCard("NAXIS", "0"),
+		fitsCard("EXTEND", "T"),
+	}, nil))
+	file.Write(compressedImageHdu("RICE_1", pixels, axes, [2]int{3, 2}, rice))
+	file.Write(compressedImageHdu("GZIP_1", pixels, axes, [2]int{7, 1}, gzip1))
+	file.Write(compressedImageHdu("GZIP_2", pixels, axes, [2]int{2, 5}, gzip2))
+
+	var result bytes.Buffer
+	if err := decompressTiledFits(&result, bytes.NewReader(file.Bytes())); err != nil {
+		t.Fatalf("Unable to decompress the file: %s", err)
+	}
+
+	f, err := fitsio.Open(&result)
+	if err != nil {
+		t.Fatalf("Unable to open the decompressed file: %s", err)
+	}
+	defer f.Close()
+
+	if len(f.HDUs()) != 4 {
+		t.Fatalf("Wrong number of HDUs: %d", len(f.HDUs()))
+	}
+	for i, name := range []string{"RICE_1", "GZIP_1", "GZIP_2"} {
+		img, ok := f.HDU(i + 1).(fitsio.Image)
+		if !ok || img.Type() != fitsio.IMAGE_HDU {
+			t.Fatalf("HDU %s does not contain an image", name)
+		}
+		if img.Name() != name || img.Header().Get("ZCMPTYPE") != nil {
+			t.Errorf("Wrong header for HDU %s", name)
+		}
+		if imgAxes := img.Header().Axes(); len(imgAxes) != 2 || imgAxes[0] != axes[0] || imgAxes[1] != axes[1] {
+			t.Errorf("Wrong axes for HDU %s: %v", name, imgAxes)
+		}
+
+		result := make([]int16, len(pixels))
+		if err := img.Read(&result); err != nil {
+			t.Fatalf("Unable to read HDU %s: %s", name, err)
+		}
+		for j := range pixels {
+			if result[j] != pixels[j] {
+				t.Fatalf("Wrong pixel #%d in HDU %s: %d instead of %d", j, name, result[j], pixels[j])
+			}
+		}
+	}
+
+	// Nothing must be written if some image cannot be decompressed
+	file.Write(compressedImageHdu("HCOMPRESS_1", pixels, axes, [2]int{7, 5}, gzip1))
+	result.Reset()
+	err = decompressTiledFits(&result, bytes.NewReader(file.Bytes()))
+	if _, ok := err.(UnsupportedCompressionError); !ok {
+		t.Errorf("Wrong error for HCOMPRESS_1: %v", err)
+	}
+	if result.Len() != 0 {
+		t.Errorf("%d bytes have been written for an unsupported file", result.Len())
+	}
+}
+
+// TestDecompressRiceFile decompresses a file whose tiles have been compressed
+// independently of riceCompress. The file "testdata/rice.fits.fz" contains
+// two 40×3 images, with 16-bit and 32-bit pixels, whose rows have been
+// compressed by a C program that reproduces fits_rcomp_short and fits_rcomp
+// from CFITSIO, using the same header as fpack. The first row of each image
+// is constant, the second changes slowly, and the third jumps between two
+// values, so that every kind of block used by RICE_1 is present.
+func TestDecompressRiceFile(t *testing.T) {
+	pixel := func(big int64, x int, y int) int64 {
+		switch y {
+		case 0:
+			return 17
+		case 1:
+			return int64(1000 + 3*x - (x*7)%5)
+		default:
+			if x%2 == 0 {
+				return -big + int64(11*x)
+			}
+			return big + int64(11*x)
+		}
+	}
+
+	var result bytes.Buffer
+	if err := decompressFitsFile(&result, filepath.Join("testdata", "rice.fits.fz")); err != nil {
+		t.Fatalf("Unable to decompress the file: %s", err)
+	}
+
+	f, err := fitsio.Open(&result)
+	if err != nil {
+		t.Fatalf("Unable to open the decompressed file: %s", err)
+	}
+	defer f.Close()
+
+	if len(f.HDUs()) != 3 {
+		t.Fatalf("Wrong number of HDUs: %d", len(f.HDUs()))
+	}
+	for i, c := range []struct {
+		name   string
+		bitpix int
+		big    int64
+	}{
+		{"INT16", 16, 12000},
+		{"INT32", 32, 100000000},
+	} {
+		img, ok := f.HDU(i + 1).(fitsio.Image)
+		if !ok || img.Name() != c.name || img.Header().Bitpix() != c.bitpix {
+			t.Fatalf("Wrong HDU #%d", i+1)
+		}
+		if axes := img.Header().Axes(); len(axes) != 2 || axes[0] != 40 || axes[1] != 3 {
+			t.Fatalf("Wrong axes for HDU %s: %v", c.name, axes)
+		}
+
+		var values []int64
+		if c.bitpix == 16 {
+			pixels := make([]int16, 40*3)
+			if err := img.Read(&pixels); err != nil {
+				t.Fatalf("Unable to read HDU %s: %s", c.name, err)
+			}
+			for _, value := range pixels {
+				values = append(values, int64(value))
+			}
+		} else {
+			pixels := make([]int32, 40*3)
+			if err := img.Read(&pixels); err != nil {
+				t.Fatalf("Unable to read HDU %s: %s", c.name, err)
+			}
+			for _, value := range pixels {
+				values = append(values, int64(value))
+			}
+		}
+
+		for j, value := range values {
+			if expected := pixel(c.big, j%40, j/40); value != expected {
+				t.Fatalf("Wrong pixel #%d in HDU %s: %d instead of %d", j, c.name, value, expected)
+			}
+		}
+	}
+}
+
+// gzipTestAcquisition copies files from the folder in "testdata" with the
+// same name as "folderPath", compressing them with gzip
+func gzipTestAcquisition(t *testing.T, folderPath string, names ...string) {
+	srcPath := filepath.Join("testdata", filepath.Base(folderPath))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(srcPath, name))
+		if err != nil {
+			t.Fatalf("Unable to read file %s: %s", name, err)
+		}
+
+		dest := filepath.Join(folderPath, name+".gz")
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %s", err)
+		}
+		if err := os.WriteFile(dest, gzipBytes(data), 0644); err != nil {
+			t.Fatalf("Unable to write file %s: %s", dest, err)
+		}
+	}
+}
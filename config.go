@@ -52,10 +52,30 @@ type Configuration struct {
 
 	StaticPath string `json:"static_path"`
 
+	// Path of the repository, used only if Repositories is empty
 	RepositoryPath string `json:"repository_path"`
+	// Repositories containing the acquisitions. If the configuration file
+	// does not list any, a repository named DefaultRepositoryName pointing
+	// to RepositoryPath is used.
+	Repositories []Repository `json:"repositories"`
+
+	WatchRepository bool  `json:"watch_repository"`
+	WatchDelay      int64 `json:"watch_delay"`
+
+	// Number of goroutines used to scan the acquisition folders
+	ScanWorkers int `json:"scan_workers"`
 
 	CookieHashKey  []byte `json:"cookie_hash_key"`
 	CookieBlockKey []byte `json:"cookie_block_key"`
+
+	// Kinds of files to look for in each acquisition, besides raw and
+	// science data. If empty, DefaultFileKinds is used.
+	FileKinds []FileKind `json:"file_kinds"`
+
+	// Maximum size in bytes of the files put in an archive containing
+	// several acquisitions; zero or negative values mean that there is no
+	// limit
+	MaxBundleSize int64 `json:"max_bundle_size"`
 }
 
 // configureViper sets up the Viper library so that it can read the
@@ -70,6 +90,10 @@ func configureViper() {
 	viper.SetDefault("server_name", "127.0.0.1")
 	viper.SetDefault("static_path", "static")
 	viper.SetDefault("repository_path", ".")
+	viper.SetDefault("watch_repository", true)
+	viper.SetDefault("watch_delay", 10)
+	viper.SetDefault("scan_workers", DefaultScanWorkers)
+	viper.SetDefault("max_bundle_size", DefaultMaxBundleSize)
 	viper.SetDefault("read_timeout", 15)
 	viper.SetDefault("write_timeout", 60)
 
@@ -126,6 +150,28 @@ func createConfiguration() *Configuration {
 			blockLen))
 	}
 
+	var fileKinds []FileKind
+	if err := viper.UnmarshalKey("file_kinds", &fileKinds); err != nil {
+		panic(fmt.Errorf("Unable to decode the list of file kinds: %s", err))
+	}
+	if err := validateFileKinds(fileKinds); err != nil {
+		panic(fmt.Errorf("Invalid list of file kinds: %s", err))
+	}
+
+	var repositories []Repository
+	if err := viper.UnmarshalKey("repositories", &repositories); err != nil {
+		panic(fmt.Errorf("Unable to decode the list of repositories: %s", err))
+	}
+	if len(repositories) == 0 {
+		repositories = []Repository{{
+			Name: DefaultRepositoryName,
+			Path: viper.GetString("repository_path"),
+		}}
+	}
+	if err := validateRepositories(repositories); err != nil {
+		panic(fmt.Errorf("Invalid list of repositories: %s", err))
+	}
+
 	return &Configuration{
 		ConfigurationFileName: viper.ConfigFileUsed(),
 		DatabaseFile:          viper.GetString("database_file"),
@@ -136,9 +182,15 @@ func createConfiguration() *Configuration {
 		ReadTimeout:           viper.GetInt64("read_timeout"),
 		WriteTimeout:          viper.GetInt64("write_timeout"),
 		RepositoryPath:        viper.GetString("repository_path"),
+		Repositories:          repositories,
+		WatchRepository:       viper.GetBool("watch_repository"),
+		WatchDelay:            viper.GetInt64("watch_delay"),
+		ScanWorkers:           viper.GetInt("scan_workers"),
 		ServerName:            viper.GetString("server_name"),
 		StaticPath:            viper.GetString("static_path"),
 		CookieHashKey:         cookieHashKey,
 		CookieBlockKey:        cookieBlockKey,
+		FileKinds:             fileKinds,
+		MaxBundleSize:         viper.GetInt64("max_bundle_size"),
 	}
 }
@@ -25,20 +25,23 @@ THE SOFTWARE.
 package qutedb
 
 import (
+	"database/sql"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	scrypt "github.com/elithrar/simple-scrypt"
 	"github.com/gofrs/uuid"
 	"github.com/jinzhu/gorm"
-	_ "github.com/mattn/go-sqlite3" // We need SQLite3 in order for GORM to use it
+	"github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -64,6 +67,10 @@ type RawDataFile struct {
 	FileName      string `json:"file_name"`
 	AsicNumber    int    `json:"asic_number"`
 	AcquisitionID int    `json:"-"`
+	// True if the file is no longer present in the repository
+	Missing bool `json:"missing"`
+	FileInfo
+	Hdus []FitsHdu `json:"-" gorm:"polymorphic:File;"`
 }
 
 // A SumDataFile represents the file containing science data acquired with one ASIC
@@ -72,6 +79,24 @@ type SumDataFile struct {
 	FileName      string `json:"file_name"`
 	AsicNumber    int    `json:"asic_number"`
 	AcquisitionID int    `json:"-"`
+	// True if the file is no longer present in the repository
+	Missing bool `json:"missing"`
+	FileInfo
+	Hdus []FitsHdu `json:"-" gorm:"polymorphic:File;"`
+}
+
+// A DataFile represents a file in the folder of an acquisition whose kind is
+// declared in the configuration (e.g., a housekeeping file). The field "Kind"
+// contains the name of the FileKind.
+type DataFile struct {
+	ID            int    `json:"id" gorm:"primary_key"`
+	Kind          string `json:"kind" gorm:"index"`
+	FileName      string `json:"file_name"`
+	AcquisitionID int    `json:"-" gorm:"index"`
+	// True if the file is no longer present in the repository
+	Missing bool `json:"missing"`
+	FileInfo
+	Hdus []FitsHdu `json:"-" gorm:"polymorphic:File;"`
 }
 
 // An Acquisition represents a set of files within a folder in the repository
@@ -81,18 +106,51 @@ type Acquisition struct {
 
 	Name          string `json:"name"`
 	Directoryname string `json:"directory_name" gorm:"unique_index"`
+	// Name of the repository containing the folder
+	Repository string `json:"repository" gorm:"index"`
+	FolderPath string `json:"-"`
+	// True if the folder is no longer present in the repository
+	Missing bool `json:"missing"`
+	// Number of files in the database that are no longer present in the folder
+	MissingFiles int `json:"missing_files"`
 	// We encode the acquisition time as a string in order to have
 	// full control on the formatting, which is always "YYYY-MM-DDThh:mm:ss"
-	AcquisitionTime  string        `json:"acquisition_time"`
-	RawFiles         []RawDataFile `json:"-"`
-	SumFiles         []SumDataFile `json:"-"`
-	AsicHkFileName   string        `json:"-"`
-	InternHkFileName string        `json:"-"`
-	ExternHkFileName string        `json:"-"`
-	MmrHkFileName    string        `json:"-"`
-	MgcHkFileName    string        `json:"-"`
-	CalConfFileName  string        `json:"-"`
-	CalDataFileName  string        `json:"-"`
+	AcquisitionTime string        `json:"acquisition_time"`
+	RawFiles        []RawDataFile `json:"-"`
+	SumFiles        []SumDataFile `json:"-"`
+	Files           []DataFile    `json:"-"`
+	HkChannels      []HkChannel   `json:"-"`
+	// Canonical URL of the acquisition in the API, see SelfURL
+	URL string `json:"url" gorm:"-"`
+	// Tags attached to the acquisition by the users
+	Tags []Tag `json:"tags" gorm:"many2many:acquisition_tags;"`
+	// Name of the campaign the acquisition belongs to, if any
+	Campaign string `json:"campaign" gorm:"index;default:''"`
+
+	// The names of the files whose kind is in DefaultFileKinds are also kept
+	// here, for compatibility with older versions of QuTeDB. Use "Files"
+	// instead.
+	AsicHkFileName   string `json:"-"`
+	InternHkFileName string `json:"-"`
+	ExternHkFileName string `json:"-"`
+	MmrHkFileName    string `json:"-"`
+	MgcHkFileName    string `json:"-"`
+	CalConfFileName  string `json:"-"`
+	CalDataFileName  string `json:"-"`
+}
+
+// SelfURL returns the canonical URL of the acquisition in the API. Unlike its
+// time, the name of the folder identifies an acquisition without ambiguity,
+// and unlike its numeric ID it does not change if the database is rebuilt.
+func (acq *Acquisition) SelfURL() string {
+	return "/api/v1/acquisitions/" + url.PathEscape(acq.Directoryname)
+}
+
+// AfterFind is called by GORM after an acquisition has been loaded from the
+// database
+func (acq *Acquisition) AfterFind() error {
+	acq.URL = acq.SelfURL()
+	return nil
 }
 
 // TimeToCanonicalStr converts a standard date/time into
@@ -103,6 +161,64 @@ func TimeToCanonicalStr(t time.Time) string {
 		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
 }
 
+// sqliteDriver is the name of the SQLite driver used by OpenDb, which
+// implements the REGEXP operator
+const sqliteDriver = "sqlite3_qutedb"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", sqliteRegexp, true)
+		},
+	})
+}
+
+// regexpCache keeps the regular expressions compiled by sqliteRegexp, so that
+// they are not compiled again for every row
+var regexpCache = struct {
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}{patterns: map[string]*regexp.Regexp{}}
+
+// sqliteRegexp implements "str REGEXP pattern", which SQLite does not
+// provide by default
+func sqliteRegexp(pattern string, str string) (bool, error) {
+	regexpCache.Lock()
+	re, ok := regexpCache.patterns[pattern]
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			regexpCache.Unlock()
+			return false, err
+		}
+		// Do not let the cache grow forever
+		if len(regexpCache.patterns) >= 64 {
+			regexpCache.patterns = map[string]*regexp.Regexp{}
+		}
+		regexpCache.patterns[pattern] = re
+	}
+	regexpCache.Unlock()
+
+	return re.MatchString(str), nil
+}
+
+// OpenDb opens the SQLite database "dataSourceName", which can be either the
+// name of a file or an URI
+func OpenDb(dataSourceName string) (*gorm.DB, error) {
+	sqlDb, err := sql.Open(sqliteDriver, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open("sqlite3", sqlDb)
+	if err != nil {
+		sqlDb.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
 // InitDb creates all the tables in the database. It takes care of not raising
 // errors if the tables are already present. You should call this function only
 // once during the lifetime of the program, as it resets all open sessions.
@@ -112,12 +228,31 @@ func InitDb(db *gorm.DB, config *Configuration) error {
 		&Session{},
 		&RawDataFile{},
 		&SumDataFile{},
+		&DataFile{},
+		&FileKind{},
+		&FitsHdu{},
+		&FitsCard{},
+		&FitsColumn{},
+		&HkChannel{},
+		&IngestionReport{},
+		&IngestionProblem{},
+		&Tag{},
+		&Comment{},
+		&Campaign{},
 		&Acquisition{},
 	)
 
 	// Clear all existing sessions in the database. Ignore any error
 	db.Delete(&Session{})
 
+	var fileKinds []FileKind
+	if config != nil {
+		fileKinds = config.FileKinds
+	}
+	if err := syncFileKinds(db, fileKinds); err != nil {
+		return fmt.Errorf("unable to save the file kinds in the database: %s", err)
+	}
+
 	return db.Error
 }
 
@@ -136,227 +271,414 @@ func SumDirName(folder string) string {
 	return path.Join(folder, "Sums")
 }
 
-// findMultipleFiles returns a sorted list of files matching "mask" in the
-// specified "path"
-func findMultipleFiles(path string, mask string) ([]string, error) {
-	filenames, err := filepath.Glob(filepath.Join(path, mask))
+// findOneMatchingFile looks in "listing" for the files in "path" matching
+// "mask" (a file name pattern built using POSIX wildcards). If no matches are found,
+// it returns "". If one match is found, it returns the name of the
+// file. If more tha one match is found, it records a warning in "changes"
+// and returns the last file (in lexicographical order).
+func findOneMatchingFile(changes *FolderChanges, listing folderListing, path string, mask string) string {
+	filenames := listing.match(path, mask)
 	if len(filenames) == 0 {
-		return []string{}, err
+		return ""
 	}
 
-	// Sort the files in lexicographic order
-	sort.Strings(filenames)
+	if len(filenames) > 1 {
+		changes.warn(path, "Found %d files matching the mask %q, only %q has been used",
+			len(filenames), mask, filepath.Base(filenames[len(filenames)-1]))
+	}
 
-	result := []string{}
-	for _, curname := range filenames {
-		fi, err := os.Stat(curname)
-		if err != nil || !fi.Mode().IsRegular() {
-			continue
-		}
+	return filenames[len(filenames)-1]
+}
 
-		result = append(result, curname)
-	}
+// Masks matched by the names of the files containing raw and science data
+const (
+	rawFileMask = "raw-asic*-????.??.??.??????.fits"
+	sumFileMask = "science-asic*-????.??.??.??????.fits"
+)
+
+// acquisitionFolderMask is the pattern matched by the names of the folders
+// containing acquisitions
+const acquisitionFolderMask = "????-??-??_??.??.??__*"
 
-	return result, nil
+// isAcquisitionFolder returns true if the name of the folder "path" matches
+// the pattern used for acquisitions
+func isAcquisitionFolder(path string) bool {
+	matched, err := filepath.Match(acquisitionFolderMask, filepath.Base(path))
+	return err == nil && matched
 }
 
-// findOneMatchingFile looks for the files matching "mask" (a file
-// name pattern built using POSIX wildcards). If no matches are found,
-// it returns "". If one match is found, it returns the name of the
-// file. If more tha one match is found, it raises a warning and
-// returns the last file (in lexicographical order).
-func findOneMatchingFile(path string, mask string) (string, error) {
-	filenames, err := findMultipleFiles(path, mask)
-	if err != nil || len(filenames) == 0 {
-		return "", err
-	}
+// FolderChanges lists the changes made to the database after a folder in the
+// repository has been scanned
+type FolderChanges struct {
+	Directoryname  string   `json:"directory_name"`
+	NewAcquisition bool     `json:"new_acquisition"`
+	NewRawFiles    []string `json:"new_raw_files"`
+	NewSumFiles    []string `json:"new_sum_files"`
+	NewDataFiles   []string `json:"new_data_files"`
+	NewHkChannels  int      `json:"new_hk_channels"`
+
+	// Files that are recorded in the database but are no longer present in
+	// the folder. They are not considered changes, as the database keeps
+	// them until they are purged
+	MissingFiles []string `json:"missing_files"`
+
+	// True if the folder has not been ingested because of the errors
+	// listed in "Problems"
+	Skipped  bool               `json:"skipped"`
+	Problems []IngestionProblem `json:"problems"`
+}
 
-	if len(filenames) > 1 {
-		log.WithFields(log.Fields{
-			"path":           path,
-			"mask":           mask,
-			"filenames":      filenames,
-			"num_of_matches": len(filenames),
-		}).Warning("Found more than one file matching the mask")
+// IsEmpty returns true if the scan did not change the database at all
+func (changes *FolderChanges) IsEmpty() bool {
+	return !changes.NewAcquisition &&
+		len(changes.NewRawFiles) == 0 &&
+		len(changes.NewSumFiles) == 0 &&
+		len(changes.NewDataFiles) == 0 &&
+		changes.NewHkChannels == 0
+}
+
+// asicNumberRe matches the number of the ASIC in the name of raw and
+// science files
+var asicNumberRe = regexp.MustCompile("asic([0-9]+)")
+
+// findAsicFiles returns the files in "path" matching "mask" (as recorded in
+// "listing"), together with the number of the ASIC each of them refers to.
+// Files whose ASIC number cannot be determined are skipped, and a warning is
+// recorded in "changes".
+func findAsicFiles(changes *FolderChanges, listing folderListing, path string, mask string) ([]string, []int) {
+	filenames := listing.match(path, mask)
+
+	var result []string
+	var asicNumbers []int
+	for _, filename := range filenames {
+		matches := asicNumberRe.FindStringSubmatch(filepath.Base(filename))
+		if matches == nil {
+			changes.warn(filename, "Unable to find the ASIC number in the name of the file")
+			continue
+		}
+
+		asicNum, err := strconv.Atoi(matches[1])
+		if err != nil {
+			changes.warn(filename, "Invalid ASIC number %q", matches[1])
+			continue
+		}
+
+		result = append(result, filename)
+		asicNumbers = append(asicNumbers, asicNum)
 	}
 
-	return filenames[len(filenames)-1], nil
+	return result, asicNumbers
 }
 
-// refreshFolder scans a folder containing *one* acquisition and updates the
-// database accordingly. This function does not check whether "folderPath" is
-// really within the repository or not.
-func refreshFolder(db *gorm.DB, folderPath string) error {
-	dirname := filepath.Base(folderPath)
-	acquisitionTime, err := time.Parse("2006-01-02_15.04.05", dirname[:19])
+// refreshFolder scans a folder containing *one* acquisition in the repository
+// "repository", and returns what has been changed in the database
+func refreshFolder(db *gorm.DB, repository string, folderPath string) (*FolderChanges, error) {
+	fileKinds, err := QueryFileKinds(db)
 	if err != nil {
-		panic(fmt.Sprintf("Wrong time in string \"%s\"", dirname))
-	}
-
-	newacq := Acquisition{
-		Name:            dirname[21:],
-		Directoryname:   dirname,
-		AcquisitionTime: TimeToCanonicalStr(acquisitionTime),
+		return nil, err
 	}
 
 	// Check if the folder is already present in the db
-	result := db.Where("directoryname = ?", newacq.Directoryname).First(&Acquisition{})
-	if !result.RecordNotFound() {
-		return nil
+	var known *Acquisition
+	hasHkChannels := false
+	var acq Acquisition
+	result := db.
+		Preload("RawFiles").
+		Preload("SumFiles").
+		Preload("Files").
+		Where("directoryname = ?", filepath.Base(folderPath)).
+		First(&acq)
+	if result.Error != nil && !result.RecordNotFound() {
+		return nil, result.Error
 	}
+	if !result.RecordNotFound() {
+		known = &acq
 
-	// Check for the presence of housekeeping files
-	hkDir := HkDirName(folderPath)
-	filename, err := findOneMatchingFile(hkDir, "conf-asics-????.??.??.??????.fits")
-	if err != nil {
-		return err
-	}
-	if filename != "" {
-		newacq.AsicHkFileName = filename
+		numOfHkChannels := 0
+		if err := db.Model(&HkChannel{}).
+			Where("acquisition_id = ?", acq.ID).
+			Count(&numOfHkChannels).Error; err != nil {
+			return nil, err
+		}
+		hasHkChannels = numOfHkChannels > 0
 	}
 
-	filename, err = findOneMatchingFile(hkDir, "hk-intern-????.??.??.??????.fits")
-	if err != nil {
-		return err
-	}
-	if filename != "" {
-		newacq.InternHkFileName = filename
+	scan := scanFolder(repository, folderPath, known, hasHkChannels, fileKinds)
+	if err := db.Transaction(scan.apply); err != nil {
+		return nil, err
 	}
 
-	filename, err = findOneMatchingFile(hkDir, "hk-extern-????.??.??.??????.fits")
-	if err != nil {
-		return err
-	}
-	if filename != "" {
-		newacq.ExternHkFileName = filename
-	}
+	return &scan.changes, nil
+}
 
-	filename, err = findOneMatchingFile(hkDir, "hk-MGC-????.??.??.??????.fits")
-	if err != nil {
-		return err
-	}
-	if filename != "" {
-		newacq.MgcHkFileName = filename
+// fileExists returns false if "name" is no longer present in the filesystem
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return !os.IsNotExist(err)
+}
+
+// updateMissingFlags checks which files belonging to "acq" are still present in
+// the repository, and updates the "missing" flags in the database accordingly.
+// The raw, science and data files must have already been loaded in "acq". The
+// function returns the list of files that are missing.
+func updateMissingFlags(db *gorm.DB, acq *Acquisition) ([]string, error) {
+	var missingFiles []string
+	numOfFiles := 0
+
+	for i := range acq.RawFiles {
+		raw := &acq.RawFiles[i]
+		numOfFiles++
+
+		missing := !fileExists(raw.FileName)
+		if missing {
+			missingFiles = append(missingFiles, raw.FileName)
+		}
+		if missing != raw.Missing {
+			raw.Missing = missing
+			if err := db.Model(raw).UpdateColumn("missing", missing).Error; err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	filename, err = findOneMatchingFile(hkDir, "hk-MMR-????.??.??.??????.fits")
-	if err != nil {
-		return err
+	for i := range acq.SumFiles {
+		sum := &acq.SumFiles[i]
+		numOfFiles++
+
+		missing := !fileExists(sum.FileName)
+		if missing {
+			missingFiles = append(missingFiles, sum.FileName)
+		}
+		if missing != sum.Missing {
+			sum.Missing = missing
+			if err := db.Model(sum).UpdateColumn("missing", missing).Error; err != nil {
+				return nil, err
+			}
+		}
 	}
-	if filename != "" {
-		newacq.MmrHkFileName = filename
+
+	for i := range acq.Files {
+		file := &acq.Files[i]
+		numOfFiles++
+
+		missing := !fileExists(file.FileName)
+		if missing {
+			missingFiles = append(missingFiles, file.FileName)
+		}
+		if missing != file.Missing {
+			file.Missing = missing
+			if err := db.Model(file).UpdateColumn("missing", missing).Error; err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	filename, err = findOneMatchingFile(hkDir, "calibConf-????.??.??.??????.fits")
-	if err != nil {
-		return err
+	var missing bool
+	if acq.FolderPath != "" {
+		missing = !fileExists(acq.FolderPath)
+	} else {
+		// Acquisitions created by older versions of QuTeDB do not record
+		// the path of their folder
+		missing = numOfFiles > 0 && len(missingFiles) == numOfFiles
 	}
-	if filename != "" {
-		newacq.CalConfFileName = filename
+
+	if missing != acq.Missing || len(missingFiles) != acq.MissingFiles {
+		acq.Missing = missing
+		acq.MissingFiles = len(missingFiles)
+		if err := db.Model(acq).UpdateColumns(map[string]interface{}{
+			"missing":       acq.Missing,
+			"missing_files": acq.MissingFiles,
+		}).Error; err != nil {
+			return nil, err
+		}
 	}
 
-	filename, err = findOneMatchingFile(hkDir, "calibData-????.??.??.??????.fits")
-	if err != nil {
+	return missingFiles, nil
+}
+
+// flagMissingAcquisitions checks the acquisitions whose folder has not been
+// found while walking the repository, and flags those that are missing.
+// The map "seenFolders" contains the names of the folders that were found.
+func flagMissingAcquisitions(db *gorm.DB, seenFolders map[string]bool) error {
+	var acqList []Acquisition
+	if err := db.Preload("RawFiles").Preload("SumFiles").Preload("Files").Find(&acqList).Error; err != nil {
 		return err
 	}
-	if filename != "" {
-		newacq.CalDataFileName = filename
-	}
 
-	asicRe := regexp.MustCompile("asic([0-9]+)")
-	if rawFiles, err := findMultipleFiles(
-		RawDirName(folderPath),
-		"raw-asic*-????.??.??.??????.fits",
-	); err == nil && len(rawFiles) > 0 {
-		for _, filename := range rawFiles {
-			matches := asicRe.FindStringSubmatch(filepath.Base(filename))
-			asicNum, err := strconv.Atoi(matches[1])
-			if err != nil {
-				panic(fmt.Sprintf("Unexpected error in Atoi(\"%s\"): %s", matches[1], err))
-			}
-			newacq.RawFiles = append(
-				newacq.RawFiles,
-				RawDataFile{
-					FileName:   filename,
-					AsicNumber: asicNum,
-				},
-			)
+	for i := range acqList {
+		acq := &acqList[i]
+		if seenFolders[acq.Directoryname] {
+			continue
 		}
-	}
 
-	if sumFiles, err := findMultipleFiles(
-		SumDirName(folderPath),
-		"science-asic*-????.??.??.??????.fits",
-	); err == nil && len(sumFiles) > 0 {
-		for _, filename := range sumFiles {
-			matches := asicRe.FindStringSubmatch(filepath.Base(filename))
-			asicNum, err := strconv.Atoi(matches[1])
-			if err != nil {
-				panic(fmt.Sprintf("Unexpected error in Atoi(\"%s\"): %s",
-					matches[1], err))
-			}
-			newacq.SumFiles = append(
-				newacq.SumFiles,
-				SumDataFile{
-					FileName:   filename,
-					AsicNumber: asicNum,
-				},
-			)
+		missingFiles, err := updateMissingFlags(db, acq)
+		if err != nil {
+			return err
 		}
-	}
 
-	log.WithFields(log.Fields{
-		"new_acquisition": newacq,
-	}).Info("Going to create new acquisition")
-
-	if db.Create(&newacq).Error != nil {
-		return fmt.Errorf("Error while creating a new acquisition for \"%s\": %s",
-			folderPath, db.Error)
+		if acq.Missing {
+			log.WithFields(log.Fields{
+				"directory_name": acq.Directoryname,
+				"folder_path":    acq.FolderPath,
+			}).Warning("Acquisition is no longer present in the repository")
+		} else if len(missingFiles) > 0 {
+			log.WithFields(log.Fields{
+				"directory_name": acq.Directoryname,
+				"missing_files":  missingFiles,
+			}).Warning("Some files are no longer present in the repository")
+		}
 	}
 
 	return nil
 }
 
 // RefreshDbContents scans the repository for any file that is missing from the
-// database, and create an entry for each of them.
+// database, and create an entry for each of them. Acquisitions and files that
+// are in the database but no longer in the repository are flagged as missing.
+// Folders that cannot be ingested are skipped; the problems found during the
+// scan are saved in the database as an IngestionReport. The folders are
+// scanned by DefaultScanWorkers goroutines, and the acquisitions are assigned
+// to the repository named DefaultRepositoryName. Use ScanRepositories to scan
+// several repositories at once.
 func RefreshDbContents(db *gorm.DB, repositoryPath string) error {
-	return filepath.Walk(repositoryPath, func(
-		path string,
-		info os.FileInfo,
-		err error,
-	) error {
-		if err != nil {
+	return ScanRepositories(db, []Repository{{
+		Name: DefaultRepositoryName,
+		Path: repositoryPath,
+	}}, DefaultScanWorkers, nil)
+}
+
+// FlagMissingAcquisition checks whether the acquisition stored in the folder
+// named "dirname" is still present in the repository and updates the "missing"
+// flags accordingly. It does nothing if no such acquisition is in the database.
+func FlagMissingAcquisition(db *gorm.DB, dirname string) error {
+	var acq Acquisition
+	result := db.Preload("RawFiles").Preload("SumFiles").Preload("Files").
+		Where("directoryname = ?", dirname).First(&acq)
+	if result.RecordNotFound() {
+		return nil
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+
+	_, err := updateMissingFlags(db, &acq)
+	return err
+}
+
+// PurgeResult counts the objects removed from the database by PurgeMissing
+type PurgeResult struct {
+	Acquisitions int64 `json:"acquisitions"`
+	RawFiles     int64 `json:"raw_files"`
+	SumFiles     int64 `json:"sum_files"`
+	DataFiles    int64 `json:"data_files"`
+}
+
+// PurgeMissing removes from the database all the acquisitions and the files
+// that have been flagged as missing
+func PurgeMissing(db *gorm.DB) (*PurgeResult, error) {
+	var result PurgeResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var acqIDs []uint
+		if err := tx.Model(&Acquisition{}).
+			Where("missing = ?", true).
+			Pluck("id", &acqIDs).Error; err != nil {
 			return err
 		}
 
-		log.WithFields(log.Fields{
-			"folder_name": path,
-		}).Debug("Walking into directory")
+		if len(acqIDs) > 0 {
+			res := tx.Where("acquisition_id IN (?)", acqIDs).Delete(RawDataFile{})
+			if res.Error != nil {
+				return res.Error
+			}
+			result.RawFiles += res.RowsAffected
+
+			res = tx.Where("acquisition_id IN (?)", acqIDs).Delete(SumDataFile{})
+			if res.Error != nil {
+				return res.Error
+			}
+			result.SumFiles += res.RowsAffected
+
+			res = tx.Where("acquisition_id IN (?)", acqIDs).Delete(DataFile{})
+			if res.Error != nil {
+				return res.Error
+			}
+			result.DataFiles += res.RowsAffected
+
+			res = tx.Where("acquisition_id IN (?)", acqIDs).Delete(HkChannel{})
+			if res.Error != nil {
+				return res.Error
+			}
+
+			res = tx.Where("acquisition_id IN (?)", acqIDs).Delete(Comment{})
+			if res.Error != nil {
+				return res.Error
+			}
 
-		if !info.IsDir() {
-			return nil
+			res = tx.Where("id IN (?)", acqIDs).Delete(Acquisition{})
+			if res.Error != nil {
+				return res.Error
+			}
+			result.Acquisitions += res.RowsAffected
 		}
 
-		matched, err := filepath.Match("????-??-??_??.??.??__*", filepath.Base(path))
-		if err != nil {
-			return err
+		res := tx.Where("missing = ?", true).Delete(RawDataFile{})
+		if res.Error != nil {
+			return res.Error
 		}
+		result.RawFiles += res.RowsAffected
 
-		if matched {
-			log.WithFields(log.Fields{
-				"folder_name": path,
-			}).Info("Processing folder")
+		res = tx.Where("missing = ?", true).Delete(SumDataFile{})
+		if res.Error != nil {
+			return res.Error
+		}
+		result.SumFiles += res.RowsAffected
+
+		// Forget the names of the missing files that are also kept in the
+		// acquisitions for compatibility
+		var missingDataFiles []DataFile
+		if err := tx.Where("missing = ?", true).Find(&missingDataFiles).Error; err != nil {
+			return err
+		}
+		for _, file := range missingDataFiles {
+			legacy, ok := legacyFileFields[file.Kind]
+			if !ok {
+				continue
+			}
 
-			if err := refreshFolder(db, path); err != nil {
+			if err := tx.Model(&Acquisition{}).
+				Where("id = ? AND "+legacy.column+" = ?", file.AcquisitionID, file.FileName).
+				UpdateColumn(legacy.column, "").Error; err != nil {
 				return err
 			}
+		}
 
-			// This directory has been processed, so don't walk into it
-			return filepath.SkipDir
+		res = tx.Where("missing = ?", true).Delete(DataFile{})
+		if res.Error != nil {
+			return res.Error
 		}
+		result.DataFiles += res.RowsAffected
 
-		return nil
+		if err := tx.Model(&Acquisition{}).
+			Where("missing_files > 0").
+			UpdateColumn("missing_files", 0).Error; err != nil {
+			return err
+		}
+
+		if err := deleteUnusedTags(tx); err != nil {
+			return err
+		}
+
+		return deleteOrphanHeaders(tx)
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"result": result,
+	}).Info("Missing acquisitions and files have been purged")
+
+	return &result, nil
 }
 
 // CreateUser creates a new "User" object and initializes it with the hash of
@@ -521,19 +843,63 @@ func QuerySessionByUUID(db *gorm.DB, UUID string) (*Session, error) {
 	return &session, nil
 }
 
-// QueryAcquisition returns an Aquisition object with all its fields
-// properly filled
-func QueryAcquisition(db *gorm.DB, acqtime string) (*Acquisition, error) {
-	var acq Acquisition
-	if err := db.
-		Where("acquisition_time = ?", acqtime).First(&acq).Error; err != nil {
-		return &acq, Error{
+// canonicalTimeRe matches the times produced by TimeToCanonicalStr
+var canonicalTimeRe = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}$`)
+
+// findAcquisition returns the acquisition identified by "acqID", which can
+// be its numeric ID, the name of its folder, or its time. Only the tags of
+// the acquisition are loaded. Since two folders can start in the same second,
+// a time can match more than one acquisition: in this case the error has code
+// 409 (Conflict) and lists the URLs of the acquisitions.
+func findAcquisition(db *gorm.DB, acqID string) (*Acquisition, error) {
+	query := preloadTags(db)
+	if id, err := strconv.ParseUint(acqID, 10, 64); err == nil {
+		query = query.Where("id = ?", id)
+	} else if canonicalTimeRe.MatchString(acqID) {
+		query = query.Where("acquisition_time = ?", acqID)
+	} else {
+		query = query.Where("directoryname = ?", acqID)
+	}
+
+	var acqs []Acquisition
+	if err := query.Order("id").Find(&acqs).Error; err != nil {
+		return nil, Error{
 			err: err,
-			msg: fmt.Sprintf("Unable to query the database for acquisition with ID %s",
-				acqtime),
+			msg: fmt.Sprintf("Unable to query the database for acquisition with ID %s", acqID),
 		}
 	}
 
+	switch len(acqs) {
+	case 0:
+		return nil, Error{
+			msg:  fmt.Sprintf("No acquisition with ID %s", acqID),
+			code: http.StatusNotFound,
+		}
+	case 1:
+		return &acqs[0], nil
+	default:
+		var urls []string
+		for _, acq := range acqs {
+			urls = append(urls, acq.SelfURL())
+		}
+		return nil, Error{
+			msg: fmt.Sprintf("More than one acquisition was started at %s, use one of %s",
+				acqID, strings.Join(urls, ", ")),
+			code: http.StatusConflict,
+		}
+	}
+}
+
+// QueryAcquisition returns an Aquisition object with all its fields
+// properly filled. See findAcquisition for the values accepted by "acqID".
+func QueryAcquisition(db *gorm.DB, acqID string) (*Acquisition, error) {
+	found, err := findAcquisition(db, acqID)
+	if err != nil {
+		return &Acquisition{}, err
+	}
+	acq := *found
+	acqtime := acq.AcquisitionTime
+
 	if err := db.
 		Joins("JOIN acquisitions ON raw_data_files.acquisition_id = acquisitions.id").
 		Where("acquisitions.id = ?", acq.ID).
@@ -556,5 +922,16 @@ func QueryAcquisition(db *gorm.DB, acqtime string) (*Acquisition, error) {
 		}
 	}
 
+	if err := db.
+		Where("acquisition_id = ?", acq.ID).
+		Order("file_name").
+		Find(&acq.Files).Error; err != nil {
+		return &acq, Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to query for the files belonging to ID %s",
+				acqtime),
+		}
+	}
+
 	return &acq, nil
 }
@@ -1,8 +1,12 @@
 package qutedb
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -292,14 +296,512 @@ func TestRefresh(t *testing.T) {
 	}
 }
 
+func TestIncrementalRefresh(t *testing.T) {
+	db := createTemporaryDb(t)
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	folderPath := filepath.Join(t.TempDir(), dirname)
+	copyTestFiles := func(names ...string) {
+		copyTestAcquisition(t, folderPath, names...)
+	}
+
+	copyTestFiles("Raws/raw-asic1-2022.04.05.155404.fits", "Hks/calibConf-2022.04.05.155408.fits")
+	changes, err := refreshFolder(db, DefaultRepositoryName, folderPath)
+	if err != nil {
+		t.Fatalf("Unexpected error in refreshFolder: %s", err)
+	}
+	if !changes.NewAcquisition || len(changes.NewRawFiles) != 1 || len(changes.NewDataFiles) != 1 {
+		t.Errorf("Wrong changes after the first scan: %v", changes)
+	}
+
+	// Simulate files that are produced after the first scan
+	copyTestFiles(
+		"Raws/raw-asic2-2022.04.05.155404.fits",
+		"Sums/science-asic1-2022.04.05.155404.fits",
+		"Sums/science-asic2-2022.04.05.155404.fits",
+		"Hks/calibData-2022.04.05.155404.fits",
+	)
+	changes, err = refreshFolder(db, DefaultRepositoryName, folderPath)
+	if err != nil {
+		t.Fatalf("Unexpected error in refreshFolder: %s", err)
+	}
+	if changes.NewAcquisition {
+		t.Errorf("The acquisition has been created twice")
+	}
+	if len(changes.NewRawFiles) != 1 || len(changes.NewSumFiles) != 2 || len(changes.NewDataFiles) != 1 {
+		t.Errorf("Wrong changes after the second scan: %v", changes)
+	}
+
+	var count int
+	db.Model(&Acquisition{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("Wrong number of acquisitions: %d", count)
+	}
+
+	var acq Acquisition
+	db.Where("directoryname = ?", dirname).First(&acq)
+	db.Model(&acq).Related(&acq.RawFiles)
+	db.Model(&acq).Related(&acq.SumFiles)
+	if len(acq.RawFiles) != 2 || len(acq.SumFiles) != 2 {
+		t.Errorf("Wrong number of files: %d raw, %d science", len(acq.RawFiles), len(acq.SumFiles))
+	}
+	if acq.CalConfFileName == "" || acq.CalDataFileName == "" {
+		t.Errorf("Calibration HK files not recorded: %v", acq)
+	}
+
+	// A third scan must not change anything
+	changes, err = refreshFolder(db, DefaultRepositoryName, folderPath)
+	if err != nil {
+		t.Fatalf("Unexpected error in refreshFolder: %s", err)
+	}
+	if !changes.IsEmpty() {
+		t.Errorf("Unexpected changes after the third scan: %v", changes)
+	}
+}
+
+func TestMissingFiles(t *testing.T) {
+	db := createTemporaryDb(t)
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	folderPath := filepath.Join(repository, dirname)
+	copyTestAcquisition(t, folderPath,
+		"Raws/raw-asic1-2022.04.05.155404.fits",
+		"Raws/raw-asic2-2022.04.05.155404.fits",
+		"Hks/calibConf-2022.04.05.155408.fits",
+	)
+
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	if err := os.Remove(filepath.Join(folderPath, "Raws", "raw-asic2-2022.04.05.155404.fits")); err != nil {
+		t.Fatalf("Unable to remove file: %s", err)
+	}
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	var acq Acquisition
+	db.Preload("RawFiles").Where("directoryname = ?", dirname).First(&acq)
+	if acq.Missing {
+		t.Errorf("Acquisition has been wrongly flagged as missing")
+	}
+	if acq.MissingFiles != 1 {
+		t.Errorf("Wrong number of missing files: %d", acq.MissingFiles)
+	}
+	for _, raw := range acq.RawFiles {
+		if raw.Missing != (raw.AsicNumber == 2) {
+			t.Errorf("Wrong missing flag for file %s", raw.FileName)
+		}
+	}
+
+	// A missing file of a kind that allows only one file per acquisition is
+	// replaced by a new one
+	newCalConf := filepath.Join(folderPath, "Hks", "calibConf-2022.04.05.155409.fits")
+	if err := os.Rename(filepath.Join(folderPath, "Hks", "calibConf-2022.04.05.155408.fits"), newCalConf); err != nil {
+		t.Fatalf("Unable to rename file: %s", err)
+	}
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	acq = Acquisition{}
+	db.Preload("Files").Where("directoryname = ?", dirname).First(&acq)
+	if len(acq.Files) != 1 || acq.Files[0].FileName != newCalConf || acq.Files[0].Missing ||
+		acq.CalConfFileName != newCalConf || acq.MissingFiles != 1 {
+		t.Errorf("The missing calibration file has not been replaced: %v", acq.Files)
+	}
+
+	// Now remove the whole folder
+	if err := os.RemoveAll(folderPath); err != nil {
+		t.Fatalf("Unable to remove folder: %s", err)
+	}
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	db.Where("directoryname = ?", dirname).First(&acq)
+	if !acq.Missing {
+		t.Errorf("Acquisition has not been flagged as missing")
+	}
+	if acq.MissingFiles != 3 {
+		t.Errorf("Wrong number of missing files: %d", acq.MissingFiles)
+	}
+
+	result, err := PurgeMissing(db)
+	if err != nil {
+		t.Fatalf("Error running PurgeMissing: %s", err)
+	}
+	if result.Acquisitions != 1 || result.RawFiles != 2 {
+		t.Errorf("Wrong result of PurgeMissing: %v", result)
+	}
+
+	var count int
+	db.Model(&Acquisition{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Wrong number of acquisitions after the purge: %d", count)
+	}
+	db.Model(&RawDataFile{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Wrong number of raw files after the purge: %d", count)
+	}
+	db.Model(&FitsHdu{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Wrong number of FITS headers after the purge: %d", count)
+	}
+	db.Model(&FitsCard{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Wrong number of FITS cards after the purge: %d", count)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	db := createTemporaryDb(t)
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	folderPath := filepath.Join(repository, dirname)
+	copyTestAcquisition(t, folderPath,
+		"Raws/raw-asic1-2022.04.05.155404.fits",
+		"Raws/raw-asic2-2022.04.05.155404.fits",
+		"Hks/calibConf-2022.04.05.155408.fits",
+	)
+
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	var acq Acquisition
+	db.Preload("RawFiles").Preload("Files").Where("directoryname = ?", dirname).First(&acq)
+	for _, raw := range acq.RawFiles {
+		data, _ := ioutil.ReadFile(raw.FileName)
+		if raw.Size != int64(len(data)) {
+			t.Errorf("Wrong size for file %s: %d", raw.FileName, raw.Size)
+		}
+		if hash := sha256.Sum256(data); raw.Sha256 != hex.EncodeToString(hash[:]) {
+			t.Errorf("Wrong checksum for file %s: %s", raw.FileName, raw.Sha256)
+		}
+	}
+	if len(acq.Files) != 1 || acq.Files[0].Kind != "calconf" || acq.Files[0].Sha256 == "" {
+		t.Errorf("Wrong list of data files: %v", acq.Files)
+	}
+
+	report, err := VerifyChecksums(db)
+	if err != nil {
+		t.Fatalf("Error running VerifyChecksums: %s", err)
+	}
+	if report.NumOfFiles != 3 || len(report.Mismatches) != 0 {
+		t.Errorf("Wrong verification report: %v", report)
+	}
+
+	// Change one byte in the first file, append one byte to the second, and
+	// remove the third
+	raw1 := filepath.Join(folderPath, "Raws", "raw-asic1-2022.04.05.155404.fits")
+	data, _ := ioutil.ReadFile(raw1)
+	data[len(data)-1]++
+	if err := ioutil.WriteFile(raw1, data, 0644); err != nil {
+		t.Fatalf("Unable to modify file: %s", err)
+	}
+	raw2 := filepath.Join(folderPath, "Raws", "raw-asic2-2022.04.05.155404.fits")
+	data, _ = ioutil.ReadFile(raw2)
+	if err := ioutil.WriteFile(raw2, append(data, 0), 0644); err != nil {
+		t.Fatalf("Unable to modify file: %s", err)
+	}
+	if err := os.Remove(filepath.Join(folderPath, "Hks", "calibConf-2022.04.05.155408.fits")); err != nil {
+		t.Fatalf("Unable to remove file: %s", err)
+	}
+
+	report, err = VerifyChecksums(db)
+	if err != nil {
+		t.Fatalf("Error running VerifyChecksums: %s", err)
+	}
+	reasons := map[string]string{}
+	for _, mismatch := range report.Mismatches {
+		reasons[filepath.Base(mismatch.FileName)] = mismatch.Reason
+	}
+	expected := map[string]string{
+		"raw-asic1-2022.04.05.155404.fits": "checksum",
+		"raw-asic2-2022.04.05.155404.fits": "size",
+		"calibConf-2022.04.05.155408.fits": "missing",
+	}
+	for name, reason := range expected {
+		if reasons[name] != reason {
+			t.Errorf("Wrong mismatch for file %s: \"%s\" instead of \"%s\"",
+				name, reasons[name], reason)
+		}
+	}
+}
+
 func touch(name string) error {
 	return ioutil.WriteFile(name, nil, 0644)
 }
 
+func TestDuplicateCompressedFiles(t *testing.T) {
+	db := createTemporaryDb(t)
+	repository := t.TempDir()
+
+	folderPath := filepath.Join(repository, "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant")
+	const rawFile = "Raws/raw-asic1-2022.04.05.155404.fits"
+	const calConf = "Hks/calibConf-2022.04.05.155408.fits"
+	copyTestAcquisition(t, folderPath, rawFile)
+	gzipTestAcquisition(t, folderPath, rawFile, calConf)
+
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	var acq Acquisition
+	if err := db.Preload("RawFiles").Preload("Files").First(&acq).Error; err != nil {
+		t.Fatalf("Unable to retrieve the acquisition: %s", err)
+	}
+	if len(acq.RawFiles) != 1 || acq.RawFiles[0].Compression != compressionNone {
+		t.Errorf("Wrong raw files: %v", acq.RawFiles)
+	}
+	if len(acq.Files) != 1 || acq.Files[0].Compression != compressionGzip {
+		t.Errorf("Wrong files: %v", acq.Files)
+	}
+
+	report, err := QueryIngestionReport(db, 0)
+	if err != nil || report == nil {
+		t.Fatalf("Unable to retrieve the ingestion report: %v", err)
+	}
+	if report.NumOfWarnings != 1 || filepath.Base(report.Problems[0].Path) != filepath.Base(rawFile)+".gz" {
+		t.Errorf("Wrong warnings for the duplicated files: %v", report.Problems)
+	}
+}
+
+func TestIngestionReport(t *testing.T) {
+	db := createTemporaryDb(t)
+	repository := t.TempDir()
+
+	folderPath := filepath.Join(repository, "2018-05-22_13.33.56__mytest")
+	copyTestAcquisition(t, folderPath, "Hks/hk-extern-2018.05.22.133356.fits")
+
+	badFiles := []string{
+		filepath.Join(folderPath, "Raws", "raw-asicX-2018.05.22.133356.fits"),
+		filepath.Join(folderPath, "Raws", "notes.txt"),
+		filepath.Join(repository, "2018-13-45_99.99.99__wrongdate", "Raws", "raw-asic1-2018.13.45.999999.fits"),
+		filepath.Join(repository, "2018-05-22_13.33.56_mistyped", "Raws", "raw-asic1-2018.05.22.133356.fits"),
+	}
+	for _, name := range badFiles {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %s", err)
+		}
+		if err := ioutil.WriteFile(name, []byte("dummy"), 0644); err != nil {
+			t.Fatalf("Unable to create file %q: %s", name, err)
+		}
+	}
+
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	var acqList []Acquisition
+	db.Preload("RawFiles").Preload("Files").Find(&acqList)
+	if len(acqList) != 1 || len(acqList[0].RawFiles) != 0 || len(acqList[0].Files) != 1 {
+		t.Fatalf("Wrong acquisitions in the database: %v", acqList)
+	}
+
+	report, err := QueryIngestionReport(db, 0)
+	if err != nil || report == nil {
+		t.Fatalf("Unable to retrieve the ingestion report: %v", err)
+	}
+	if report.NumOfFolders != 2 || report.NumOfNewAcquisitions != 1 ||
+		report.NumOfSkippedFolders != 1 || report.NumOfWarnings != 3 {
+		t.Fatalf("Wrong ingestion report: %v", report)
+	}
+
+	severities := map[string]string{}
+	for _, problem := range report.Problems {
+		severities[filepath.Base(problem.Path)] = problem.Severity
+	}
+	for name, severity := range map[string]string{
+		"raw-asicX-2018.05.22.133356.fits": severityWarning,
+		"notes.txt":                        severityWarning,
+		"2018-13-45_99.99.99__wrongdate":   severityError,
+		"2018-05-22_13.33.56_mistyped":     severityWarning,
+	} {
+		if severities[name] != severity {
+			t.Errorf("Wrong severity for %q: %q", name, severities[name])
+		}
+	}
+
+	// Every scan produces a new report
+	if err := RefreshDbContents(db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+	reports, err := QueryIngestionReports(db)
+	if err != nil || len(reports) != 2 || reports[0].NumOfNewAcquisitions != 0 {
+		t.Fatalf("Wrong list of ingestion reports: %v (%v)", reports, err)
+	}
+}
+
+// createSyntheticRepository fills "repository" with "numOfFolders" copies of
+// the acquisition "2018-04-06_14.20.35__testbackups", each with a different
+// timestamp
+func createSyntheticRepository(tb testing.TB, repository string, numOfFolders int) {
+	names := []string{
+		"Hks/conf-asics-2018.04.06.142036.fits",
+		"Raws/raw-asic1-2018.04.06.142047.fits",
+		"hkplot/data_description.ini",
+	}
+	srcPath := filepath.Join("testdata", "2018-04-06_14.20.35__testbackups")
+	for i := 0; i < numOfFolders; i++ {
+		folderPath := filepath.Join(repository,
+			fmt.Sprintf("2018-04-06_%02d.%02d.00__synthetic", i/60, i%60))
+		for _, name := range names {
+			dest := filepath.Join(folderPath, name)
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				tb.Fatalf("Unable to create directory: %s", err)
+			}
+			if err := copyFile(dest, filepath.Join(srcPath, name)); err != nil {
+				tb.Fatalf("Unable to copy file \"%s\": %s", name, err)
+			}
+		}
+	}
+}
+
+func TestScanRepositories(t *testing.T) {
+	db := createTemporaryDb(t)
+	repositories := []Repository{
+		{Name: "lab", Path: t.TempDir()},
+		{Name: "site", Path: t.TempDir()},
+		{Name: "unmounted", Path: filepath.Join(t.TempDir(), "nonexistent")},
+	}
+	createSyntheticRepository(t, repositories[0].Path, 10)
+	copyTestAcquisition(t, filepath.Join(repositories[1].Path, "2018-05-22_13.33.56__mytest"),
+		"Hks/hk-extern-2018.05.22.133356.fits")
+
+	// Two folders with the same name cannot be told apart in the database,
+	// even if they are in different repositories
+	createSyntheticRepository(t, repositories[1].Path, 1)
+
+	// With two workers, fewer folders than those in the repositories can be
+	// scanned ahead of the first one whose changes have not been saved
+	if err := ScanRepositories(db, repositories, 2, nil); err != nil {
+		t.Fatalf("Error running ScanRepositories: %s", err)
+	}
+
+	var acqList []Acquisition
+	db.Preload("RawFiles").Preload("Files").Preload("HkChannels").Order("id").Find(&acqList)
+	if len(acqList) != 11 {
+		t.Fatalf("Wrong number of acquisitions: %d", len(acqList))
+	}
+	for i, acq := range acqList {
+		if i > 0 && acq.Repository == acqList[i-1].Repository && acq.Directoryname < acqList[i-1].Directoryname {
+			t.Errorf("Acquisition %q has been added after %q", acq.Directoryname, acqList[i-1].Directoryname)
+		}
+
+		if acq.Name == "mytest" {
+			if acq.Repository != "site" {
+				t.Errorf("Wrong repository for %q: %q", acq.Directoryname, acq.Repository)
+			}
+			continue
+		}
+
+		if acq.Repository != "lab" {
+			t.Errorf("Wrong repository for %q: %q", acq.Directoryname, acq.Repository)
+		}
+		if len(acq.RawFiles) != 1 || len(acq.Files) != 1 || len(acq.HkChannels) == 0 ||
+			acq.AsicHkFileName == "" {
+			t.Errorf("Wrong contents for acquisition %q: %d raw files, %d data files, %d channels",
+				acq.Directoryname, len(acq.RawFiles), len(acq.Files), len(acq.HkChannels))
+		}
+	}
+
+	report, err := QueryIngestionReport(db, 0)
+	if err != nil || report == nil {
+		t.Fatalf("Unable to retrieve the ingestion report: %v", err)
+	}
+	if report.NumOfFolders != 12 || report.NumOfNewAcquisitions != 11 ||
+		report.NumOfSkippedFolders != 1 || report.numOfErrors() != 2 {
+		t.Fatalf("Wrong ingestion report: %v", report)
+	}
+
+	// A second scan must not add anything
+	if err := ScanRepositories(db, repositories, 3, nil); err != nil {
+		t.Fatalf("Error running ScanRepositories: %s", err)
+	}
+	numOfRawFiles := 0
+	db.Model(&RawDataFile{}).Count(&numOfRawFiles)
+	if numOfRawFiles != 10 {
+		t.Fatalf("Wrong number of raw files after the second scan: %d", numOfRawFiles)
+	}
+
+	// The scan fails only if no repository can be read
+	if err := ScanRepositories(db, repositories[2:], 3, nil); err == nil {
+		t.Fatalf("No error when scanning a nonexistent repository")
+	}
+}
+
+func BenchmarkScanRepositories(b *testing.B) {
+	repository := b.TempDir()
+	createSyntheticRepository(b, repository, 50)
+
+	for _, numOfWorkers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", numOfWorkers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := createTemporaryDb(b)
+				b.StartTimer()
+
+				err := ScanRepositories(db, []Repository{{Name: "synthetic", Path: repository}},
+					numOfWorkers, nil)
+				if err != nil {
+					b.Fatalf("Error running ScanRepositories: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// copyFile copies the contents of file "src" into "dest"
+func copyFile(dest string, src string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dest, data, 0644)
+}
+
+// copyTestAcquisition copies files from the folder in "testdata" with the same
+// name as "folderPath". File names must be relative to the folder.
+func copyTestAcquisition(t *testing.T, folderPath string, names ...string) {
+	srcPath := filepath.Join("testdata", filepath.Base(folderPath))
+	for _, name := range names {
+		dest := filepath.Join(folderPath, name)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %s", err)
+		}
+		if err := copyFile(dest, filepath.Join(srcPath, name)); err != nil {
+			t.Fatalf("Unable to copy file \"%s\": %s", name, err)
+		}
+	}
+}
+
+// createTemporaryDb creates an empty database that is used only by the
+// current test, so that tests modifying the database do not interfere with
+// the shared "testdb"
+func createTemporaryDb(t testing.TB) *gorm.DB {
+	db, err := OpenDb(filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatalf("Unable to create a temporary database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := InitDb(db, &Configuration{}); err != nil {
+		t.Fatalf("Unable to initialize a temporary database: %s", err)
+	}
+
+	return db
+}
+
 var app *App
 
 func TestMain(m *testing.M) {
-	testdb, _ = gorm.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	testdb, _ = OpenDb("file::memory:?mode=memory&cache=shared")
 	defer testdb.Close()
 
 	InitDb(testdb, &Configuration{})
@@ -0,0 +1,213 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that describes the kinds of files (besides raw
+// and science data) that can be found in the folder of an acquisition
+
+package qutedb
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// A FileKind tells QuTeDB where to look for a kind of file within the folder
+// of an acquisition. The list of kinds is read from the configuration file and
+// copied in the database by InitDb.
+type FileKind struct {
+	ID uint `json:"-" gorm:"primary_key"`
+	// Name used in the URLs of the API (e.g., "externhk")
+	Name string `json:"name" gorm:"unique_index" mapstructure:"name"`
+	// Subdirectory of the acquisition folder containing the files
+	Directory string `json:"directory" mapstructure:"directory"`
+	// File name pattern built using POSIX wildcards
+	Mask        string `json:"mask" mapstructure:"mask"`
+	Description string `json:"description" mapstructure:"description"`
+	// If false, only one file matching the mask is kept (the last one in
+	// lexicographic order); otherwise, all the files are kept
+	Multiple bool `json:"multiple" mapstructure:"multiple"`
+	// If true, the acquisition page shows a plot of the file
+	QuickLook bool `json:"quick_look" mapstructure:"quick_look"`
+}
+
+// DefaultFileKinds lists the housekeeping files saved by QubicStudio. It is
+// used when the configuration file does not contain any file kind.
+var DefaultFileKinds = []FileKind{
+	{Name: "asichk", Directory: "Hks", Mask: "conf-asics-????.??.??.??????.fits",
+		Description: "ASIC housekeeping", QuickLook: true},
+	{Name: "internhk", Directory: "Hks", Mask: "hk-intern-????.??.??.??????.fits",
+		Description: "Internal housekeeping", QuickLook: true},
+	{Name: "externhk", Directory: "Hks", Mask: "hk-extern-????.??.??.??????.fits",
+		Description: "External housekeeping", QuickLook: true},
+	{Name: "mmrhk", Directory: "Hks", Mask: "hk-MMR-????.??.??.??????.fits",
+		Description: "MMR housekeeping", QuickLook: true},
+	{Name: "mgchk", Directory: "Hks", Mask: "hk-MGC-????.??.??.??????.fits",
+		Description: "MGC housekeeping", QuickLook: true},
+	{Name: "calconf", Directory: "Hks", Mask: "calibConf-????.??.??.??????.fits",
+		Description: "Calibrator configuration"},
+	{Name: "caldata", Directory: "Hks", Mask: "calibData-????.??.??.??????.fits",
+		Description: "Calibrator data", QuickLook: true},
+}
+
+// legacyFileFields associates the default file kinds with the fields of
+// Acquisition that stored the names of the housekeeping files before file
+// kinds became configurable. They are still filled for compatibility.
+var legacyFileFields = map[string]struct {
+	column string
+	field  func(acq *Acquisition) *string
+}{
+	"asichk": {"asic_hk_file_name",
+		func(acq *Acquisition) *string { return &acq.AsicHkFileName }},
+	"internhk": {"intern_hk_file_name",
+		func(acq *Acquisition) *string { return &acq.InternHkFileName }},
+	"externhk": {"extern_hk_file_name",
+		func(acq *Acquisition) *string { return &acq.ExternHkFileName }},
+	"mgchk": {"mgc_hk_file_name",
+		func(acq *Acquisition) *string { return &acq.MgcHkFileName }},
+	"mmrhk": {"mmr_hk_file_name",
+		func(acq *Acquisition) *string { return &acq.MmrHkFileName }},
+	"calconf": {"cal_conf_file_name",
+		func(acq *Acquisition) *string { return &acq.CalConfFileName }},
+	"caldata": {"cal_data_file_name",
+		func(acq *Acquisition) *string { return &acq.CalDataFileName }},
+}
+
+// fileKindNameRe matches the names that can be used for file kinds, as they
+// must be usable in URLs
+var fileKindNameRe = regexp.MustCompile("^[-_A-Za-z0-9]+$")
+
+// validateFileKinds checks that the names of the file kinds are unique and
+// valid, and that their masks are well-formed
+func validateFileKinds(kinds []FileKind) error {
+	names := map[string]bool{}
+	for _, kind := range kinds {
+		if !fileKindNameRe.MatchString(kind.Name) {
+			return fmt.Errorf("invalid name %q for a file kind", kind.Name)
+		}
+		if names[kind.Name] {
+			return fmt.Errorf("file kind %q is defined more than once", kind.Name)
+		}
+		names[kind.Name] = true
+
+		if kind.Mask == "" {
+			return fmt.Errorf("no mask specified for file kind %q", kind.Name)
+		}
+		if _, err := filepath.Match(kind.Mask, ""); err != nil {
+			return fmt.Errorf("invalid mask %q for file kind %q: %s", kind.Mask, kind.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// syncFileKinds replaces the file kinds stored in the database with "kinds",
+// or with DefaultFileKinds if "kinds" is empty
+func syncFileKinds(db *gorm.DB, kinds []FileKind) error {
+	if len(kinds) == 0 {
+		kinds = DefaultFileKinds
+	}
+
+	if err := validateFileKinds(kinds); err != nil {
+		return err
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(FileKind{}).Error; err != nil {
+			return err
+		}
+
+		for _, kind := range kinds {
+			kind.ID = 0
+			if err := tx.Create(&kind).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(kinds))
+	for i, kind := range kinds {
+		names[i] = kind.Name
+	}
+	log.WithFields(log.Fields{
+		"file_kinds": names,
+	}).Debug("File kinds have been saved in the database")
+
+	return nil
+}
+
+// QueryFileKinds returns the file kinds stored in the database, in the same
+// order as they appear in the configuration
+func QueryFileKinds(db *gorm.DB) ([]FileKind, error) {
+	var kinds []FileKind
+	if err := db.Order("id").Find(&kinds).Error; err != nil {
+		return nil, err
+	}
+
+	return kinds, nil
+}
+
+// BaseName returns the name of the file, without its path
+func (file *DataFile) BaseName() string {
+	return path.Base(file.FileName)
+}
+
+// FilesOfKind returns the files of the given kind belonging to the
+// acquisition, sorted by name as in the "/files" endpoints. The files must
+// have already been loaded in "acq".
+func (acq *Acquisition) FilesOfKind(kind string) []DataFile {
+	var result []DataFile
+	for _, file := range acq.Files {
+		if file.Kind == kind {
+			result = append(result, file)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FileName < result[j].FileName
+	})
+	return result
+}
+
+// FileOfKind returns the first file of the given kind belonging to the
+// acquisition, or nil if there is none. The files must have already been
+// loaded in "acq".
+func (acq *Acquisition) FileOfKind(kind string) *DataFile {
+	files := acq.FilesOfKind(kind)
+	if len(files) == 0 {
+		return nil
+	}
+
+	return &files[0]
+}
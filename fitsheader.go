@@ -0,0 +1,205 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that extracts the headers of FITS files and
+// stores them in the database
+
+package qutedb
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/astrogo/fitsio"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// A FitsHdu describes one HDU of a FITS file. It belongs to a RawDataFile, a
+// SumDataFile or a DataFile, depending on the value of "FileType".
+type FitsHdu struct {
+	ID       int    `json:"-" gorm:"primary_key"`
+	FileID   int    `json:"-" gorm:"index"`
+	FileType string `json:"-"`
+	// Index of the HDU within the file, starting from 0 for the primary HDU
+	Number int `json:"number"`
+	// Either "IMAGE", "TABLE", or "BINTABLE"
+	Type      string       `json:"type"`
+	Name      string       `json:"name"`
+	NumOfRows int64        `json:"num_of_rows"`
+	Cards     []FitsCard   `json:"cards"`
+	Columns   []FitsColumn `json:"columns"`
+}
+
+// A FitsCard is a keyword in the header of a HDU. Values are always stored as
+// strings; logical values are represented by "T" and "F". The values of
+// numeric keywords are stored in "Number" as well, so that they can be
+// compared as numbers; it is nil for any other keyword.
+type FitsCard struct {
+	ID        int      `json:"-" gorm:"primary_key"`
+	FitsHduID int      `json:"-" gorm:"index"`
+	Position  int      `json:"-"`
+	Keyword   string   `json:"keyword"`
+	Value     string   `json:"value"`
+	Number    *float64 `json:"-"`
+	Comment   string   `json:"comment"`
+}
+
+// A FitsColumn describes a column of a table HDU
+type FitsColumn struct {
+	ID        int    `json:"-" gorm:"primary_key"`
+	FitsHduID int    `json:"-" gorm:"index"`
+	Position  int    `json:"-"`
+	Name      string `json:"name"`
+	Format    string `json:"format"`
+	Unit      string `json:"unit"`
+}
+
+// fitsValueToString converts the value of a FITS card into a string
+func fitsValueToString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "T"
+		}
+		return "F"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// fitsValueToNumber returns the value of a FITS card as a number, or nil if
+// the value is not numeric
+func fitsValueToNumber(value interface{}) *float64 {
+	var result float64
+	switch v := value.(type) {
+	case int:
+		result = float64(v)
+	case float64:
+		result = v
+	case big.Int:
+		result, _ = new(big.Float).SetInt(&v).Float64()
+	default:
+		return nil
+	}
+
+	return &result
+}
+
+// readFitsHeaders returns the headers of all the HDUs in the FITS file
+// "filename"
+func readFitsHeaders(filename string) ([]FitsHdu, error) {
+	f, err := openFitsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fits, err := fitsio.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer fits.Close()
+
+	var hdus []FitsHdu
+	for i, hdu := range fits.HDUs() {
+		curHdu := FitsHdu{
+			Number: i,
+			Type:   hdu.Type().String(),
+			Name:   hdu.Name(),
+		}
+
+		header := hdu.Header()
+		for pos, key := range header.Keys() {
+			card := header.Get(key)
+			curHdu.Cards = append(curHdu.Cards, FitsCard{
+				Position: pos,
+				Keyword:  card.Name,
+				Value:    fitsValueToString(card.Value),
+				Number:   fitsValueToNumber(card.Value),
+				Comment:  card.Comment,
+			})
+		}
+
+		if table, ok := hdu.(*fitsio.Table); ok {
+			curHdu.NumOfRows = table.NumRows()
+			for pos, col := range table.Cols() {
+				curHdu.Columns = append(curHdu.Columns, FitsColumn{
+					Position: pos,
+					Name:     col.Name,
+					Format:   col.Format,
+					Unit:     col.Unit,
+				})
+			}
+		}
+
+		hdus = append(hdus, curHdu)
+	}
+
+	return hdus, nil
+}
+
+// loadFitsHeaders works like readFitsHeaders, but it only logs a warning if
+// the file cannot be read, so that a malformed file does not prevent the
+// acquisition from being added to the database
+func loadFitsHeaders(filename string) []FitsHdu {
+	hdus, err := readFitsHeaders(filename)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file_name": filename,
+			"error":     err,
+		}).Warning("Unable to read the headers of the FITS file")
+		return nil
+	}
+
+	return hdus
+}
+
+// deleteOrphanHeaders removes the headers of the files that are no longer in
+// the database
+func deleteOrphanHeaders(db *gorm.DB) error {
+	tables := []string{"raw_data_files", "sum_data_files", "data_files"}
+
+	// Older versions of QuTeDB used other tables for housekeeping files
+	if err := db.Where("file_type NOT IN (?)", tables).Delete(FitsHdu{}).Error; err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if err := db.
+			Where("file_type = ? AND file_id NOT IN (?)", table, db.Table(table).Select("id").QueryExpr()).
+			Delete(FitsHdu{}).Error; err != nil {
+			return err
+		}
+	}
+
+	orphans := db.Table("fits_hdus").Select("id").QueryExpr()
+	if err := db.Where("fits_hdu_id NOT IN (?)", orphans).Delete(FitsCard{}).Error; err != nil {
+		return err
+	}
+
+	return db.Where("fits_hdu_id NOT IN (?)", orphans).Delete(FitsColumn{}).Error
+}
@@ -0,0 +1,411 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that extracts a subset of the rows and columns
+// of the table in raw and science files
+
+package qutedb
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/astrogo/fitsio"
+)
+
+// A FitsSubset specifies which rows and columns of a table must be kept
+type FitsSubset struct {
+	// Number or name of the HDU containing the table. If empty, the first
+	// table in the file is used
+	Hdu string
+	// Range of rows to keep, counting from zero. If LastRow is negative, all
+	// the rows after FirstRow are kept
+	FirstRow int64
+	LastRow  int64
+	// If nonzero, only the rows whose time (column "ComputerDate") falls in
+	// the range [Start, End] are kept
+	Start time.Time
+	End   time.Time
+	// Names of the columns to keep. If empty, all the columns are kept
+	Columns []string
+}
+
+// FitsSubsetError is returned when the parameters of a subset do not match
+// the contents of the file
+type FitsSubsetError struct {
+	msg string
+}
+
+func (e FitsSubsetError) Error() string {
+	return e.msg
+}
+
+// structuralKeywordRe matches the keywords that describe the layout of a
+// table, which fitsio computes again when the table is written, the
+// checksums, which are no longer valid, and the provenance of tables that are
+// subsets themselves, which is replaced
+var structuralKeywordRe = regexp.MustCompile(
+	"^(XTENSION|BITPIX|NAXIS[0-9]*|PCOUNT|GCOUNT|TFIELDS|THEAP|EXTNAME|CHECKSUM|DATASUM|" +
+		"T(TYPE|FORM|UNIT|SCAL|ZERO|NULL|DISP|DIM|BCOL)[0-9]+|QDB.*)$")
+
+// imageKeywordRe matches the keywords that describe the layout of an image
+var imageKeywordRe = regexp.MustCompile("^(SIMPLE|XTENSION|BITPIX|NAXIS[0-9]*|PCOUNT|GCOUNT|CHECKSUM|DATASUM)$")
+
+// description returns a human-readable description of the subset, which is
+// saved in the HISTORY of the table
+func (subset *FitsSubset) description(numOfRows int64) string {
+	lastRow := "end"
+	if subset.LastRow >= 0 {
+		lastRow = fmt.Sprintf("%d", subset.LastRow)
+	}
+	result := fmt.Sprintf("rows %d-%s of %d", subset.FirstRow, lastRow, numOfRows)
+
+	if !subset.Start.IsZero() || !subset.End.IsZero() {
+		result += fmt.Sprintf(", %s in [%s, %s]", hkTimeColumn,
+			formatSubsetTime(subset.Start), formatSubsetTime(subset.End))
+	}
+
+	if len(subset.Columns) > 0 {
+		result += ", columns " + strings.Join(subset.Columns, ",")
+	} else {
+		result += ", all columns"
+	}
+
+	return result
+}
+
+// key returns a string identifying the subset, which is the same for all the
+// sets of parameters that select the same rows and columns
+func (subset *FitsSubset) key() string {
+	lastRow := subset.LastRow
+	if lastRow < 0 {
+		lastRow = -1
+	}
+	return fmt.Sprintf("hdu=%s&first_row=%d&last_row=%d&start=%s&end=%s&column=%s",
+		subset.Hdu, subset.FirstRow, lastRow,
+		formatSubsetTime(subset.Start), formatSubsetTime(subset.End),
+		strings.Join(subset.Columns, ","))
+}
+
+// formatSubsetTime formats one of the ends of the time range of a subset
+func formatSubsetTime(t time.Time) string {
+	if t.IsZero() {
+		return "*"
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000")
+}
+
+// copyKeywords appends to "dest" the keywords in "source" that are not
+// matched by "skipRe" and are not already in "dest". COMMENT and HISTORY cards
+// are not copied, as fitsio does not provide a way to enumerate them.
+func copyKeywords(dest *fitsio.Header, source *fitsio.Header, skipRe *regexp.Regexp) error {
+	for _, key := range source.Keys() {
+		if skipRe.MatchString(key) || dest.Get(key) != nil {
+			continue
+		}
+		if err := dest.Append(*source.Get(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newTableLike returns an empty table with the same name and keywords as
+// "table", containing the columns whose indexes are in "cols"
+func newTableLike(table *fitsio.Table, cols []int) (*fitsio.Table, error) {
+	newCols := make([]fitsio.Column, 0, len(cols))
+	for _, idx := range cols {
+		col := table.Col(idx)
+		newCols = append(newCols, fitsio.Column{
+			Name:    col.Name,
+			Format:  col.Format,
+			Unit:    col.Unit,
+			Null:    col.Null,
+			Bscale:  col.Bscale,
+			Bzero:   col.Bzero,
+			Display: col.Display,
+			Dim:     col.Dim,
+		})
+	}
+
+	result, err := fitsio.NewTable(table.Name(), newCols, table.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := copyKeywords(result.Header(), table.Header(), structuralKeywordRe); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// copyTable returns a copy of "table"
+func copyTable(table *fitsio.Table) (*fitsio.Table, error) {
+	cols := make([]int, len(table.Cols()))
+	for i := range cols {
+		cols[i] = i
+	}
+
+	result, err := newTableLike(table, cols)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fitsio.CopyTable(result, table); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// copyImage returns a copy of "img", which is the primary HDU if "primary"
+// is true
+func copyImage(img fitsio.Image, primary bool) (fitsio.Image, error) {
+	hdr := img.Header()
+
+	var result fitsio.Image
+	if primary {
+		var err error
+		header := fitsio.NewHeader(nil, fitsio.IMAGE_HDU, hdr.Bitpix(), hdr.Axes())
+		if result, err = fitsio.NewPrimaryHDU(header); err != nil {
+			return nil, err
+		}
+	} else {
+		result = fitsio.NewImage(hdr.Bitpix(), hdr.Axes())
+	}
+
+	if err := copyKeywords(result.Header(), hdr, imageKeywordRe); err != nil {
+		return nil, err
+	}
+
+	if len(hdr.Axes()) == 0 {
+		return result, nil
+	}
+
+	var data interface{}
+	switch hdr.Bitpix() {
+	case 8:
+		data = &[]int8{}
+	case 16:
+		data = &[]int16{}
+	case 32:
+		data = &[]int32{}
+	case 64:
+		data = &[]int64{}
+	case -32:
+		data = &[]float32{}
+	case -64:
+		data = &[]float64{}
+	default:
+		return nil, fmt.Errorf("invalid BITPIX %d", hdr.Bitpix())
+	}
+	if err := img.Read(data); err != nil {
+		return nil, err
+	}
+	if err := result.Write(data); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// subsetTable returns a new table containing the rows and columns of "table"
+// selected by "subset". The keywords in the header of "table" are copied,
+// and keywords describing the subset are added.
+func subsetTable(table *fitsio.Table, sourceName string, subset FitsSubset) (*fitsio.Table, error) {
+	if card := table.Header().Get("ZTABLE"); card != nil && card.Value == true {
+		return nil, unsupportedCompression("Subsets of compressed tables are not supported")
+	}
+
+	if subset.FirstRow < 0 || (subset.LastRow >= 0 && subset.LastRow < subset.FirstRow) {
+		return nil, FitsSubsetError{fmt.Sprintf("Invalid range of rows [%d, %d]", subset.FirstRow, subset.LastRow)}
+	}
+
+	var cols []int
+	if len(subset.Columns) == 0 {
+		for i := range table.Cols() {
+			cols = append(cols, i)
+		}
+	}
+	for _, name := range subset.Columns {
+		idx := table.Index(name)
+		if idx < 0 {
+			return nil, FitsSubsetError{fmt.Sprintf("Table %q has no column %q", table.Name(), name)}
+		}
+		cols = append(cols, idx)
+	}
+
+	timeIdx := -1
+	if !subset.Start.IsZero() || !subset.End.IsZero() {
+		if timeIdx = table.Index(hkTimeColumn); timeIdx < 0 {
+			return nil, FitsSubsetError{fmt.Sprintf("Table %q has no column %q", table.Name(), hkTimeColumn)}
+		}
+		if table.Col(timeIdx).Type().Kind() != reflect.Int64 {
+			return nil, FitsSubsetError{fmt.Sprintf("Column %q does not contain integer numbers", hkTimeColumn)}
+		}
+	}
+
+	result, err := newTableLike(table, cols)
+	if err != nil {
+		return nil, err
+	}
+
+	provenance := []fitsio.Card{
+		{Name: "QDBVERS", Value: QuteDBVersion, Comment: "Version of QuTeDB that made the subset"},
+		{Name: "QDBSRC", Value: sourceName, Comment: "File containing the whole table"},
+		{Name: "QDBNROWS", Value: table.NumRows(), Comment: "Number of rows in the whole table"},
+		{Name: "QDBFROW", Value: subset.FirstRow, Comment: "First row of the subset (from 0)"},
+		{Name: "QDBLROW", Value: subset.LastRow, Comment: "Last row of the subset (-1 means the end)"},
+	}
+	if !subset.Start.IsZero() {
+		provenance = append(provenance, fitsio.Card{
+			Name:    "QDBTSTA",
+			Value:   subset.Start.UnixNano() / int64(time.Millisecond),
+			Comment: "Start of the time range [ms since 1970-01-01]",
+		})
+	}
+	if !subset.End.IsZero() {
+		provenance = append(provenance, fitsio.Card{
+			Name:    "QDBTEND",
+			Value:   subset.End.UnixNano() / int64(time.Millisecond),
+			Comment: "End of the time range [ms since 1970-01-01]",
+		})
+	}
+	provenance = append(provenance, fitsio.Card{
+		Name:    "HISTORY",
+		Comment: fmt.Sprintf("Subset of %s: %s", sourceName, subset.description(table.NumRows())),
+	})
+	if err := result.Header().Append(provenance...); err != nil {
+		return nil, err
+	}
+
+	end := table.NumRows()
+	if subset.LastRow >= 0 && subset.LastRow+1 < end {
+		end = subset.LastRow + 1
+	}
+	rows, err := table.Read(subset.FirstRow, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Rows can only be read as a whole, so every column needs a value
+	values := make([]interface{}, len(table.Cols()))
+	for i := range table.Cols() {
+		values[i] = reflect.New(table.Col(i).Type()).Interface()
+	}
+	selected := make([]interface{}, len(cols))
+	for i, idx := range cols {
+		selected[i] = values[idx]
+	}
+
+	startMs := subset.Start.UnixNano() / int64(time.Millisecond)
+	endMs := subset.End.UnixNano() / int64(time.Millisecond)
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+
+		if timeIdx >= 0 {
+			timeMs := *values[timeIdx].(*int64)
+			if (!subset.Start.IsZero() && timeMs < startMs) || (!subset.End.IsZero() && timeMs > endMs) {
+				continue
+			}
+		}
+
+		if err := result.Write(selected...); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// WriteFitsSubset writes into "w" a FITS file containing the rows and
+// columns of the table in "filename" selected by "subset". The other HDUs
+// are copied as they are. Errors due to the parameters in "subset" are of
+// type FitsSubsetError.
+func WriteFitsSubset(w io.Writer, filename string, subset FitsSubset) error {
+	f, err := openFitsFile(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fits, err := fitsio.Open(f)
+	if err != nil {
+		return err
+	}
+	defer fits.Close()
+
+	table, err := hkTable(fits, subset.Hdu)
+	if err != nil {
+		if queryErr, ok := err.(HkQueryError); ok {
+			return FitsSubsetError{queryErr.msg}
+		}
+		return err
+	}
+
+	newTable, err := subsetTable(table, filepath.Base(filename), subset)
+	if err != nil {
+		return err
+	}
+
+	out, err := fitsio.Create(w)
+	if err != nil {
+		return err
+	}
+	// fitsio.CopyHDU would write the END card of the original headers twice,
+	// so the other HDUs are copied one by one
+	for i, hdu := range fits.HDUs() {
+		copied := fitsio.HDU(newTable)
+		switch cur := hdu.(type) {
+		case *fitsio.Table:
+			if cur != table {
+				copied, err = copyTable(cur)
+			}
+		case fitsio.Image:
+			copied, err = copyImage(cur, i == 0)
+		default:
+			err = fmt.Errorf("unknown type of HDU %d", i)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := out.Write(copied); err != nil {
+			return err
+		}
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,110 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that reads the description of the housekeeping
+// channels saved by QubicStudio in "hkplot/data_description.ini"
+
+package qutedb
+
+import (
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+// A HkChannel describes one of the housekeeping channels recorded during an
+// acquisition
+type HkChannel struct {
+	ID            int `json:"-" gorm:"primary_key"`
+	AcquisitionID int `json:"-" gorm:"index"`
+	// Name of the section in "data_description.ini"
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Unit     string `json:"unit"`
+	// Name of the channel containing the X values (usually the time) of
+	// this channel. It is empty if the channel is itself a X axis.
+	XName          string `json:"x_name"`
+	XDataOptions   int    `json:"x_data_options"`
+	DataType       int    `json:"data_type"`
+	ObjectDataSize int    `json:"object_data_size"`
+}
+
+// HkDescriptionFileName returns the name of the file describing the
+// housekeeping channels of the acquisition in "folder"
+func HkDescriptionFileName(folder string) string {
+	return path.Join(folder, "hkplot", "data_description.ini")
+}
+
+// readHkChannels parses the file "data_description.ini" and returns the list
+// of channels described in it
+func readHkChannels(filename string) ([]HkChannel, error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []HkChannel
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+
+		// QubicStudio appends ".dat" to the name of the X channel
+		xName := strings.TrimSuffix(section.Key("externXName").String(), ".dat")
+		channels = append(channels, HkChannel{
+			Name:           section.Name(),
+			RealName:       section.Key("realName").String(),
+			Unit:           strings.TrimSpace(section.Key("unit").String()),
+			XName:          xName,
+			XDataOptions:   section.Key("XDataOptions").MustInt(0),
+			DataType:       section.Key("dataType").MustInt(0),
+			ObjectDataSize: section.Key("objectDataSize").MustInt(0),
+		})
+	}
+
+	return channels, nil
+}
+
+// loadHkChannels works like readHkChannels, but it returns an empty list if
+// the acquisition in "folder" has no description of the channels, and it only
+// logs a warning if the file cannot be parsed
+func loadHkChannels(folder string) []HkChannel {
+	filename := HkDescriptionFileName(folder)
+	if !fileExists(filename) {
+		return nil
+	}
+
+	channels, err := readHkChannels(filename)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file_name": filename,
+			"error":     err,
+		}).Warning("Unable to read the description of the housekeeping channels")
+		return nil
+	}
+
+	return channels
+}
@@ -0,0 +1,128 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that produces plots of housekeeping channels
+
+package qutedb
+
+import (
+	"io"
+	"math"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart/v2"
+)
+
+// maxDefaultPlotChannels is the number of channels plotted when the user does
+// not specify any
+const maxDefaultPlotChannels = 4
+
+// defaultPlotChannels picks the channels to plot when the user does not ask
+// for any specific channel. It skips the GPS time, which is useless in a plot
+func defaultPlotChannels(channels []HkChannelSeries) []HkChannelSeries {
+	var result []HkChannelSeries
+	for _, channel := range channels {
+		if channel.Name == "GPSDate" {
+			continue
+		}
+
+		result = append(result, channel)
+		if len(result) == maxDefaultPlotChannels {
+			break
+		}
+	}
+
+	return result
+}
+
+// utcTimeFormatter formats the ticks on the X axis as UTC times
+func utcTimeFormatter(v interface{}) string {
+	if value, ok := v.(float64); ok {
+		return time.Unix(0, int64(value)).UTC().Format("15:04:05")
+	}
+	return ""
+}
+
+// PlotHkTimeSeries writes a plot of the channels in "series" to "w". The
+// parameter "format" can be either "png" or "svg". NaNs and infinities are
+// not plotted.
+func PlotHkTimeSeries(w io.Writer, series *HkTimeSeries, title string, width, height int, format string) error {
+	graph := chart.Chart{
+		Title:  title,
+		Width:  width,
+		Height: height,
+		Background: chart.Style{
+			Padding: chart.Box{Top: 40, Left: 20, Right: 20, Bottom: 20},
+		},
+		XAxis: chart.XAxis{
+			Name:           "Time (UTC)",
+			ValueFormatter: utcTimeFormatter,
+		},
+	}
+
+	units := map[string]bool{}
+	for _, channel := range series.Channels {
+		var xValues []time.Time
+		var yValues []float64
+		for i, value := range channel.Values {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			xValues = append(xValues, time.Unix(0, series.Time[i]*int64(time.Millisecond)).UTC())
+			yValues = append(yValues, value)
+		}
+
+		// A line needs at least two points
+		if len(xValues) < 2 {
+			continue
+		}
+
+		units[channel.Unit] = true
+		graph.Series = append(graph.Series, chart.TimeSeries{
+			Name:    channel.Name,
+			XValues: xValues,
+			YValues: yValues,
+		})
+	}
+
+	if len(graph.Series) == 0 {
+		return HkQueryError{"There are not enough samples to produce a plot"}
+	}
+
+	// Units are often descriptions rather than proper units, so we show them
+	// only if they are the same for all the channels
+	if len(units) == 1 {
+		for unit := range units {
+			graph.YAxis.Name = unit
+		}
+	}
+
+	graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+
+	if format == "svg" {
+		return graph.Render(chart.SVG, w)
+	}
+	return graph.Render(chart.PNG, w)
+}
@@ -0,0 +1,332 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that extracts time series from the tables in
+// housekeeping files
+
+package qutedb
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/astrogo/fitsio"
+)
+
+// hkTimeColumn is the name of the column containing the time of each sample
+// in housekeeping tables, measured in milliseconds since 1970-01-01
+const hkTimeColumn = "ComputerDate"
+
+// A HkQuery specifies which data to extract from a housekeeping file
+type HkQuery struct {
+	// Number or name of the HDU to read. If empty, the first table in the
+	// file is used
+	Hdu string
+	// Names of the columns to read. If empty, all the scalar columns are read
+	Channels []string
+	// If nonzero, only samples acquired in the range [Start, End] are
+	// returned
+	Start time.Time
+	End   time.Time
+	// If nonzero, samples are decimated so that no more than NumOfPoints
+	// samples are returned
+	NumOfPoints int
+}
+
+// HkQueryError is returned by ReadHkTimeSeries if the query cannot be
+// satisfied because of a mistake in the parameters
+type HkQueryError struct {
+	msg string
+}
+
+func (e HkQueryError) Error() string {
+	return e.msg
+}
+
+// hkValues is a list of samples that is encoded in JSON using "null" for NaNs
+// and infinities, as JSON does not support them
+type hkValues []float64
+
+func (values hkValues) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, value := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			buf.WriteString("null")
+		} else {
+			buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// A HkChannelSeries contains the samples of one housekeeping channel
+type HkChannelSeries struct {
+	Name   string   `json:"name"`
+	Unit   string   `json:"unit"`
+	Values hkValues `json:"values"`
+}
+
+// A HkTimeSeries contains the samples of a few housekeeping channels
+// acquired at the same times
+type HkTimeSeries struct {
+	// Name of the HDU containing the samples
+	Hdu string `json:"hdu"`
+	// Time of each sample, in milliseconds since 1970-01-01
+	Time     []int64           `json:"time"`
+	Channels []HkChannelSeries `json:"channels"`
+}
+
+// hkTable returns the table in the HDU requested by the user
+func hkTable(fits *fitsio.File, hdu string) (*fitsio.Table, error) {
+	if hdu == "" {
+		for _, cur := range fits.HDUs() {
+			if table, ok := cur.(*fitsio.Table); ok {
+				return table, nil
+			}
+		}
+		return nil, HkQueryError{"The file does not contain any table"}
+	}
+
+	var cur fitsio.HDU
+	if num, err := strconv.Atoi(hdu); err == nil {
+		if num < 0 || num >= len(fits.HDUs()) {
+			return nil, HkQueryError{fmt.Sprintf("HDU %d does not exist", num)}
+		}
+		cur = fits.HDU(num)
+	} else {
+		if !fits.Has(hdu) {
+			return nil, HkQueryError{fmt.Sprintf("HDU %q does not exist", hdu)}
+		}
+		cur = fits.Get(hdu)
+	}
+
+	table, ok := cur.(*fitsio.Table)
+	if !ok {
+		return nil, HkQueryError{fmt.Sprintf("HDU %q is not a table", hdu)}
+	}
+	return table, nil
+}
+
+// toFloat64 converts the value of a scalar column into a float64
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// isScalarColumn returns true if the column contains one number per row
+func isScalarColumn(col *fitsio.Column) bool {
+	switch col.Type().Kind() {
+	case reflect.Bool,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadHkTimeSeries reads the samples of the channels in "query" from the
+// housekeeping file "filename"
+func ReadHkTimeSeries(filename string, query HkQuery) (*HkTimeSeries, error) {
+	f, err := openFitsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fits, err := fitsio.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer fits.Close()
+
+	table, err := hkTable(fits, query.Hdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if table.Index(hkTimeColumn) < 0 {
+		return nil, HkQueryError{fmt.Sprintf("Table %q has no column %q", table.Name(), hkTimeColumn)}
+	}
+
+	channels := query.Channels
+	if len(channels) == 0 {
+		for i := range table.Cols() {
+			col := table.Col(i)
+			if col.Name != hkTimeColumn && isScalarColumn(col) {
+				channels = append(channels, col.Name)
+			}
+		}
+	}
+
+	result := HkTimeSeries{Hdu: table.Name(), Time: []int64{}}
+	for _, name := range channels {
+		idx := table.Index(name)
+		if idx < 0 {
+			return nil, HkQueryError{fmt.Sprintf("Table %q has no column %q", table.Name(), name)}
+		}
+		if !isScalarColumn(table.Col(idx)) {
+			return nil, HkQueryError{fmt.Sprintf("Column %q does not contain scalar numbers", name)}
+		}
+
+		result.Channels = append(result.Channels, HkChannelSeries{
+			Name:   name,
+			Unit:   table.Col(idx).Unit,
+			Values: hkValues{},
+		})
+	}
+
+	rows, err := table.Read(0, table.NumRows())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	startMs := query.Start.UnixNano() / int64(time.Millisecond)
+	endMs := query.End.UnixNano() / int64(time.Millisecond)
+	for rows.Next() {
+		data := map[string]interface{}{hkTimeColumn: nil}
+		for _, name := range channels {
+			data[name] = nil
+		}
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		timeMs, ok := data[hkTimeColumn].(int64)
+		if !ok {
+			return nil, HkQueryError{fmt.Sprintf("Column %q does not contain integer numbers", hkTimeColumn)}
+		}
+		if (!query.Start.IsZero() && timeMs < startMs) || (!query.End.IsZero() && timeMs > endMs) {
+			continue
+		}
+
+		result.Time = append(result.Time, timeMs)
+		for i, name := range channels {
+			value, _ := toFloat64(data[name])
+			result.Channels[i].Values = append(result.Channels[i].Values, value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result.decimate(query.NumOfPoints)
+	return &result, nil
+}
+
+// decimate keeps one sample every N, so that no more than "numOfPoints"
+// samples are left
+func (series *HkTimeSeries) decimate(numOfPoints int) {
+	if numOfPoints <= 0 || len(series.Time) <= numOfPoints {
+		return
+	}
+
+	step := (len(series.Time) + numOfPoints - 1) / numOfPoints
+	decimatedTime := make([]int64, 0, numOfPoints)
+	for i := 0; i < len(series.Time); i += step {
+		decimatedTime = append(decimatedTime, series.Time[i])
+	}
+	series.Time = decimatedTime
+
+	for c := range series.Channels {
+		values := series.Channels[c].Values
+		decimated := make(hkValues, 0, numOfPoints)
+		for i := 0; i < len(values); i += step {
+			decimated = append(decimated, values[i])
+		}
+		series.Channels[c].Values = decimated
+	}
+}
+
+// WriteCSV returns the samples as a CSV table. The first column contains the
+// time of each sample
+func (series *HkTimeSeries) WriteCSV() ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	record := []string{"time"}
+	for _, channel := range series.Channels {
+		record = append(record, channel.Name)
+	}
+	if err := writer.Write(record); err != nil {
+		return nil, err
+	}
+
+	for i, timeMs := range series.Time {
+		record = record[:0]
+		record = append(record, strconv.FormatInt(timeMs, 10))
+		for _, channel := range series.Channels {
+			record = append(record, strconv.FormatFloat(channel.Values[i], 'g', -1, 64))
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
@@ -0,0 +1,345 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that checks the structure of the acquisition
+// folders and records the problems found while scanning the repository
+
+package qutedb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The folder has not been added to the database
+	severityError = "error"
+
+	// The folder has been added to the database, but something in it was
+	// ignored
+	severityWarning = "warning"
+)
+
+// maxIngestionReports is the number of ingestion reports kept in the
+// database. Older reports are deleted automatically.
+const maxIngestionReports = 100
+
+// An IngestionProblem describes something unexpected that has been found
+// while scanning the repository
+type IngestionProblem struct {
+	ID                uint `json:"-" gorm:"primary_key"`
+	IngestionReportID uint `json:"-" gorm:"index"`
+	// Path of the folder or of the file that caused the problem
+	Path string `json:"path"`
+	// Either "error" (the folder has been skipped) or "warning"
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// An IngestionReport summarizes what happened during a scan of the
+// repository, or during the ingestion of one folder by the Watcher
+type IngestionReport struct {
+	ID         uint      `json:"id" gorm:"primary_key"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Either "scan" or "watcher"
+	Trigger              string             `json:"trigger"`
+	NumOfFolders         int                `json:"num_of_folders"`
+	NumOfNewAcquisitions int                `json:"num_of_new_acquisitions"`
+	NumOfSkippedFolders  int                `json:"num_of_skipped_folders"`
+	NumOfWarnings        int                `json:"num_of_warnings"`
+	Problems             []IngestionProblem `json:"problems,omitempty"`
+}
+
+// addProblem adds a problem to the report and logs it
+func (report *IngestionReport) addProblem(problem IngestionProblem) {
+	fields := log.Fields{
+		"path":    problem.Path,
+		"message": problem.Message,
+	}
+	if problem.Severity == severityError {
+		log.WithFields(fields).Error("Folder has not been ingested")
+	} else {
+		log.WithFields(fields).Warning("Problem found while ingesting a folder")
+		report.NumOfWarnings++
+	}
+
+	report.Problems = append(report.Problems, problem)
+}
+
+// addFolder updates the report with the result of a call to refreshFolder
+func (report *IngestionReport) addFolder(changes *FolderChanges) {
+	report.NumOfFolders++
+	if changes.NewAcquisition {
+		report.NumOfNewAcquisitions++
+	}
+	if changes.Skipped {
+		report.NumOfSkippedFolders++
+	}
+
+	for _, problem := range changes.Problems {
+		report.addProblem(problem)
+	}
+}
+
+// addProblem records a problem found while scanning the folder
+func (changes *FolderChanges) addProblem(severity string, path string, format string, args ...interface{}) {
+	changes.Problems = append(changes.Problems, IngestionProblem{
+		Path:     path,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// warn records a problem that does not prevent the folder from being ingested
+func (changes *FolderChanges) warn(path string, format string, args ...interface{}) {
+	changes.addProblem(severityWarning, path, format, args...)
+}
+
+// skip records a problem that prevents the folder from being ingested
+func (changes *FolderChanges) skip(path string, format string, args ...interface{}) {
+	changes.Skipped = true
+	changes.addProblem(severityError, path, format, args...)
+}
+
+// parseFolderName extracts the name and the time of an acquisition from the
+// name of its folder, e.g., "2019-05-07_18.11.29__RF_switch_cont_13_34"
+func parseFolderName(dirname string) (string, time.Time, error) {
+	if !isAcquisitionFolder(dirname) {
+		return "", time.Time{}, fmt.Errorf("%q is not the name of an acquisition folder", dirname)
+	}
+
+	// The mask guarantees that the name contains at least 21 ASCII characters
+	acquisitionTime, err := time.Parse("2006-01-02_15.04.05", dirname[:19])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("wrong time in folder name %q", dirname)
+	}
+
+	return dirname[21:], acquisitionTime, nil
+}
+
+// suspiciousFolderRe matches the names of the folders that begin like an
+// acquisition folder
+var suspiciousFolderRe = regexp.MustCompile("^[0-9]{4}-[0-9]{2}-[0-9]{2}_")
+
+// looksLikeAcquisitionFolder returns true if the name of the folder "path"
+// begins with a date, even if it does not match the pattern used for
+// acquisitions: in this case, the name has probably been mistyped
+func looksLikeAcquisitionFolder(path string) bool {
+	return suspiciousFolderRe.MatchString(filepath.Base(path))
+}
+
+// matchesAnyMask returns true if "name" matches at least one of the masks
+func matchesAnyMask(name string, masks []string) bool {
+	for _, mask := range masks {
+		if matchesMask(mask, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A folderListing contains the names of the regular files found in the
+// directories of an acquisition folder, so that each directory is read only
+// once, no matter how many masks are used to look for files in it
+type folderListing map[string][]string
+
+// readDirectory adds the regular files in "dir" to the listing
+func (listing folderListing) readDirectory(dir string) error {
+	// The entries are already sorted by name
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		mode := entry.Type()
+		if mode&os.ModeSymlink != 0 {
+			// Symbolic links are followed
+			info, err := os.Stat(path.Join(dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			mode = info.Mode()
+		}
+
+		if mode.IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	listing[dir] = names
+	return nil
+}
+
+// dropDuplicates removes from the listing of "dir" the files that have the
+// same name as a file listed before them once the extension of the
+// compression is removed, e.g., "a.fits.gz" if "a.fits" is present, and
+// reports them as warnings. Since names are sorted, the uncompressed file is
+// the one kept, if there is any.
+func (listing folderListing) dropDuplicates(changes *FolderChanges, dir string) {
+	var names []string
+	kept := map[string]string{}
+	for _, name := range listing[dir] {
+		if other, ok := kept[uncompressedName(name)]; ok {
+			changes.warn(path.Join(dir, name),
+				"The file is a copy of %q with a different compression and has been ignored", other)
+			continue
+		}
+
+		kept[uncompressedName(name)] = name
+		names = append(names, name)
+	}
+
+	listing[dir] = names
+}
+
+// match returns the full path of the files in "dir" whose name matches
+// "mask", in lexicographic order. Compressed files are included as well.
+func (listing folderListing) match(dir string, mask string) []string {
+	var result []string
+	for _, name := range listing[dir] {
+		if matchesMask(mask, name) {
+			result = append(result, path.Join(dir, name))
+		}
+	}
+
+	return result
+}
+
+// checkFolder reads the directories of the acquisition folder "folderPath"
+// and looks for problems in its structure before it is ingested. Directories
+// that cannot be read make the folder be skipped, while files that do not
+// match any mask are only reported as warnings.
+func checkFolder(changes *FolderChanges, folderPath string, fileKinds []FileKind) folderListing {
+	listing := folderListing{}
+	if _, err := os.ReadDir(folderPath); err != nil {
+		changes.skip(folderPath, "Unable to read the folder: %s", err)
+		return listing
+	}
+
+	masks := map[string][]string{
+		RawDirName(folderPath): {rawFileMask},
+		SumDirName(folderPath): {sumFileMask},
+	}
+	for _, kind := range fileKinds {
+		dir := path.Join(folderPath, kind.Directory)
+		masks[dir] = append(masks[dir], kind.Mask)
+	}
+
+	dirs := make([]string, 0, len(masks))
+	for dir := range masks {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		err := listing.readDirectory(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			changes.skip(dir, "Unable to read the directory: %s", err)
+			continue
+		}
+
+		listing.dropDuplicates(changes, dir)
+
+		for _, name := range listing[dir] {
+			if !matchesAnyMask(name, masks[dir]) {
+				changes.warn(path.Join(dir, name),
+					"The file does not match any known pattern and has been ignored")
+			}
+		}
+	}
+
+	return listing
+}
+
+// saveIngestionReport saves "report" in the database and deletes the oldest
+// reports, so that no more than maxIngestionReports are kept
+func saveIngestionReport(db *gorm.DB, report *IngestionReport) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(report).Error; err != nil {
+			return err
+		}
+
+		keep := tx.Table("ingestion_reports").
+			Select("id").
+			Order("id desc").
+			Limit(maxIngestionReports).
+			QueryExpr()
+		if err := tx.Where("id NOT IN (?)", keep).Delete(IngestionReport{}).Error; err != nil {
+			return err
+		}
+
+		return tx.
+			Where("ingestion_report_id NOT IN (?)", tx.Table("ingestion_reports").Select("id").QueryExpr()).
+			Delete(IngestionProblem{}).Error
+	})
+}
+
+// QueryIngestionReports returns the most recent ingestion reports, without
+// the list of problems
+func QueryIngestionReports(db *gorm.DB) ([]IngestionReport, error) {
+	var reports []IngestionReport
+	if err := db.Order("id desc").Find(&reports).Error; err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// QueryIngestionReport returns the ingestion report with the given ID,
+// together with its problems. If "id" is zero, the most recent report is
+// returned. If no report is found, the function returns nil.
+func QueryIngestionReport(db *gorm.DB, id uint) (*IngestionReport, error) {
+	query := db.Preload("Problems", func(db *gorm.DB) *gorm.DB {
+		return db.Order("severity, path")
+	})
+	if id != 0 {
+		query = query.Where("id = ?", id)
+	}
+
+	var report IngestionReport
+	result := query.Order("id desc").First(&report)
+	if result.RecordNotFound() {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &report, nil
+}
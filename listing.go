@@ -0,0 +1,430 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file implements the filtering, sorting and pagination of the list of
+// acquisitions
+
+package qutedb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// acquisitionSortColumns maps the values accepted by the parameter "sort" to
+// the columns of the table "acquisitions"
+var acquisitionSortColumns = map[string]string{
+	"time":       "acquisitions.acquisition_time",
+	"name":       "acquisitions.name",
+	"repository": "acquisitions.repository",
+	"campaign":   "acquisitions.campaign",
+}
+
+// An AcquisitionQuery describes which acquisitions must be listed, in which
+// order, and which part of the list must be returned. It is usually built
+// from the parameters of a HTTP request using ParseAcquisitionQuery.
+type AcquisitionQuery struct {
+	// Conditions on the headers of the FITS files and the kinds of files
+	// they apply to, see FilterByHeaders
+	Predicates  []HeaderPredicate
+	HeaderFiles []string
+	// Lists of accepted repositories and campaigns, and of the tags that
+	// acquisitions must have; empty lists accept everything
+	Repositories []string
+	Campaigns    []string
+	Tags         []string
+	// Time span, in the same format as Acquisition.AcquisitionTime. Both
+	// ends are included, and empty strings mean that the span is open.
+	StartTime string
+	EndTime   string
+	// Substring (case-insensitive) and regular expression that the name of
+	// the acquisitions must match
+	Name       string
+	NameRegexp string
+	// If not nil, these require the presence (true) or the absence (false)
+	// of raw files, science files, and files listed by /files
+	HasRaw *bool
+	HasSum *bool
+	HasHk  *bool
+	// If not empty, only acquisitions with raw or science files for one of
+	// these ASICs are listed
+	Asics []int
+	// Key used to sort the list (one of the keys of acquisitionSortColumns)
+	// and order
+	Sort       string
+	Descending bool
+	// Maximum number of acquisitions to return (0 means no limit), and
+	// either the number of acquisitions to skip or the cursor returned with
+	// the previous page
+	Limit  int
+	Offset int
+	Cursor *AcquisitionCursor
+}
+
+// An AcquisitionCursor marks the position of the last acquisition in a page,
+// so that the next page can be retrieved even if new acquisitions have been
+// added in the meantime
+type AcquisitionCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d"`
+	Value      string `json:"v"`
+	ID         uint   `json:"i"`
+}
+
+// Encode returns the cursor as an opaque string that can be used in URLs
+func (cursor AcquisitionCursor) Encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeAcquisitionCursor parses a string returned by
+// AcquisitionCursor.Encode
+func decodeAcquisitionCursor(str string) (*AcquisitionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", str)
+	}
+
+	var cursor AcquisitionCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", str)
+	}
+	if _, ok := acquisitionSortColumns[cursor.Sort]; !ok {
+		return nil, fmt.Errorf("invalid cursor %q", str)
+	}
+
+	return &cursor, nil
+}
+
+// splitValues returns all the values of the parameter "key", splitting them
+// at commas, e.g., "?tag=a,b&tag=c" becomes ["a", "b", "c"]
+func splitValues(values url.Values, key string) []string {
+	var result []string
+	for _, str := range values[key] {
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// parseNonNegative parses the parameter "key", returning 0 if it is missing
+func parseNonNegative(values url.Values, key string) (int, error) {
+	str := values.Get(key)
+	if str == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.Atoi(str)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid value %q for %q, it must be a non-negative integer", str, key)
+	}
+	return value, nil
+}
+
+// ParseAcquisitionQuery builds an AcquisitionQuery from the parameters of a
+// HTTP request, like "?start=2019-05-01&name=IV&sort=name&limit=50"
+func ParseAcquisitionQuery(values url.Values) (*AcquisitionQuery, error) {
+	query := AcquisitionQuery{
+		HeaderFiles:  splitValues(values, "file"),
+		Repositories: splitValues(values, "repository"),
+		Campaigns:    splitValues(values, "campaign"),
+		Tags:         splitValues(values, "tag"),
+		Name:         values.Get("name"),
+		NameRegexp:   values.Get("name_regexp"),
+		Sort:         "time",
+		Descending:   true,
+	}
+
+	for _, str := range values["header"] {
+		pred, err := ParseHeaderPredicate(str)
+		if err != nil {
+			return nil, err
+		}
+		query.Predicates = append(query.Predicates, pred)
+	}
+
+	// Check the kinds of files and the tags now, so that mistakes in the
+	// request are not confused with errors of the database
+	for _, kind := range query.HeaderFiles {
+		if _, ok := headerFileTables[kind]; !ok {
+			return nil, fmt.Errorf("Unknown kind of file: %q", kind)
+		}
+	}
+	for i := range query.Tags {
+		tag, err := normalizeTagName(query.Tags[i])
+		if err != nil {
+			return nil, err
+		}
+		query.Tags[i] = tag
+	}
+
+	var err error
+	if query.StartTime, err = parseTimeBound(values.Get("start"), false); err != nil {
+		return nil, err
+	}
+	if query.EndTime, err = parseTimeBound(values.Get("end"), true); err != nil {
+		return nil, err
+	}
+
+	if query.NameRegexp != "" {
+		if _, err := regexp.Compile(query.NameRegexp); err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %s", query.NameRegexp, err)
+		}
+	}
+
+	for key, field := range map[string]**bool{
+		"has_raw": &query.HasRaw,
+		"has_sum": &query.HasSum,
+		"has_hk":  &query.HasHk,
+	} {
+		str := values.Get(key)
+		if str == "" {
+			continue
+		}
+
+		value, err := strconv.ParseBool(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for %q, it must be either true or false", str, key)
+		}
+		*field = &value
+	}
+
+	for _, str := range splitValues(values, "asic") {
+		asic, err := strconv.Atoi(str)
+		if err != nil || asic < 1 {
+			return nil, fmt.Errorf("invalid ASIC number %q", str)
+		}
+		query.Asics = append(query.Asics, asic)
+	}
+
+	if str := values.Get("sort"); str != "" {
+		if _, ok := acquisitionSortColumns[str]; !ok {
+			return nil, fmt.Errorf("unable to sort acquisitions by %q, use one of time, name, repository, campaign", str)
+		}
+		query.Sort = str
+		// Times are sorted from the most recent by default, everything else
+		// alphabetically
+		query.Descending = str == "time"
+	}
+	switch values.Get("order") {
+	case "":
+	case "asc":
+		query.Descending = false
+	case "desc":
+		query.Descending = true
+	default:
+		return nil, fmt.Errorf("invalid order %q, use either asc or desc", values.Get("order"))
+	}
+
+	if query.Limit, err = parseNonNegative(values, "limit"); err != nil {
+		return nil, err
+	}
+	if query.Offset, err = parseNonNegative(values, "offset"); err != nil {
+		return nil, err
+	}
+	if str := values.Get("cursor"); str != "" {
+		if query.Offset > 0 {
+			return nil, fmt.Errorf("\"cursor\" and \"offset\" cannot be used together")
+		}
+		if query.Cursor, err = decodeAcquisitionCursor(str); err != nil {
+			return nil, err
+		}
+		if query.Cursor.Sort != query.Sort || query.Cursor.Descending != query.Descending {
+			return nil, fmt.Errorf("the cursor was produced with a different sort order")
+		}
+	}
+
+	return &query, nil
+}
+
+// filter restricts a query on the table "acquisitions" using all the
+// conditions in "query" but the ones about pagination
+func (query *AcquisitionQuery) filter(db *gorm.DB) (*gorm.DB, error) {
+	db, err := FilterByHeaders(db, query.Predicates, query.HeaderFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(query.Repositories) > 0 {
+		db = db.Where("acquisitions.repository IN (?)", query.Repositories)
+	}
+	if len(query.Campaigns) > 0 {
+		db = db.Where("acquisitions.campaign IN (?)", query.Campaigns)
+	}
+	if db, err = FilterByTags(db, query.Tags); err != nil {
+		return nil, err
+	}
+
+	if query.StartTime != "" {
+		db = db.Where("acquisitions.acquisition_time >= ?", query.StartTime)
+	}
+	if query.EndTime != "" {
+		db = db.Where("acquisitions.acquisition_time <= ?", query.EndTime)
+	}
+
+	if query.Name != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query.Name)
+		db = db.Where(`acquisitions.name LIKE ? ESCAPE '\'`, "%"+escaped+"%")
+	}
+	if query.NameRegexp != "" {
+		db = db.Where("acquisitions.name REGEXP ?", query.NameRegexp)
+	}
+
+	for _, presence := range []struct {
+		value *bool
+		table string
+	}{
+		{query.HasRaw, "raw_data_files"},
+		{query.HasSum, "sum_data_files"},
+		{query.HasHk, "data_files"},
+	} {
+		if presence.value == nil {
+			continue
+		}
+
+		operator := "IN"
+		if !*presence.value {
+			operator = "NOT IN"
+		}
+		db = db.Where(fmt.Sprintf("acquisitions.id %s (SELECT acquisition_id FROM %s)",
+			operator, presence.table))
+	}
+
+	if len(query.Asics) > 0 {
+		db = db.Where(`acquisitions.id IN (
+			SELECT acquisition_id FROM raw_data_files WHERE asic_number IN (?)
+			UNION SELECT acquisition_id FROM sum_data_files WHERE asic_number IN (?))`,
+			query.Asics, query.Asics)
+	}
+
+	return db, nil
+}
+
+// An AcquisitionPage is a part of the list of acquisitions matching an
+// AcquisitionQuery
+type AcquisitionPage struct {
+	Acquisitions []Acquisition
+	// Number of acquisitions matching the query, in all the pages
+	Total int
+	// Position of the first acquisition of this page in the full list. It is
+	// not known if the page was retrieved using a cursor.
+	Offset int
+	// Cursor to retrieve the next page, or nil if this is the last one
+	Next *AcquisitionCursor
+}
+
+// First returns the position of the first acquisition of the page in the
+// full list, starting from 1
+func (page *AcquisitionPage) First() int {
+	return page.Offset + 1
+}
+
+// Last returns the position of the last acquisition of the page in the full
+// list, starting from 1
+func (page *AcquisitionPage) Last() int {
+	return page.Offset + len(page.Acquisitions)
+}
+
+// QueryAcquisitionPage returns the acquisitions matching "query". The
+// function "preload" can add Preload clauses to the query that loads the
+// acquisitions in the page; it can be nil.
+func QueryAcquisitionPage(db *gorm.DB, query *AcquisitionQuery,
+	preload func(*gorm.DB) *gorm.DB) (*AcquisitionPage, error) {
+	filtered, err := query.filter(db.Model(&Acquisition{}))
+	if err != nil {
+		return nil, err
+	}
+
+	page := AcquisitionPage{Acquisitions: []Acquisition{}, Offset: query.Offset}
+	if err := filtered.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+
+	column := acquisitionSortColumns[query.Sort]
+	direction, comparison := "asc", ">"
+	if query.Descending {
+		direction, comparison = "desc", "<"
+	}
+	// The ID breaks ties, so that the order is always the same
+	pageQuery := filtered.Order(fmt.Sprintf("%s %s, acquisitions.id %s", column, direction, direction))
+
+	if query.Cursor != nil {
+		pageQuery = pageQuery.Where(
+			fmt.Sprintf("(%[1]s %[2]s ?) OR (%[1]s = ? AND acquisitions.id %[2]s ?)", column, comparison),
+			query.Cursor.Value, query.Cursor.Value, query.Cursor.ID,
+		)
+		page.Offset = -1
+	} else if query.Offset > 0 {
+		pageQuery = pageQuery.Offset(query.Offset)
+	}
+
+	if query.Limit > 0 {
+		// Ask for one more acquisition, to know if there is a next page
+		pageQuery = pageQuery.Limit(query.Limit + 1)
+	}
+	if preload != nil {
+		pageQuery = preload(pageQuery)
+	}
+	if err := pageQuery.Find(&page.Acquisitions).Error; err != nil {
+		return nil, err
+	}
+
+	if query.Limit > 0 && len(page.Acquisitions) > query.Limit {
+		page.Acquisitions = page.Acquisitions[:query.Limit]
+
+		last := page.Acquisitions[query.Limit-1]
+		page.Next = &AcquisitionCursor{
+			Sort:       query.Sort,
+			Descending: query.Descending,
+			Value:      last.sortValue(query.Sort),
+			ID:         last.ID,
+		}
+	}
+
+	return &page, nil
+}
+
+// sortValue returns the value of the field used to sort acquisitions by "key"
+func (acq *Acquisition) sortValue(key string) string {
+	switch key {
+	case "name":
+		return acq.Name
+	case "repository":
+		return acq.Repository
+	case "campaign":
+		return acq.Campaign
+	default:
+		return acq.AcquisitionTime
+	}
+}
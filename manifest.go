@@ -0,0 +1,97 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that builds manifests, i.e., machine-readable
+// descriptions of the files of acquisitions
+
+package qutedb
+
+import "time"
+
+// A ManifestFile describes one of the files of an acquisition
+type ManifestFile struct {
+	// Either "raw", "sum", or the name of a FileKind
+	Kind       string `json:"kind"`
+	AsicNumber int    `json:"asic_number,omitempty"`
+	// Path of the file within archives
+	FileName string `json:"file_name"`
+	// URL of the endpoint that returns the file
+	URL     string `json:"url"`
+	Missing bool   `json:"missing"`
+	FileInfo
+}
+
+// An AcquisitionManifest describes an acquisition and its files
+type AcquisitionManifest struct {
+	Acquisition
+	Files []ManifestFile `json:"files"`
+}
+
+// A BundleManifest describes the acquisitions in an archive and their files.
+// It is saved in the archive as "manifest.json", so that clients can check
+// and index the files without querying the server.
+type BundleManifest struct {
+	QuteDBVersion string                `json:"qutedb_version"`
+	GeneratedAt   time.Time             `json:"generated_at"`
+	Acquisitions  []AcquisitionManifest `json:"acquisitions"`
+}
+
+// A CampaignManifest describes a campaign and the files of all its
+// acquisitions
+type CampaignManifest struct {
+	Campaign
+	BundleManifest
+}
+
+// acquisitionManifest describes the files of "acq" included in "selection",
+// using the same paths as archives whose files are put in the folder "root"
+func acquisitionManifest(acq *Acquisition, root string, fileKinds []FileKind,
+	selection archiveSelection) AcquisitionManifest {
+	manifest := AcquisitionManifest{
+		Acquisition: *acq,
+		Files:       []ManifestFile{},
+	}
+	for _, entry := range acquisitionArchiveEntries(acq, root, fileKinds, selection) {
+		manifest.Files = append(manifest.Files, entry.manifest)
+	}
+
+	return manifest
+}
+
+// bundleManifest describes the files of "acqs" included in "selection"; the
+// files of each acquisition are in the folder returned by "rootOf"
+func bundleManifest(acqs []Acquisition, rootOf func(*Acquisition) string, fileKinds []FileKind,
+	selection archiveSelection) BundleManifest {
+	manifest := BundleManifest{
+		QuteDBVersion: QuteDBVersion,
+		GeneratedAt:   time.Now().UTC(),
+		Acquisitions:  []AcquisitionManifest{},
+	}
+	for i := range acqs {
+		manifest.Acquisitions = append(manifest.Acquisitions,
+			acquisitionManifest(&acqs[i], rootOf(&acqs[i]), fileKinds, selection))
+	}
+
+	return manifest
+}
@@ -0,0 +1,79 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the definition of the repositories scanned by QuTeDB
+
+package qutedb
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// DefaultRepositoryName is the name of the repository used when the
+// configuration file only specifies "repository_path"
+const DefaultRepositoryName = "default"
+
+// A Repository is a folder containing acquisitions. Each acquisition in the
+// database remembers the name of the repository where it was found.
+type Repository struct {
+	// Name used in URLs and in ZIP archives (e.g., "lab")
+	Name string `json:"name" mapstructure:"name"`
+	Path string `json:"path" mapstructure:"path"`
+}
+
+// validateRepositories checks that the names of the repositories are unique
+// and valid, and that no repository contains another one
+func validateRepositories(repositories []Repository) error {
+	names := map[string]bool{}
+	for _, repo := range repositories {
+		// Repository names follow the same rules as the names of file kinds
+		if !fileKindNameRe.MatchString(repo.Name) {
+			return fmt.Errorf("invalid name %q for a repository", repo.Name)
+		}
+		if names[repo.Name] {
+			return fmt.Errorf("repository %q is defined more than once", repo.Name)
+		}
+		names[repo.Name] = true
+
+		if repo.Path == "" {
+			return fmt.Errorf("no path specified for repository %q", repo.Name)
+		}
+	}
+
+	for _, repo := range repositories {
+		for _, other := range repositories {
+			if repo.Name == other.Name {
+				continue
+			}
+
+			rel, err := filepath.Rel(filepath.Clean(repo.Path), filepath.Clean(other.Path))
+			if err == nil && (rel == "." || filepath.IsLocal(rel)) {
+				return fmt.Errorf("repository %q is within repository %q", other.Name, repo.Name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -25,13 +25,14 @@ THE SOFTWARE.
 package qutedb
 
 import (
-	"archive/zip"
-	"compress/flate"
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
@@ -41,6 +42,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
 )
 
 // logMiddleware is a middleware function used by the router. It logs a number
@@ -83,10 +85,37 @@ func (app *App) session(w http.ResponseWriter, r *http.Request) (*Session, error
 	return QuerySessionByUUID(app.db, value)
 }
 
+// homePageSize is the number of acquisitions shown in each page of the list
+// in the home page
+const homePageSize = 100
+
 // HomeData contains the data passed to the "index.html" template
 type HomeData struct {
 	User            User
 	AcquisitionList []Acquisition
+	// The page of the list shown in "AcquisitionList", the parameters used to
+	// filter the list, and the URLs of the previous and next pages (empty if
+	// there is no such page)
+	Page     *AcquisitionPage
+	Filter   url.Values
+	PrevPage string
+	NextPage string
+	// Number of acquisitions with missing folders or files
+	NumOfMissing int
+	FileKinds    []FileKind
+	// Most recent ingestion report, shown only to administrators
+	LatestReport *IngestionReport
+	// State of the scan of the repository run at startup
+	Scan ScanStatus
+}
+
+// AcquisitionData contains the data passed to the "acquisition.html" template
+type AcquisitionData struct {
+	*Acquisition
+	FileKinds []FileKind
+	Comments  []Comment
+	// User who is looking at the page, or nil if nobody is logged in
+	User *User
 }
 
 func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) error {
@@ -104,8 +133,20 @@ func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	var acqList []Acquisition
-	if err := app.db.Order("acquisition_time desc").Find(&acqList).Error; err != nil {
+	// The home page accepts the same parameters as /api/v1/acquisitions, but
+	// it shows one page at a time
+	query, err := ParseAcquisitionQuery(r.URL.Query())
+	if err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+	if query.Limit == 0 {
+		query.Limit = homePageSize
+	}
+
+	page, err := QueryAcquisitionPage(app.db, query, func(db *gorm.DB) *gorm.DB {
+		return preloadTags(db).Preload("Files")
+	})
+	if err != nil {
 		return Error{
 			err:  err,
 			msg:  "Unable to retrieve list of acquisitions",
@@ -113,12 +154,41 @@ func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 	log.WithFields(log.Fields{
-		"num_of_acquisitions": len(acqList),
+		"num_of_acquisitions": len(page.Acquisitions),
+		"total":               page.Total,
 	}).Info("List of acquisitions going to be sent to index.html")
 
+	numOfMissing := 0
+	if err := app.db.Model(&Acquisition{}).
+		Where("missing = ? OR missing_files > 0", true).
+		Count(&numOfMissing).Error; err != nil {
+		return Error{err: err, msg: "Unable to count the missing acquisitions"}
+	}
+
+	fileKinds, err := QueryFileKinds(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of file kinds"}
+	}
+
+	var latestReport *IngestionReport
+	if user.Superuser {
+		if latestReport, err = QueryIngestionReport(app.db, 0); err != nil {
+			return Error{err: err, msg: "Unable to retrieve the ingestion report"}
+		}
+	}
+
+	prev, next := pageLinks(r, query, page)
 	return generateHTML(w, HomeData{
 		User:            *user,
-		AcquisitionList: acqList,
+		PrevPage:        prev,
+		NextPage:        next,
+		AcquisitionList: page.Acquisitions,
+		Page:            page,
+		Filter:          r.URL.Query(),
+		NumOfMissing:    numOfMissing,
+		FileKinds:       fileKinds,
+		LatestReport:    latestReport,
+		Scan:            app.scanProgress.Status(),
 	}, "layout", "private.navbar", "index")
 }
 
@@ -193,20 +263,86 @@ func (app *App) authenticateHandler(w http.ResponseWriter, r *http.Request) erro
 	return nil
 }
 
+// pageURL returns the URL of the request "r", with the parameters used to
+// retrieve another page of results changed to "changes". Empty values remove
+// the parameter.
+func pageURL(r *http.Request, changes map[string]string) string {
+	values := r.URL.Query()
+	for key, value := range changes {
+		if value == "" {
+			values.Del(key)
+		} else {
+			values.Set(key, value)
+		}
+	}
+
+	result := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+	return result.String()
+}
+
+// pageLinks returns the URLs of the previous and next page of the list of
+// acquisitions; each of them is empty if there is no such page. The previous
+// page is known only if the request uses "offset" instead of "cursor".
+func pageLinks(r *http.Request, query *AcquisitionQuery, page *AcquisitionPage) (prev string, next string) {
+	if page.Next != nil {
+		if query.Cursor != nil {
+			next = pageURL(r, map[string]string{"cursor": page.Next.Encode()})
+		} else {
+			next = pageURL(r, map[string]string{"offset": strconv.Itoa(query.Offset + query.Limit)})
+		}
+	}
+
+	if query.Cursor == nil && query.Offset > 0 {
+		offset := query.Offset - query.Limit
+		if query.Limit == 0 || offset <= 0 {
+			prev = pageURL(r, map[string]string{"offset": ""})
+		} else {
+			prev = pageURL(r, map[string]string{"offset": strconv.Itoa(offset)})
+		}
+	}
+
+	return prev, next
+}
+
 func (app *App) acquisitionListHandler(w http.ResponseWriter, r *http.Request) error {
-	var acq []Acquisition
 	if app == nil {
 		panic("app cannot be nil")
 	}
-	if err := app.db.Order("acquisition_time desc").Find(&acq).Error; err != nil {
+
+	// Acquisitions can be filtered by the values of the keywords in the
+	// headers of their FITS files, by repository, campaign, tag, time, name
+	// and files, and they can be split in pages
+	query, err := ParseAcquisitionQuery(r.URL.Query())
+	if err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	page, err := QueryAcquisitionPage(app.db, query, preloadTags)
+	if err != nil {
 		return Error{err: err, msg: "Unable to query the database"}
 	}
 
-	data, err := json.Marshal(acq)
+	data, err := json.Marshal(page.Acquisitions)
 	if err != nil {
 		return Error{err: err, msg: "Unable to encode the list of acquisitions"}
 	}
 
+	// Information about the pages is sent in the headers, so that the body
+	// is always the list of acquisitions
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	prev, next := pageLinks(r, query, page)
+	var links []string
+	if next != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, next))
+		w.Header().Set("X-Next-Cursor", page.Next.Encode())
+	}
+	if prev != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, prev))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 
@@ -225,16 +361,32 @@ func (app *App) acquisitionHandler(w http.ResponseWriter, r *http.Request) error
 	vars := mux.Vars(r)
 	acq, err := QueryAcquisition(app.db, vars["acq_id"])
 	if err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to query the database for acquisition with ID %s",
-				vars["acq_id"]),
-		}
+		return err
 	}
 
 	// If the requester wants an HTML page, satisfy it!
 	if strings.Contains(r.Header.Get("Accept"), "text/html") {
-		return generateHTML(w, acq, "layout", "private.navbar", "acquisition")
+		fileKinds, err := QueryFileKinds(app.db)
+		if err != nil {
+			return Error{err: err, msg: "Unable to retrieve the list of file kinds"}
+		}
+
+		comments, err := QueryComments(app.db, acq)
+		if err != nil {
+			return Error{err: err, msg: "Unable to retrieve the comments"}
+		}
+
+		var user *User
+		if session, _ := app.session(w, r); session != nil {
+			user, _ = QueryUserByID(app.db, session.UserID)
+		}
+
+		return generateHTML(w, AcquisitionData{
+			Acquisition: acq,
+			FileKinds:   fileKinds,
+			Comments:    comments,
+			User:        user,
+		}, "layout", "private.navbar", "acquisition")
 	}
 
 	// Otherwise, just return a JSON record
@@ -249,62 +401,6 @@ func (app *App) acquisitionHandler(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
-func addFileToArchive(nameInArchive string, filename string, comment string, ziparchive *zip.Writer) error {
-	fileInfo, err := os.Lstat(filename)
-	if err != nil {
-		return err
-	}
-
-	fileHeader, err := zip.FileInfoHeader(fileInfo)
-	if err != nil {
-		return err
-	}
-	fileHeader.Method = zip.Deflate
-	fileHeader.Name = nameInArchive
-	fileHeader.Comment = comment
-
-	f, err := ziparchive.CreateHeader(fileHeader)
-	if err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to add file \"%s\" to ZIP archive", nameInArchive),
-		}
-	}
-
-	datafile, err := os.Open(filename)
-	if err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to retrieve FITS file \"%s\"", filename),
-		}
-	}
-	defer datafile.Close()
-
-	if _, err := io.Copy(f, datafile); err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to compress file \"%s\"", filename),
-		}
-	}
-
-	return nil
-}
-
-func addFilesToArchive(filelist []string, dirname string, comment string, ziparchive *zip.Writer) error {
-	for _, filename := range filelist {
-		if err := addFileToArchive(
-			dirname+"/"+path.Base(filename),
-			filename,
-			comment,
-			ziparchive,
-		); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 func (app *App) acquisitionBundleHandler(w http.ResponseWriter, r *http.Request) error {
 	if app == nil {
 		panic("app cannot be nil")
@@ -317,119 +413,204 @@ func (app *App) acquisitionBundleHandler(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	acq, err := QueryAcquisition(app.db, vars["acq_id"])
 	if err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to query the database for acquisition with ID %s",
-				vars["acq_id"]),
-		}
+		return err
 	}
 
-	zipFile, err := os.CreateTemp("", "qutedb")
+	fileKinds, err := QueryFileKinds(app.db)
 	if err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to create a temporary Zip file for acquisition with ID %s",
-				vars["acq_id"]),
-		}
+		return Error{err: err, msg: "Unable to retrieve the list of file kinds"}
 	}
 
-	defer os.Remove(zipFile.Name())
+	// Files are put in a folder named after the repository containing the
+	// acquisition, together with the manifest
+	return serveArchive(w, r, acq.Directoryname, fileKinds, func(builder *archiveBuilder) error {
+		acqs := []Acquisition{*acq}
+		rootOf := func(acq *Acquisition) string { return acq.Repository }
 
-	ziparchive := zip.NewWriter(zipFile)
-
-	// We strive for speed here, so we use the lowest possible compression
-	// level. This usually achieves good performance nevertheless, so it is not a
-	// big loss
-	ziparchive.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, flate.BestSpeed)
+		manifest := builder.bundleManifest(acqs, rootOf)
+		if err := builder.addManifest(path.Join(acq.Repository, "manifest.json"), manifest); err != nil {
+			return err
+		}
+		return builder.addAcquisitions(acqs, rootOf)
 	})
+}
 
-	// Create the directory structure within the ZIP file
-	if _, err := ziparchive.Create("Hks/"); err != nil {
-		return Error{err: err, msg: "Unable to create directory structure in ZIP file"}
+// fileOpenError wraps an error returned by os.Open, so that files that have
+// disappeared from the repository are reported with a proper HTTP code
+func fileOpenError(err error, fileName string) error {
+	code := http.StatusInternalServerError
+	if os.IsNotExist(err) {
+		code = http.StatusGone
 	}
 
-	if _, err := ziparchive.Create("Raws/"); err != nil {
-		return Error{err: err, msg: "Unable to create directory structure in ZIP file"}
+	return Error{
+		err:  err,
+		msg:  fmt.Sprintf("Unable to retrieve the FITS file %q", fileName),
+		code: code,
 	}
+}
 
-	if _, err := ziparchive.Create("Sums/"); err != nil {
-		return Error{err: err, msg: "Unable to create directory structure in ZIP file"}
+// missingFileError returns the error to send when a file has been flagged as
+// missing from the repository
+func missingFileError(fileName string) error {
+	return Error{
+		err:  nil,
+		msg:  fmt.Sprintf("File %q is no longer present in the repository", path.Base(fileName)),
+		code: http.StatusGone,
 	}
+}
+
+// A trackingWriter remembers if something has been written in the response,
+// so that errors can still be reported to the client as long as nothing has
+// been sent
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
 
-	filelist := make([]string, len(acq.RawFiles))
-	for i := 0; i < len(acq.RawFiles); i++ {
-		filelist[i] = acq.RawFiles[i].FileName
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.written = true
+	return t.w.Write(p)
+}
+
+// fileCacheMaxAge is the time during which clients and proxies can keep the
+// files downloaded from the repository without asking the server again
+const fileCacheMaxAge = time.Hour
+
+// contentDisposition returns the value of the header "Content-Disposition"
+// that makes clients save the file with name "fileName"
+func contentDisposition(fileName string) string {
+	result := fmt.Sprintf("attachment; filename=%q", fileName)
+	for _, c := range fileName {
+		if c >= 0x80 {
+			// Old clients use the plain name, new ones the UTF-8 one (RFC 6266)
+			return result + "; filename*=UTF-8''" + url.PathEscape(fileName)
+		}
 	}
-	if err := addFilesToArchive(filelist, "Raws", "FITS file containing raw ASIC data", ziparchive); err != nil {
-		return err
+	return result
+}
+
+// fileContentType returns the MIME type of the file "fileName" in the
+// repository as it is stored on disk, or an empty string if it should be
+// guessed from its contents. Tile-compressed files are still FITS files,
+// while gzipped files are not.
+func fileContentType(fileName string) string {
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".fits", ".fit", ".fts", ".fz":
+		return "application/fits"
+	case ".gz":
+		return "application/gzip"
+	default:
+		return ""
 	}
+}
 
-	filelist = make([]string, len(acq.SumFiles))
-	for i := 0; i < len(acq.SumFiles); i++ {
-		filelist[i] = acq.SumFiles[i].FileName
+// fileETag returns the entity tag of the file "fileName", whose size and
+// modification time are in "stat". The checksum in "info" is used only if the
+// file has not changed since it was added to the database.
+func fileETag(stat os.FileInfo, info FileInfo) string {
+	if info.Sha256 != "" && stat.Size() == info.Size && stat.ModTime().Unix() == info.ModTime.Unix() {
+		return fmt.Sprintf(`"%s"`, info.Sha256)
 	}
-	if err := addFilesToArchive(filelist, "Sums", "FITS file containing scientific ASIC data", ziparchive); err != nil {
-		return err
+	return fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size())
+}
+
+// serveDecompressedFitsFile sends the decompressed contents of the compressed
+// FITS file "fileName" over the HTTP connection
+func serveDecompressedFitsFile(w http.ResponseWriter, r *http.Request, fileName string) error {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return fileOpenError(err, fileName)
 	}
 
-	if acq.AsicHkFileName != "" {
-		if err := addFileToArchive("Hks/"+path.Base(acq.AsicHkFileName), acq.AsicHkFileName,
-			"FITS file containing ASIC configuration", ziparchive); err != nil {
-			return err
-		}
+	// The size of the decompressed file is not known in advance, so
+	// "Content-Length" is not set and ranges are not supported. The checksum
+	// in the database refers to the compressed file, so it is not sent
+	// either.
+	w.Header().Set("Content-Type", "application/fits")
+	w.Header().Set("Content-Disposition", contentDisposition(path.Base(uncompressedName(fileName))))
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(fileCacheMaxAge.Seconds())))
+	if r.Method == http.MethodHead {
+		return nil
 	}
 
-	if acq.InternHkFileName != "" {
-		if err := addFileToArchive("Hks/"+path.Base(acq.InternHkFileName), acq.InternHkFileName,
-			"FITS file containing internal housekeeping data", ziparchive); err != nil {
-			return err
-		}
+	writer := trackingWriter{w: w}
+	err = decompressFitsFile(&writer, fileName)
+	if err == nil {
+		return nil
 	}
 
-	if acq.ExternHkFileName != "" {
-		if err := addFileToArchive("Hks/"+path.Base(acq.ExternHkFileName), acq.ExternHkFileName,
-			"FITS file containing external housekeeping data", ziparchive); err != nil {
-			return err
-		}
+	if writer.written {
+		// It is too late to send an error to the client: break the
+		// connection, so that the client does not take the truncated file
+		// for a complete one
+		log.WithFields(log.Fields{
+			"file_name": fileName,
+			"error":     err,
+		}).Error("Unable to decompress the FITS file")
+		panic(http.ErrAbortHandler)
 	}
 
-	if acq.MmrHkFileName != "" {
-		if err := addFileToArchive("Hks/"+path.Base(acq.MmrHkFileName), acq.MmrHkFileName,
-			"FITS file containing MMR housekeeping data", ziparchive); err != nil {
-			return err
-		}
+	code := http.StatusInternalServerError
+	if _, ok := err.(UnsupportedCompressionError); ok {
+		code = http.StatusNotImplemented
+	}
+	return Error{
+		err:  err,
+		msg:  fmt.Sprintf("Unable to decompress the FITS file %q: %s", path.Base(fileName), err),
+		code: code,
 	}
+}
 
-	if acq.MgcHkFileName != "" {
-		if err := addFileToArchive("Hks/"+path.Base(acq.MgcHkFileName), acq.MgcHkFileName,
-			"FITS file containing MGC housekeeping data", ziparchive); err != nil {
-			return err
+// serveFitsFile sends the FITS file "fileName" over the HTTP connection. If
+// "info" contains a checksum, it is sent in the "X-Checksum-Sha256" header, so
+// that clients can verify the integrity of the file they downloaded.
+// Compressed files are decompressed on the fly if the request contains
+// "decompress=true". Otherwise, clients can ask for parts of the file (e.g.,
+// to resume a download) and use conditional requests.
+func serveFitsFile(w http.ResponseWriter, r *http.Request, fileName string, info FileInfo) error {
+	if str := r.URL.Query().Get("decompress"); str != "" {
+		decompress, err := strconv.ParseBool(str)
+		if err != nil {
+			return Error{
+				err:  err,
+				msg:  fmt.Sprintf("Invalid value %q for \"decompress\"", str),
+				code: http.StatusBadRequest,
+			}
 		}
-	}
 
-	if acq.CalDataFileName != "" {
-		if err := addFileToArchive("Hks/"+path.Base(acq.CalDataFileName), acq.CalDataFileName,
-			"FITS file containing calibrator data", ziparchive); err != nil {
-			return err
+		if decompress && compressionOf(fileName) != compressionNone {
+			return serveDecompressedFitsFile(w, r, fileName)
 		}
 	}
 
-	if acq.CalConfFileName != "" {
-		if err := addFileToArchive("Hks/"+path.Base(acq.CalConfFileName), acq.CalConfFileName,
-			"FITS file containing the configuration of the calibrator", ziparchive); err != nil {
-			return err
-		}
+	fitsfile, err := os.Open(fileName)
+	if err != nil {
+		return fileOpenError(err, fileName)
 	}
+	defer fitsfile.Close()
 
-	if err := ziparchive.Close(); err != nil {
-		return err
+	stat, err := fitsfile.Stat()
+	if err != nil {
+		return fileOpenError(err, fileName)
 	}
 
-	zipFileName := zipFile.Name()
-	zipFile.Close()
+	// All the headers must be set before calling ServeContent, which sets
+	// "Content-Length" and "Last-Modified" and handles ranges, conditional
+	// requests and HEAD
+	if contentType := fileContentType(fileName); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(path.Base(fileName)))
+	w.Header().Set("ETag", fileETag(stat, info))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(fileCacheMaxAge.Seconds())))
+	if info.Sha256 != "" {
+		w.Header().Set("X-Checksum-Sha256", info.Sha256)
+	}
 
-	http.ServeFile(w, r, zipFileName)
+	http.ServeContent(w, r, path.Base(fileName), stat.ModTime(), fitsfile)
 	return nil
 }
 
@@ -439,10 +620,14 @@ func (app *App) rawListHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	vars := mux.Vars(r)
+	acq, err := findAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
+
 	var rawFiles []RawDataFile
 	if err := app.db.
-		Joins("JOIN acquisitions ON raw_data_files.acquisition_id = acquisitions.id").
-		Where("acquisitions.acquisition_time = ?", vars["acq_id"]).
+		Where("acquisition_id = ?", acq.ID).
 		Find(&rawFiles).Error; err != nil {
 		return Error{
 			err: err,
@@ -466,34 +651,12 @@ func (app *App) rawFileHandler(w http.ResponseWriter, r *http.Request) error {
 		panic("app cannot be nil")
 	}
 
-	vars := mux.Vars(r)
-	asicNumber, _ := strconv.Atoi(vars["asic_num"])
-	var rawFiles []RawDataFile
-	if err := app.db.
-		Joins("JOIN acquisitions ON raw_data_files.acquisition_id = acquisitions.id").
-		Where("acquisitions.acquisition_time = ? AND asic_number = ?",
-			vars["acq_id"], asicNumber).
-		Find(&rawFiles).Error; err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to query for raw file (ASIC %d) belonging to ID %s",
-				asicNumber, vars["acq_id"],
-			),
-		}
-	}
-
-	fitsfile, err := os.Open(rawFiles[0].FileName)
+	rawFile, err := app.rawFileOf(mux.Vars(r))
 	if err != nil {
-		return Error{err: err, msg: "Unable to retrieve the FITS file"}
-	}
-	defer fitsfile.Close()
-
-	if _, err := io.Copy(w, fitsfile); err != nil {
-		return Error{err: err, msg: "Unable to send the FITS file"}
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/fits")
-	return nil
+	return serveFitsFile(w, r, rawFile.FileName, rawFile.FileInfo)
 }
 
 func (app *App) sumListHandler(w http.ResponseWriter, r *http.Request) error {
@@ -502,10 +665,14 @@ func (app *App) sumListHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	vars := mux.Vars(r)
+	acq, err := findAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
+
 	var sumFiles []SumDataFile
 	if err := app.db.
-		Joins("JOIN acquisitions ON sum_data_files.acquisition_id = acquisitions.id").
-		Where("acquisitions.acquisition_time = ?", vars["acq_id"]).
+		Where("acquisition_id = ?", acq.ID).
 		Find(&sumFiles).Error; err != nil {
 		return Error{
 			err: err,
@@ -528,129 +695,1449 @@ func (app *App) sumFileHandler(w http.ResponseWriter, r *http.Request) error {
 		panic("app cannot be nil")
 	}
 
-	vars := mux.Vars(r)
-	asicNumber, _ := strconv.Atoi(vars["asic_num"])
-	var sumFiles []SumDataFile
-	if err := app.db.
-		Joins("JOIN acquisitions ON sum_data_files.acquisition_id = acquisitions.id").
-		Where("acquisitions.acquisition_time = ? AND asic_number = ?",
-			vars["acq_id"], asicNumber).
-		Find(&sumFiles).Error; err != nil {
-		return Error{
-			err: err,
-			msg: fmt.Sprintf("Unable to query for science file (ASIC %d) belonging to ID %s",
-				asicNumber, vars["acq_id"],
-			),
-		}
+	sumFile, err := app.sumFileOf(mux.Vars(r))
+	if err != nil {
+		return err
+	}
+
+	return serveFitsFile(w, r, sumFile.FileName, sumFile.FileInfo)
+}
+
+func (app *App) fileKindListHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
 	}
 
-	fitsfile, err := os.Open(sumFiles[0].FileName)
+	fileKinds, err := QueryFileKinds(app.db)
 	if err != nil {
-		return Error{err: err, msg: "Unable to retrieve the FITS file"}
+		return Error{err: err, msg: "Unable to retrieve the list of file kinds"}
 	}
-	defer fitsfile.Close()
 
-	if _, err := io.Copy(w, fitsfile); err != nil {
-		return Error{err: err, msg: "Unable to send the FITS file"}
+	data, err := json.Marshal(fileKinds)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the list of file kinds"}
 	}
 
-	w.Header().Set("Content-Type", "application/fits")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 	return nil
 }
 
-func (app *App) genericHkHandler(w http.ResponseWriter, r *http.Request, getFileName func(*Acquisition) string) error {
+func (app *App) dataFileListHandler(w http.ResponseWriter, r *http.Request) error {
 	if app == nil {
 		panic("app cannot be nil")
 	}
 
 	vars := mux.Vars(r)
-	log.WithFields(log.Fields{
-		"acq_id": vars["acq_id"],
-	}).Debug("REST request for a HK file")
+	acq, err := findAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
 
-	var acq Acquisition
-	if err := app.db.
-		Where("acquisition_time = ?", vars["acq_id"]).
-		First(&acq).Error; err != nil {
+	query := app.db.
+		Where("acquisition_id = ?", acq.ID)
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+
+	var files []DataFile
+	if err := query.Order("kind, file_name").Find(&files).Error; err != nil {
 		return Error{
 			err: err,
-			msg: fmt.Sprintf("Unable to query for acquisition with ID %s",
-				vars["acq_id"]),
-		}
+			msg: fmt.Sprintf("Unable to query for the files belonging to ID %s",
+				vars["acq_id"])}
 	}
 
-	fileName := getFileName(&acq)
-	if fileName == "" {
-		return Error{err: nil, msg: "File not present in the acquisition"}
+	data, err := json.Marshal(files)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the list of files"}
 	}
 
-	log.WithFields(log.Fields{
-		"filename": fileName,
-		"url":      r.URL.String(),
-	}).Info("Going to copy a FITS file over a HTTP connection")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	return nil
+}
 
-	fitsfile, err := os.Open(fileName)
+// dataFileOf returns the file of kind vars["kind"] in the acquisition with ID
+// vars["acq_id"]. If the acquisition contains more than one file of that
+// kind, vars["index"] selects one of them (sorted by name); by default, the
+// first one is returned.
+func (app *App) dataFileOf(vars map[string]string) (*DataFile, error) {
+	index := 0
+	if str, ok := vars["index"]; ok {
+		var err error
+		if index, err = strconv.Atoi(str); err != nil {
+			return nil, Error{
+				err:  err,
+				msg:  fmt.Sprintf("Invalid file index %q", str),
+				code: http.StatusBadRequest,
+			}
+		}
+	}
+
+	acq, err := findAcquisition(app.db, vars["acq_id"])
 	if err != nil {
-		return Error{
+		return nil, err
+	}
+
+	var files []DataFile
+	if err := app.db.
+		Where("acquisition_id = ? AND kind = ?", acq.ID, vars["kind"]).
+		Order("file_name").
+		Find(&files).Error; err != nil {
+		return nil, Error{
 			err: err,
-			msg: fmt.Sprintf("Unable to retrieve the FITS file %q",
-				fileName),
+			msg: fmt.Sprintf("Unable to query for files of kind %q belonging to ID %s",
+				vars["kind"], vars["acq_id"],
+			),
 		}
 	}
-	defer fitsfile.Close()
 
-	if _, err := io.Copy(w, fitsfile); err != nil {
-		return Error{
-			err: err,
-			msg: "Unable to send the FITS file",
+	if index >= len(files) {
+		return nil, Error{
+			err: nil,
+			msg: fmt.Sprintf("No file of kind %q with index %d in acquisition with ID %s",
+				vars["kind"], index, vars["acq_id"]),
+			code: http.StatusNotFound,
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/fits")
-	return nil
+	return &files[index], nil
 }
 
-func (app *App) asicHkHandler(w http.ResponseWriter, r *http.Request) error {
-	return app.genericHkHandler(w, r, func(acq *Acquisition) string {
-		return acq.AsicHkFileName
-	})
-}
+func (app *App) dataFileHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
 
-func (app *App) internHkHandler(w http.ResponseWriter, r *http.Request) error {
-	return app.genericHkHandler(w, r, func(acq *Acquisition) string {
-		return acq.InternHkFileName
-	})
-}
+	file, err := app.dataFileOf(mux.Vars(r))
+	if err != nil {
+		return err
+	}
 
-func (app *App) externHkHandler(w http.ResponseWriter, r *http.Request) error {
-	return app.genericHkHandler(w, r, func(acq *Acquisition) string {
-		return acq.ExternHkFileName
-	})
-}
+	if file.Missing {
+		return missingFileError(file.FileName)
+	}
 
-func (app *App) mmrHkHandler(w http.ResponseWriter, r *http.Request) error {
-	return app.genericHkHandler(w, r, func(acq *Acquisition) string {
-		return acq.MmrHkFileName
-	})
-}
+	log.WithFields(log.Fields{
+		"filename": file.FileName,
+		"url":      r.URL.String(),
+	}).Info("Going to copy a FITS file over a HTTP connection")
 
-func (app *App) mgcHkHandler(w http.ResponseWriter, r *http.Request) error {
-	return app.genericHkHandler(w, r, func(acq *Acquisition) string {
-		return acq.MgcHkFileName
-	})
+	return serveFitsFile(w, r, file.FileName, file.FileInfo)
 }
 
-func (app *App) calDataHkHandler(w http.ResponseWriter, r *http.Request) error {
-	return app.genericHkHandler(w, r, func(acq *Acquisition) string {
-		return acq.CalDataFileName
-	})
-}
+// sendFitsHeaders sends the headers of the file with ID "fileID" in the
+// table "fileType" as a JSON list, one element per HDU
+func (app *App) sendFitsHeaders(w http.ResponseWriter, fileType string, fileID int) error {
+	var hdus []FitsHdu
+	if err := app.db.
+		Preload("Cards", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Preload("Columns", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Where("file_type = ? AND file_id = ?", fileType, fileID).
+		Order("number").
+		Find(&hdus).Error; err != nil {
+		return Error{err: err, msg: "Unable to query for the headers of the file"}
+	}
 
-func (app *App) calConfHkHandler(w http.ResponseWriter, r *http.Request) error {
-	return app.genericHkHandler(w, r, func(acq *Acquisition) string {
-		return acq.CalConfFileName
-	})
+	if len(hdus) == 0 {
+		return Error{
+			err:  nil,
+			msg:  "No header is available for the file",
+			code: http.StatusNotFound,
+		}
+	}
+
+	data, err := json.Marshal(hdus)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the headers of the file"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	return nil
+}
+
+// parseFitsSubset builds a FitsSubset from the parameters of a URL
+func parseFitsSubset(values url.Values) (FitsSubset, error) {
+	subset := FitsSubset{
+		Hdu:     values.Get("hdu"),
+		LastRow: -1,
+		Columns: splitValues(values, "column"),
+	}
+
+	var err error
+	if str := values.Get("first_row"); str != "" {
+		if subset.FirstRow, err = strconv.ParseInt(str, 10, 64); err != nil || subset.FirstRow < 0 {
+			return subset, FitsSubsetError{fmt.Sprintf("Invalid first row %q", str)}
+		}
+	}
+	if str := values.Get("last_row"); str != "" {
+		if subset.LastRow, err = strconv.ParseInt(str, 10, 64); err != nil || subset.LastRow < 0 {
+			return subset, FitsSubsetError{fmt.Sprintf("Invalid last row %q", str)}
+		}
+	}
+	if str := values.Get("start"); str != "" {
+		if subset.Start, err = parseHkTime(str); err != nil {
+			return subset, FitsSubsetError{fmt.Sprintf("Invalid start time %q", str)}
+		}
+	}
+	if str := values.Get("end"); str != "" {
+		if subset.End, err = parseHkTime(str); err != nil {
+			return subset, FitsSubsetError{fmt.Sprintf("Invalid end time %q", str)}
+		}
+	}
+
+	return subset, nil
+}
+
+// fitsSubsetETag returns the entity tag of the subset of the file described
+// by "stat" and "info". It changes whenever the file or the version of QuTeDB
+// change, as the latter is written in the subset.
+func fitsSubsetETag(stat os.FileInfo, info FileInfo, subset FitsSubset) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s", QuteDBVersion, fileETag(stat, info), subset.key())
+	return fmt.Sprintf(`"%x"`, hash.Sum(nil))
+}
+
+// etagMatches returns true if "etag" is listed in the value "header" of
+// "If-None-Match"
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveFitsSubset sends a FITS file containing the rows and columns of the
+// table in "fileName" requested in the URL of "r". Both the original table
+// and the subset are kept in memory, but the FITS file is written directly
+// to the connection instead of being buffered first.
+func serveFitsSubset(w http.ResponseWriter, r *http.Request, fileName string, info FileInfo) error {
+	subset, err := parseFitsSubset(r.URL.Query())
+	if err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return fileOpenError(err, fileName)
+	}
+
+	etag := fitsSubsetETag(stat, info, subset)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(fileCacheMaxAge.Seconds())))
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	// The size of the subset is not known in advance, so "Content-Length"
+	// is not set and ranges are not supported. HEAD requests write the
+	// subset anyway, so that invalid parameters are reported.
+	downloadName := strings.TrimSuffix(path.Base(uncompressedName(fileName)), ".fits") + "-subset.fits"
+	w.Header().Set("Content-Type", "application/fits")
+	w.Header().Set("Content-Disposition", contentDisposition(downloadName))
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "none")
+
+	var body io.Writer = w
+	if r.Method == http.MethodHead {
+		body = io.Discard
+	}
+	writer := trackingWriter{w: body}
+	err = WriteFitsSubset(&writer, fileName, subset)
+	if err == nil {
+		return nil
+	}
+
+	if !writer.written || r.Method == http.MethodHead {
+		for _, key := range []string{"ETag", "Cache-Control", "Content-Disposition", "Last-Modified", "Accept-Ranges"} {
+			w.Header().Del(key)
+		}
+
+		switch err.(type) {
+		case FitsSubsetError:
+			return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+		case UnsupportedCompressionError:
+			return Error{err: err, msg: err.Error(), code: http.StatusNotImplemented}
+		}
+		return Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to extract a subset of the FITS file %q: %s", path.Base(fileName), err),
+		}
+	}
+
+	// It is too late to send an error to the client: break the connection,
+	// so that the client does not take the truncated file for a complete one
+	log.WithFields(log.Fields{
+		"file_name": fileName,
+		"error":     err,
+	}).Error("Unable to complete the subset of the FITS file")
+	panic(http.ErrAbortHandler)
+}
+
+// rawFileOf returns the raw file of the ASIC and the acquisition in "vars"
+func (app *App) rawFileOf(vars map[string]string) (*RawDataFile, error) {
+	asicNumber, _ := strconv.Atoi(vars["asic_num"])
+	acq, err := findAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	var rawFiles []RawDataFile
+	if err := app.db.
+		Where("acquisition_id = ? AND asic_number = ?", acq.ID, asicNumber).
+		Find(&rawFiles).Error; err != nil {
+		return nil, Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to query for raw file (ASIC %d) belonging to ID %s",
+				asicNumber, vars["acq_id"],
+			),
+		}
+	}
+
+	if len(rawFiles) == 0 {
+		return nil, Error{
+			err: nil,
+			msg: fmt.Sprintf("No raw file for ASIC %d in acquisition with ID %s",
+				asicNumber, vars["acq_id"]),
+			code: http.StatusNotFound,
+		}
+	}
+
+	if rawFiles[0].Missing {
+		return nil, missingFileError(rawFiles[0].FileName)
+	}
+
+	return &rawFiles[0], nil
+}
+
+// sumFileOf returns the science file of the ASIC and the acquisition in
+// "vars"
+func (app *App) sumFileOf(vars map[string]string) (*SumDataFile, error) {
+	asicNumber, _ := strconv.Atoi(vars["asic_num"])
+	acq, err := findAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	var sumFiles []SumDataFile
+	if err := app.db.
+		Where("acquisition_id = ? AND asic_number = ?", acq.ID, asicNumber).
+		Find(&sumFiles).Error; err != nil {
+		return nil, Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to query for science file (ASIC %d) belonging to ID %s",
+				asicNumber, vars["acq_id"],
+			),
+		}
+	}
+
+	if len(sumFiles) == 0 {
+		return nil, Error{
+			err: nil,
+			msg: fmt.Sprintf("No science file for ASIC %d in acquisition with ID %s",
+				asicNumber, vars["acq_id"]),
+			code: http.StatusNotFound,
+		}
+	}
+
+	if sumFiles[0].Missing {
+		return nil, missingFileError(sumFiles[0].FileName)
+	}
+
+	return &sumFiles[0], nil
+}
+
+func (app *App) rawSubsetHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	rawFile, err := app.rawFileOf(mux.Vars(r))
+	if err != nil {
+		return err
+	}
+
+	return serveFitsSubset(w, r, rawFile.FileName, rawFile.FileInfo)
+}
+
+func (app *App) sumSubsetHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	sumFile, err := app.sumFileOf(mux.Vars(r))
+	if err != nil {
+		return err
+	}
+
+	return serveFitsSubset(w, r, sumFile.FileName, sumFile.FileInfo)
+}
+
+func (app *App) rawHeaderHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	rawFile, err := app.rawFileOf(mux.Vars(r))
+	if err != nil {
+		return err
+	}
+
+	return app.sendFitsHeaders(w, "raw_data_files", rawFile.ID)
+}
+
+func (app *App) sumHeaderHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	sumFile, err := app.sumFileOf(mux.Vars(r))
+	if err != nil {
+		return err
+	}
+
+	return app.sendFitsHeaders(w, "sum_data_files", sumFile.ID)
+}
+
+func (app *App) dataFileHeaderHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	file, err := app.dataFileOf(mux.Vars(r))
+	if err != nil {
+		return err
+	}
+
+	if file.Missing {
+		return missingFileError(file.FileName)
+	}
+
+	return app.sendFitsHeaders(w, "data_files", file.ID)
+}
+
+func (app *App) hkChannelListHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	vars := mux.Vars(r)
+	acq, err := findAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
+
+	var channels []HkChannel
+	if err := app.db.
+		Where("acquisition_id = ?", acq.ID).
+		Order("id").
+		Find(&channels).Error; err != nil {
+		return Error{
+			err: err,
+			msg: fmt.Sprintf("Unable to query for HK channels belonging to ID %s",
+				vars["acq_id"]),
+		}
+	}
+
+	data, err := json.Marshal(channels)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the list of HK channels"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	return nil
+}
+
+// parseHkTime parses a time passed in a URL, which can be either a number of
+// milliseconds since 1970-01-01 or a UTC date like "2019-05-07T18:11:29"
+func parseHkTime(str string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+
+	if t, err := time.Parse("2006-01-02T15:04:05", str); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, str)
+}
+
+// parseHkQuery builds a HkQuery from the parameters of a URL
+func parseHkQuery(values url.Values) (HkQuery, error) {
+	query := HkQuery{
+		Hdu:      values.Get("hdu"),
+		Channels: values["channel"],
+	}
+
+	var err error
+	if str := values.Get("start"); str != "" {
+		if query.Start, err = parseHkTime(str); err != nil {
+			return query, HkQueryError{fmt.Sprintf("Invalid start time %q", str)}
+		}
+	}
+	if str := values.Get("end"); str != "" {
+		if query.End, err = parseHkTime(str); err != nil {
+			return query, HkQueryError{fmt.Sprintf("Invalid end time %q", str)}
+		}
+	}
+	if str := values.Get("points"); str != "" {
+		if query.NumOfPoints, err = strconv.Atoi(str); err != nil || query.NumOfPoints < 0 {
+			return query, HkQueryError{fmt.Sprintf("Invalid number of points %q", str)}
+		}
+	}
+
+	return query, nil
+}
+
+// readHkTimeSeries reads the time series requested in the URL of "r". If
+// the URL does not specify the number of points, "defaultPoints" is used.
+func (app *App) readHkTimeSeries(r *http.Request, defaultPoints int) (*HkTimeSeries, error) {
+	hkFile, err := app.dataFileOf(mux.Vars(r))
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := parseHkQuery(r.URL.Query())
+	if err != nil {
+		return nil, Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+	if query.NumOfPoints == 0 {
+		query.NumOfPoints = defaultPoints
+	}
+
+	series, err := ReadHkTimeSeries(hkFile.FileName, query)
+	if err != nil {
+		if _, ok := err.(HkQueryError); ok {
+			return nil, Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+		}
+		return nil, fileOpenError(err, hkFile.FileName)
+	}
+
+	return series, nil
+}
+
+func (app *App) hkTimeSeriesHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	series, err := app.readHkTimeSeries(r, 0)
+	if err != nil {
+		return err
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		data, err := json.Marshal(series)
+		if err != nil {
+			return Error{err: err, msg: "Unable to encode the time series"}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+
+	case "csv":
+		data, err := series.WriteCSV()
+		if err != nil {
+			return Error{err: err, msg: "Unable to encode the time series"}
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(data)
+
+	default:
+		return Error{
+			err:  nil,
+			msg:  fmt.Sprintf("Unknown format %q", format),
+			code: http.StatusBadRequest,
+		}
+	}
+
+	return nil
+}
+
+// parsePlotSize reads the size of a plot from the parameter "name" in the URL
+func parsePlotSize(values url.Values, name string, defaultSize int) (int, error) {
+	str := values.Get(name)
+	if str == "" {
+		return defaultSize, nil
+	}
+
+	size, err := strconv.Atoi(str)
+	if err != nil || size < 100 || size > 4000 {
+		return 0, Error{
+			err:  err,
+			msg:  fmt.Sprintf("Invalid %s %q, it must be a number between 100 and 4000", name, str),
+			code: http.StatusBadRequest,
+		}
+	}
+
+	return size, nil
+}
+
+func (app *App) hkPlotHandler(w http.ResponseWriter, r *http.Request) error {
+	if app == nil {
+		panic("app cannot be nil")
+	}
+
+	values := r.URL.Query()
+	width, err := parsePlotSize(values, "width", 800)
+	if err != nil {
+		return err
+	}
+	height, err := parsePlotSize(values, "height", 400)
+	if err != nil {
+		return err
+	}
+
+	format := values.Get("format")
+	var contentType string
+	switch format {
+	case "", "png":
+		contentType = "image/png"
+	case "svg":
+		contentType = "image/svg+xml"
+	default:
+		return Error{
+			err:  nil,
+			msg:  fmt.Sprintf("Unknown format %q", format),
+			code: http.StatusBadRequest,
+		}
+	}
+
+	// There is no point in plotting more than one sample per pixel
+	series, err := app.readHkTimeSeries(r, width)
+	if err != nil {
+		return err
+	}
+	if len(values["channel"]) == 0 {
+		series.Channels = defaultPlotChannels(series.Channels)
+	}
+
+	vars := mux.Vars(r)
+	var buf bytes.Buffer
+	if err := PlotHkTimeSeries(&buf, series,
+		fmt.Sprintf("%s (%s)", vars["acq_id"], series.Hdu),
+		width, height, format); err != nil {
+		if _, ok := err.(HkQueryError); ok {
+			return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+		}
+		return Error{err: err, msg: "Unable to produce the plot"}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+	return nil
+}
+
+func (app *App) tagListHandler(w http.ResponseWriter, r *http.Request) error {
+	tags, err := QueryTags(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of tags"}
+	}
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the list of tags"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+// sendAcquisitionTags sends the tags of "acq" after they have been modified.
+// If the request comes from the acquisition page, the user is brought back
+// there instead.
+func (app *App) sendAcquisitionTags(w http.ResponseWriter, r *http.Request, acq *Acquisition) error {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, acq.SelfURL(), 302)
+		return nil
+	}
+
+	tags := []Tag{}
+	if err := app.db.Model(acq).Order("tags.name").Related(&tags, "Tags").Error; err != nil {
+		return Error{err: err, msg: "Unable to retrieve the tags of the acquisition"}
+	}
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the list of tags"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+func (app *App) addTagHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	acq, err := QueryAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return Error{err: err, msg: "Unable to parse the request", code: http.StatusBadRequest}
+	}
+
+	// Several tags can be added at once, separated by commas
+	var names []string
+	for _, name := range strings.Split(r.PostFormValue("tag"), ",") {
+		if strings.TrimSpace(name) != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return Error{msg: "No tag has been specified", code: http.StatusBadRequest}
+	}
+
+	for _, name := range names {
+		if err := AddTag(app.db, acq, name); err != nil {
+			return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"acquisition": acq.AcquisitionTime,
+		"tag":         r.PostFormValue("tag"),
+	}).Info("Tags have been added to the acquisition")
+
+	return app.sendAcquisitionTags(w, r, acq)
+}
+
+func (app *App) removeTagHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	acq, err := QueryAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
+
+	if err := RemoveTag(app.db, acq, vars["tag"]); err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	log.WithFields(log.Fields{
+		"acquisition": acq.AcquisitionTime,
+		"tag":         vars["tag"],
+	}).Info("Tag has been removed from the acquisition")
+
+	return app.sendAcquisitionTags(w, r, acq)
+}
+
+// sendComment sends "comment" in JSON format. If the request comes from the
+// acquisition page, the user is brought back there instead.
+func sendComment(w http.ResponseWriter, r *http.Request, acq *Acquisition, comment *Comment, code int) error {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, acq.SelfURL(), 302)
+		return nil
+	}
+
+	data, err := json.Marshal(comment)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the comment"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+
+	return nil
+}
+
+func (app *App) commentListHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	acq, err := QueryAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
+
+	comments, err := QueryComments(app.db, acq)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the comments"}
+	}
+
+	data, err := json.Marshal(comments)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the list of comments"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+func (app *App) addCommentHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	acq, err := QueryAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return Error{err: err, msg: "Unable to parse the request", code: http.StatusBadRequest}
+	}
+
+	user := app.retrieveUserFromSession(w, r)
+	comment, err := AddComment(app.db, acq, user, r.PostFormValue("body"))
+	if err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	log.WithFields(log.Fields{
+		"acquisition": acq.AcquisitionTime,
+		"comment_id":  comment.ID,
+		"user_email":  user.Email,
+	}).Info("A comment has been added to the acquisition")
+
+	return sendComment(w, r, acq, comment, http.StatusCreated)
+}
+
+// modifiableComment returns the comment specified in the URL, checking that
+// the user who sent the request is allowed to modify it
+func (app *App) modifiableComment(w http.ResponseWriter, r *http.Request) (*Acquisition, *Comment, error) {
+	vars := mux.Vars(r)
+	acq, err := QueryAcquisition(app.db, vars["acq_id"])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commentID, _ := strconv.Atoi(vars["comment_id"])
+	comment, err := QueryComment(app.db, acq, commentID)
+	if err != nil {
+		return nil, nil, Error{err: err, msg: "Unable to retrieve the comment"}
+	}
+	if comment == nil {
+		return nil, nil, Error{
+			msg:  fmt.Sprintf("No comment with ID %s in acquisition %s", vars["comment_id"], vars["acq_id"]),
+			code: http.StatusNotFound,
+		}
+	}
+
+	user := app.retrieveUserFromSession(w, r)
+	if !comment.CanBeModifiedBy(user) {
+		return nil, nil, Error{
+			msg:  "Only the author of a comment and administrators can modify it",
+			code: http.StatusForbidden,
+		}
+	}
+
+	return acq, comment, nil
+}
+
+func (app *App) updateCommentHandler(w http.ResponseWriter, r *http.Request) error {
+	acq, comment, err := app.modifiableComment(w, r)
+	if err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return Error{err: err, msg: "Unable to parse the request", code: http.StatusBadRequest}
+	}
+
+	if err := UpdateComment(app.db, comment, r.PostFormValue("body")); err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	log.WithFields(log.Fields{
+		"acquisition": acq.AcquisitionTime,
+		"comment_id":  comment.ID,
+	}).Info("A comment has been modified")
+
+	return sendComment(w, r, acq, comment, http.StatusOK)
+}
+
+func (app *App) deleteCommentHandler(w http.ResponseWriter, r *http.Request) error {
+	acq, comment, err := app.modifiableComment(w, r)
+	if err != nil {
+		return err
+	}
+
+	if err := DeleteComment(app.db, comment); err != nil {
+		return Error{err: err, msg: "Unable to delete the comment"}
+	}
+
+	log.WithFields(log.Fields{
+		"acquisition": acq.AcquisitionTime,
+		"comment_id":  comment.ID,
+	}).Info("A comment has been deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// CampaignData contains the data passed to the "campaign.html" and
+// "campaigns.html" templates
+type CampaignData struct {
+	User         *User
+	Campaign     *Campaign
+	Campaigns    []Campaign
+	Acquisitions []Acquisition
+}
+
+// queryCampaign returns the campaign specified in the URL
+func (app *App) queryCampaign(r *http.Request) (*Campaign, error) {
+	name := mux.Vars(r)["campaign"]
+	campaign, err := QueryCampaign(app.db, name)
+	if err != nil {
+		return nil, Error{err: err, msg: "Unable to query the database for campaigns"}
+	}
+	if campaign == nil {
+		return nil, Error{
+			msg:  fmt.Sprintf("No campaign named %q", name),
+			code: http.StatusNotFound,
+		}
+	}
+
+	return campaign, nil
+}
+
+// sendJSON encodes "value" and sends it over the HTTP connection
+func sendJSON(w http.ResponseWriter, value interface{}, code int) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the result in JSON format"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+
+	return nil
+}
+
+// campaignFromForm copies into "campaign" the fields that are present in the
+// form sent with the request
+func campaignFromForm(r *http.Request, campaign *Campaign) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	form := r.PostForm
+	if _, ok := form["description"]; ok {
+		campaign.Description = form.Get("description")
+	}
+	if _, ok := form["name_mask"]; ok {
+		campaign.NameMask = strings.TrimSpace(form.Get("name_mask"))
+	}
+
+	var err error
+	if _, ok := form["start_time"]; ok {
+		if campaign.StartTime, err = parseTimeBound(form.Get("start_time"), false); err != nil {
+			return err
+		}
+	}
+	if _, ok := form["end_time"]; ok {
+		if campaign.EndTime, err = parseTimeBound(form.Get("end_time"), true); err != nil {
+			return err
+		}
+	}
+	if _, ok := form["auto_assign"]; ok {
+		// HTML checkboxes send "on"
+		str := form.Get("auto_assign")
+		if str == "on" {
+			campaign.AutoAssign = true
+		} else if campaign.AutoAssign, err = strconv.ParseBool(str); err != nil {
+			return fmt.Errorf("invalid value %q for \"auto_assign\"", str)
+		}
+	}
+
+	return nil
+}
+
+func (app *App) campaignListHandler(w http.ResponseWriter, r *http.Request) error {
+	campaigns, err := QueryCampaigns(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of campaigns"}
+	}
+
+	return sendJSON(w, campaigns, http.StatusOK)
+}
+
+func (app *App) createCampaignHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return Error{err: err, msg: "Unable to parse the request", code: http.StatusBadRequest}
+	}
+
+	campaign := Campaign{Name: strings.TrimSpace(r.PostFormValue("name"))}
+	if err := campaignFromForm(r, &campaign); err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+	if err := CreateCampaign(app.db, &campaign); err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	log.WithFields(log.Fields{
+		"campaign": campaign.Name,
+	}).Info("A new campaign has been created")
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/campaigns/"+campaign.Name, 302)
+		return nil
+	}
+
+	return sendJSON(w, campaign, http.StatusCreated)
+}
+
+func (app *App) campaignHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, campaign, http.StatusOK)
+}
+
+func (app *App) updateCampaignHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	if err := campaignFromForm(r, campaign); err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+	if err := UpdateCampaign(app.db, campaign); err != nil {
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	return sendJSON(w, campaign, http.StatusOK)
+}
+
+func (app *App) deleteCampaignHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	if err := DeleteCampaign(app.db, campaign); err != nil {
+		return Error{err: err, msg: "Unable to delete the campaign"}
+	}
+
+	log.WithFields(log.Fields{
+		"campaign": campaign.Name,
+	}).Info("Campaign has been deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (app *App) campaignAcquisitionListHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	acqs, err := QueryCampaignAcquisitions(app.db, campaign, false)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the acquisitions of the campaign"}
+	}
+
+	return sendJSON(w, acqs, http.StatusOK)
+}
+
+// assignAcquisitionsHandler assigns acquisitions to a campaign, either by
+// listing them in the form field "acquisition" or by applying the rules of
+// the campaign ("apply_rules=true")
+func (app *App) assignAcquisitionsHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return Error{err: err, msg: "Unable to parse the request", code: http.StatusBadRequest}
+	}
+
+	var acqIDs []string
+	for _, str := range strings.Split(r.PostFormValue("acquisition"), ",") {
+		if str = strings.TrimSpace(str); str != "" {
+			acqIDs = append(acqIDs, str)
+		}
+	}
+	if err := AssignToCampaign(app.db, campaign, acqIDs); err != nil {
+		if e, ok := err.(Error); ok && e.code == http.StatusConflict {
+			return err
+		}
+		return Error{err: err, msg: err.Error(), code: http.StatusBadRequest}
+	}
+
+	numOfAssigned := len(acqIDs)
+	if str := r.PostFormValue("apply_rules"); str != "" {
+		applyRules, err := strconv.ParseBool(str)
+		if err != nil {
+			return Error{
+				err:  err,
+				msg:  fmt.Sprintf("Invalid value %q for \"apply_rules\"", str),
+				code: http.StatusBadRequest,
+			}
+		}
+
+		if applyRules {
+			num, err := ApplyCampaignRules(app.db, campaign)
+			if err != nil {
+				return Error{err: err, msg: "Unable to apply the rules of the campaign"}
+			}
+			numOfAssigned += num
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"campaign":            campaign.Name,
+		"num_of_acquisitions": numOfAssigned,
+	}).Info("Acquisitions have been assigned to the campaign")
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/campaigns/"+campaign.Name, 302)
+		return nil
+	}
+
+	if campaign, err = app.queryCampaign(r); err != nil {
+		return err
+	}
+	return sendJSON(w, campaign, http.StatusOK)
+}
+
+func (app *App) removeAcquisitionHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	acq, err := QueryAcquisition(app.db, mux.Vars(r)["acq_id"])
+	if err != nil {
+		return err
+	}
+
+	if err := RemoveFromCampaign(app.db, campaign, acq); err != nil {
+		return Error{err: err, msg: "Unable to remove the acquisition from the campaign"}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// campaignFolder returns a function that gives the folder containing the
+// files of each acquisition in the archives of the campaign
+func campaignFolder(campaign *Campaign) func(*Acquisition) string {
+	return func(acq *Acquisition) string {
+		return path.Join(campaign.Name, acq.Directoryname)
+	}
+}
+
+// campaignManifest returns the manifest of the files of the campaign included
+// in "selection", using the same paths as the archive returned by
+// campaignBundleHandler, together with the acquisitions of the campaign
+func (app *App) campaignManifest(campaign *Campaign, selection archiveSelection) (*CampaignManifest, []Acquisition, error) {
+	acqs, err := QueryCampaignAcquisitions(app.db, campaign, true)
+	if err != nil {
+		return nil, nil, Error{err: err, msg: "Unable to retrieve the acquisitions of the campaign"}
+	}
+
+	fileKinds, err := QueryFileKinds(app.db)
+	if err != nil {
+		return nil, nil, Error{err: err, msg: "Unable to retrieve the list of file kinds"}
+	}
+
+	manifest := CampaignManifest{
+		Campaign:       *campaign,
+		BundleManifest: bundleManifest(acqs, campaignFolder(campaign), fileKinds, selection),
+	}
+
+	return &manifest, acqs, nil
+}
+
+func (app *App) campaignManifestHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	manifest, _, err := app.campaignManifest(campaign, archiveSelection{})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, manifest, http.StatusOK)
+}
+
+// maxBundleSize returns the maximum size in bytes of the files put in an
+// archive containing several acquisitions, or zero if there is no limit
+func (app *App) maxBundleSize() int64 {
+	if app.config == nil {
+		return DefaultMaxBundleSize
+	}
+	if app.config.MaxBundleSize < 0 {
+		return 0
+	}
+	return app.config.MaxBundleSize
+}
+
+// multipleBundleHandler sends an archive containing the files of the
+// acquisitions listed in the parameter "acquisition", each in a folder named
+// after the acquisition. See findAcquisition for the values that identify
+// acquisitions.
+func (app *App) multipleBundleHandler(w http.ResponseWriter, r *http.Request) error {
+	acqIDs := splitValues(r.URL.Query(), "acquisition")
+	if len(acqIDs) == 0 {
+		return Error{
+			msg:  "No acquisition specified, use the parameter \"acquisition\"",
+			code: http.StatusBadRequest,
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"num_of_acquisitions": len(acqIDs),
+	}).Info("multipleBundleHandler")
+
+	var ids []uint
+	for _, acqID := range acqIDs {
+		acq, err := findAcquisition(app.db, acqID)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, acq.ID)
+	}
+
+	// Acquisitions listed more than once are put in the archive only once
+	acqs := []Acquisition{}
+	if err := preloadFiles(app.db).
+		Where("id IN (?)", ids).
+		Order("acquisition_time").
+		Find(&acqs).Error; err != nil {
+		return Error{err: err, msg: "Unable to load the acquisitions from the database"}
+	}
+
+	fileKinds, err := QueryFileKinds(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of file kinds"}
+	}
+
+	return serveArchive(w, r, "acquisitions", fileKinds, func(builder *archiveBuilder) error {
+		// Nothing has been sent yet, so the client still gets a proper error
+		if limit := app.maxBundleSize(); limit > 0 {
+			if size := builder.selectedSize(acqs); size > limit {
+				return Error{
+					msg: fmt.Sprintf("The selected files take %d bytes, more than the limit of %d bytes: "+
+						"select fewer acquisitions or files", size, limit),
+					code: http.StatusRequestEntityTooLarge,
+				}
+			}
+		}
+
+		rootOf := func(acq *Acquisition) string { return acq.Directoryname }
+		if err := builder.addManifest("manifest.json", builder.bundleManifest(acqs, rootOf)); err != nil {
+			return err
+		}
+		return builder.addAcquisitions(acqs, rootOf)
+	})
+}
+
+// campaignBundleHandler sends an archive containing the files of all the
+// acquisitions in the campaign, each in a folder named after the acquisition,
+// together with the manifest of the campaign
+func (app *App) campaignBundleHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	fileKinds, err := QueryFileKinds(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of file kinds"}
+	}
+
+	return serveArchive(w, r, campaign.Name, fileKinds, func(builder *archiveBuilder) error {
+		manifest, acqs, err := app.campaignManifest(campaign, builder.selection)
+		if err != nil {
+			return err
+		}
+
+		if err := builder.addManifest(path.Join(campaign.Name, "manifest.json"), manifest); err != nil {
+			return err
+		}
+		return builder.addAcquisitions(acqs, campaignFolder(campaign))
+	})
+}
+
+func (app *App) campaignListPageHandler(w http.ResponseWriter, r *http.Request) error {
+	campaigns, err := QueryCampaigns(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of campaigns"}
+	}
+
+	return generateHTML(w, CampaignData{
+		User:      app.retrieveUserFromSession(w, r),
+		Campaigns: campaigns,
+	}, "layout", "private.navbar", "campaigns")
+}
+
+func (app *App) campaignPageHandler(w http.ResponseWriter, r *http.Request) error {
+	campaign, err := app.queryCampaign(r)
+	if err != nil {
+		return err
+	}
+
+	acqs, err := QueryCampaignAcquisitions(app.db, campaign, false)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the acquisitions of the campaign"}
+	}
+
+	return generateHTML(w, CampaignData{
+		User:         app.retrieveUserFromSession(w, r),
+		Campaign:     campaign,
+		Acquisitions: acqs,
+	}, "layout", "private.navbar", "campaign")
+}
+
+func (app *App) purgeHandler(w http.ResponseWriter, r *http.Request) error {
+	result, err := PurgeMissing(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to purge missing acquisitions"}
+	}
+
+	// If the request comes from the web page, bring the user back there
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/", 302)
+		return nil
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the result of the purge"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+func (app *App) verifyHandler(w http.ResponseWriter, r *http.Request) error {
+	report, err := VerifyChecksums(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to verify the checksums of the files"}
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the result of the verification"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+func (app *App) ingestionReportListHandler(w http.ResponseWriter, r *http.Request) error {
+	reports, err := QueryIngestionReports(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of ingestion reports"}
+	}
+
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the list of ingestion reports"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+// queryIngestionReport returns the ingestion report whose ID is in the
+// variable "report_id" of the URL, or the most recent report if the variable
+// is missing or equal to "latest"
+func (app *App) queryIngestionReport(r *http.Request) (*IngestionReport, error) {
+	var id uint
+	if str := mux.Vars(r)["report_id"]; str != "" && str != "latest" {
+		value, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return nil, Error{
+				err:  err,
+				msg:  fmt.Sprintf("Invalid report ID %q", str),
+				code: http.StatusBadRequest,
+			}
+		}
+		id = uint(value)
+	}
+
+	report, err := QueryIngestionReport(app.db, id)
+	if err != nil {
+		return nil, Error{err: err, msg: "Unable to retrieve the ingestion report"}
+	}
+	if report == nil {
+		return nil, Error{
+			err:  nil,
+			msg:  "No ingestion report found",
+			code: http.StatusNotFound,
+		}
+	}
+
+	return report, nil
+}
+
+func (app *App) ingestionReportHandler(w http.ResponseWriter, r *http.Request) error {
+	report, err := app.queryIngestionReport(r)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the ingestion report"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+func (app *App) scanStatusHandler(w http.ResponseWriter, r *http.Request) error {
+	data, err := json.Marshal(app.scanProgress.Status())
+	if err != nil {
+		return Error{err: err, msg: "Unable to encode the state of the scan"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+
+	return nil
+}
+
+// IngestionData contains the data passed to the "ingestion.html" template
+type IngestionData struct {
+	Report  *IngestionReport
+	Reports []IngestionReport
+}
+
+func (app *App) ingestionPageHandler(w http.ResponseWriter, r *http.Request) error {
+	reports, err := QueryIngestionReports(app.db)
+	if err != nil {
+		return Error{err: err, msg: "Unable to retrieve the list of ingestion reports"}
+	}
+
+	data := IngestionData{Reports: reports}
+	if len(reports) > 0 {
+		if data.Report, err = app.queryIngestionReport(r); err != nil {
+			return err
+		}
+	}
+
+	return generateHTML(w, data, "layout", "private.navbar", "ingestion")
 }
 
 func (app *App) serve() {
@@ -749,33 +2236,110 @@ func (app *App) initRouter(router *mux.Router) {
 		app.forceAuth(app.handleErrWrap(app.createUserHandler), authAdmin))
 	router.HandleFunc("/createuser/new",
 		app.forceAuth(app.handleErrWrap(app.createUser), authAdmin))
-
+	router.HandleFunc("/ingestion",
+		app.forceAuth(app.handleErrWrap(app.ingestionPageHandler), authAdmin))
+	router.HandleFunc("/ingestion/{report_id:[0-9]+}",
+		app.forceAuth(app.handleErrWrap(app.ingestionPageHandler), authAdmin))
+
+	router.HandleFunc("/api/v1/purge",
+		app.forceAuth(app.handleErrWrap(app.purgeHandler), authAdmin)).Methods("POST")
+	router.HandleFunc("/api/v1/verify",
+		app.forceAuth(app.handleErrWrap(app.verifyHandler), authAdmin)).Methods("POST")
+	router.HandleFunc("/api/v1/ingestion",
+		app.forceAuth(app.handleErrWrap(app.ingestionReportListHandler), authAdmin)).Methods("GET")
+	router.HandleFunc("/api/v1/ingestion/{report_id:[0-9]+|latest}",
+		app.forceAuth(app.handleErrWrap(app.ingestionReportHandler), authAdmin)).Methods("GET")
+	router.HandleFunc("/api/v1/scan",
+		app.forceAuth(app.handleErrWrap(app.scanStatusHandler), authAdmin)).Methods("GET")
+
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/tags",
+		app.forceAuth(app.handleErrWrap(app.addTagHandler), authNormal)).Methods("POST")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/tags/{tag}",
+		app.forceAuth(app.handleErrWrap(app.removeTagHandler), authNormal)).Methods("DELETE")
+
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/comments",
+		app.forceAuth(app.handleErrWrap(app.addCommentHandler), authNormal)).Methods("POST")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/comments/{comment_id:[0-9]+}",
+		app.forceAuth(app.handleErrWrap(app.updateCommentHandler), authNormal)).Methods("PUT")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/comments/{comment_id:[0-9]+}",
+		app.forceAuth(app.handleErrWrap(app.deleteCommentHandler), authNormal)).Methods("DELETE")
+
+	router.HandleFunc("/campaigns",
+		app.forceAuth(app.handleErrWrap(app.campaignListPageHandler), authNormal))
+	router.HandleFunc("/campaigns/{campaign:[-_.A-Za-z0-9]+}",
+		app.forceAuth(app.handleErrWrap(app.campaignPageHandler), authNormal))
+	router.HandleFunc("/api/v1/campaigns",
+		app.forceAuth(app.handleErrWrap(app.createCampaignHandler), authAdmin)).Methods("POST")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}",
+		app.forceAuth(app.handleErrWrap(app.updateCampaignHandler), authAdmin)).Methods("PUT")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}",
+		app.forceAuth(app.handleErrWrap(app.deleteCampaignHandler), authAdmin)).Methods("DELETE")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}/acquisitions",
+		app.forceAuth(app.handleErrWrap(app.assignAcquisitionsHandler), authAdmin)).Methods("POST")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}/acquisitions/{acq_id:[^/]+}",
+		app.forceAuth(app.handleErrWrap(app.removeAcquisitionHandler), authAdmin)).Methods("DELETE")
+
+	router.HandleFunc("/api/v1/campaigns",
+		app.handleErrWrap(app.campaignListHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}",
+		app.handleErrWrap(app.campaignHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}/acquisitions",
+		app.handleErrWrap(app.campaignAcquisitionListHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}/archive",
+		app.handleErrWrap(app.campaignBundleHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/campaigns/{campaign:[-_.A-Za-z0-9]+}/manifest",
+		app.handleErrWrap(app.campaignManifestHandler)).Methods("GET")
+
+	router.HandleFunc("/api/v1/filekinds",
+		app.handleErrWrap(app.fileKindListHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/tags",
+		app.handleErrWrap(app.tagListHandler)).Methods("GET")
 	router.HandleFunc("/api/v1/acquisitions",
 		app.handleErrWrap(app.acquisitionListHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}",
+	router.HandleFunc("/api/v1/archive",
+		app.handleErrWrap(app.multipleBundleHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}",
 		app.handleErrWrap(app.acquisitionHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/archive",
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/archive",
 		app.handleErrWrap(app.acquisitionBundleHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/rawdata",
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/rawdata",
 		app.handleErrWrap(app.rawListHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/rawdata/{asic_num:[0-9]+}",
-		app.handleErrWrap(app.rawFileHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/sumdata",
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/rawdata/{asic_num:[0-9]+}",
+		app.handleErrWrap(app.rawFileHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/rawdata/{asic_num:[0-9]+}/header",
+		app.handleErrWrap(app.rawHeaderHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/rawdata/{asic_num:[0-9]+}/subset",
+		app.handleErrWrap(app.rawSubsetHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/sumdata",
 		app.handleErrWrap(app.sumListHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/sumdata/{asic_num:[0-9]+}",
-		app.handleErrWrap(app.sumFileHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/asichk",
-		app.handleErrWrap(app.asicHkHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/internhk",
-		app.handleErrWrap(app.internHkHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/externhk",
-		app.handleErrWrap(app.externHkHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/mmrhk",
-		app.handleErrWrap(app.mmrHkHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/mgchk",
-		app.handleErrWrap(app.mgcHkHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/calconf",
-		app.handleErrWrap(app.calConfHkHandler)).Methods("GET")
-	router.HandleFunc("/api/v1/acquisitions/{acq_id:[-:T0-9]+}/caldata",
-		app.handleErrWrap(app.calDataHkHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/sumdata/{asic_num:[0-9]+}",
+		app.handleErrWrap(app.sumFileHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/sumdata/{asic_num:[0-9]+}/header",
+		app.handleErrWrap(app.sumHeaderHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/sumdata/{asic_num:[0-9]+}/subset",
+		app.handleErrWrap(app.sumSubsetHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/hkchannels",
+		app.handleErrWrap(app.hkChannelListHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/files",
+		app.handleErrWrap(app.dataFileListHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/acquisitions/{acq_id:[^/]+}/comments",
+		app.handleErrWrap(app.commentListHandler)).Methods("GET")
+
+	// Files are selected by kind and, if there are many files of the same
+	// kind, by index. The names of the default file kinds can also be used
+	// directly after the ID of the acquisition, as in older versions
+	for _, prefix := range []string{
+		"/api/v1/acquisitions/{acq_id:[^/]+}/files/{kind:[-_A-Za-z0-9]+}",
+		"/api/v1/acquisitions/{acq_id:[^/]+}/files/{kind:[-_A-Za-z0-9]+}/{index:[0-9]+}",
+		"/api/v1/acquisitions/{acq_id:[^/]+}/{kind:asichk|internhk|externhk|mmrhk|mgchk|calconf|caldata}",
+	} {
+		router.HandleFunc(prefix,
+			app.handleErrWrap(app.dataFileHandler)).Methods("GET", "HEAD")
+		router.HandleFunc(prefix+"/header",
+			app.handleErrWrap(app.dataFileHeaderHandler)).Methods("GET")
+		router.HandleFunc(prefix+"/timeseries",
+			app.handleErrWrap(app.hkTimeSeriesHandler)).Methods("GET")
+		router.HandleFunc(prefix+"/plot",
+			app.handleErrWrap(app.hkPlotHandler)).Methods("GET")
+	}
 }
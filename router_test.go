@@ -1,17 +1,55 @@
 package qutedb
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/astrogo/fitsio"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 )
 
+// newTestApp returns an application whose database contains the acquisitions
+// in "repository" (none if it is empty), together with its router
+func newTestApp(t *testing.T, repository string) (*App, *mux.Router) {
+	t.Helper()
+
+	testApp := &App{
+		db: createTemporaryDb(t),
+		cookieEncoder: securecookie.New(
+			securecookie.GenerateRandomKey(32),
+			securecookie.GenerateRandomKey(32),
+		),
+	}
+	if repository != "" {
+		if err := RefreshDbContents(testApp.db, repository); err != nil {
+			t.Fatalf("Error running RefreshDbContents: %s", err)
+		}
+	}
+
+	router := mux.NewRouter()
+	testApp.initRouter(router)
+	return testApp, router
+}
+
 func TestHandleAcquisitionList(t *testing.T) {
 	router := mux.NewRouter()
 	app.initRouter(router)
@@ -230,7 +268,7 @@ func TestZipArchive(t *testing.T) {
 	writer := httptest.NewRecorder()
 	router.ServeHTTP(writer, request)
 
-	if writer.Result().StatusCode != 500 {
+	if writer.Result().StatusCode != 404 {
 		t.Errorf("Response code for non-existing URL is %v instead of 404", writer.Code)
 	}
 
@@ -246,3 +284,1854 @@ func TestZipArchive(t *testing.T) {
 		t.Errorf("Response code is %v instead of 200 when downloading ZIP archive", writer.Code)
 	}
 }
+
+func TestMissingRawFile(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	const rawFile = "Raws/raw-asic1-2022.04.05.155404.fits"
+	copyTestAcquisition(t, filepath.Join(repository, dirname), rawFile)
+	testApp, router := newTestApp(t, repository)
+
+	if err := os.Remove(filepath.Join(repository, dirname, rawFile)); err != nil {
+		t.Fatalf("Unable to remove file: %s", err)
+	}
+
+	for _, url := range []string{
+		"/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/1",
+		"/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/2",
+		"/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/2/header",
+		"/api/v1/acquisitions/2022-04-05T15:54:04/caldata",
+	} {
+		request, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		expected := http.StatusNotFound
+		if strings.HasSuffix(url, "/1") {
+			expected = http.StatusGone
+		}
+		if writer.Code != expected {
+			t.Errorf("Response code for %s is %v instead of %v", url, writer.Code, expected)
+		}
+	}
+
+	// The headers are read from the database, so they are refused only once
+	// a new scan has marked the file as missing
+	if err := RefreshDbContents(testApp.db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	request, _ := http.NewRequest("GET", "/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/1/header", nil)
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	if writer.Code != http.StatusGone {
+		t.Errorf("Response code for the headers of a missing file is %v instead of %v",
+			writer.Code, http.StatusGone)
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	copyTestAcquisition(t, filepath.Join(repository, dirname),
+		"Raws/raw-asic1-2022.04.05.155404.fits",
+		"Hks/calibConf-2022.04.05.155408.fits",
+	)
+	_, router := newTestApp(t, repository)
+
+	for _, url := range []string{
+		"/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/1",
+		"/api/v1/acquisitions/2022-04-05T15:54:04/calconf",
+	} {
+		request, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		if writer.Code != http.StatusOK {
+			t.Fatalf("Response code for %s is %v", url, writer.Code)
+		}
+
+		hash := sha256.Sum256(writer.Body.Bytes())
+		if checksum := writer.Header().Get("X-Checksum-Sha256"); checksum != hex.EncodeToString(hash[:]) {
+			t.Errorf("Wrong checksum for %s: %q", url, checksum)
+		}
+		if length := writer.Header().Get("Content-Length"); length != strconv.Itoa(writer.Body.Len()) {
+			t.Errorf("Wrong length for %s: %q", url, length)
+		}
+		if writer.Header().Get("Last-Modified") == "" {
+			t.Errorf("No Last-Modified header for %s", url)
+		}
+	}
+}
+
+func TestDownloadRanges(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	const rawFile = "Raws/raw-asic1-2022.04.05.155404.fits"
+	copyTestAcquisition(t, filepath.Join(repository, dirname), rawFile)
+	gzipTestAcquisition(t, filepath.Join(repository, dirname), "Hks/calibConf-2022.04.05.155408.fits")
+	_, router := newTestApp(t, repository)
+
+	const url = "/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/1"
+	contents, _ := os.ReadFile(filepath.Join(repository, dirname, rawFile))
+	send := func(method string, url string, headers map[string]string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, url, nil)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+
+	writer := send("HEAD", url, nil)
+	etag := writer.Header().Get("ETag")
+	hash := sha256.Sum256(contents)
+	if writer.Code != http.StatusOK || writer.Body.Len() != 0 {
+		t.Fatalf("Wrong response to HEAD (%d, %d bytes)", writer.Code, writer.Body.Len())
+	}
+	for key, expected := range map[string]string{
+		"Content-Length":      strconv.Itoa(len(contents)),
+		"Content-Type":        "application/fits",
+		"Content-Disposition": `attachment; filename="raw-asic1-2022.04.05.155404.fits"`,
+		"Accept-Ranges":       "bytes",
+		"ETag":                `"` + hex.EncodeToString(hash[:]) + `"`,
+	} {
+		if value := writer.Header().Get(key); value != expected {
+			t.Errorf("Wrong value for %s: %q instead of %q", key, value, expected)
+		}
+	}
+	if !strings.Contains(writer.Header().Get("Cache-Control"), "max-age=") {
+		t.Errorf("Wrong Cache-Control: %q", writer.Header().Get("Cache-Control"))
+	}
+
+	// Resume a download
+	writer = send("GET", url, map[string]string{"Range": "bytes=100-", "If-Range": etag})
+	if writer.Code != http.StatusPartialContent || !bytes.Equal(writer.Body.Bytes(), contents[100:]) {
+		t.Errorf("Wrong partial content (%d, %d bytes)", writer.Code, writer.Body.Len())
+	}
+	if contentRange := writer.Header().Get("Content-Range"); contentRange !=
+		fmt.Sprintf("bytes 100-%d/%d", len(contents)-1, len(contents)) {
+		t.Errorf("Wrong Content-Range: %q", contentRange)
+	}
+
+	// If the file has changed, the whole file must be sent again
+	writer = send("GET", url, map[string]string{"Range": "bytes=100-", "If-Range": `"old"`})
+	if writer.Code != http.StatusOK || writer.Body.Len() != len(contents) {
+		t.Errorf("Wrong response for an old If-Range (%d, %d bytes)", writer.Code, writer.Body.Len())
+	}
+
+	for _, c := range []struct {
+		headers map[string]string
+		code    int
+	}{
+		{map[string]string{"Range": "bytes=10-19"}, http.StatusPartialContent},
+		{map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(contents)+10)}, http.StatusRequestedRangeNotSatisfiable},
+		{map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"old"`}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}, http.StatusNotModified},
+	} {
+		if writer := send("GET", url, c.headers); writer.Code != c.code {
+			t.Errorf("Response code for %v is %d instead of %d", c.headers, writer.Code, c.code)
+		}
+	}
+
+	// Files decompressed on the fly do not support ranges
+	writer = send("HEAD", "/api/v1/acquisitions/2022-04-05T15:54:04/calconf?decompress=true", nil)
+	if writer.Code != http.StatusOK || writer.Body.Len() != 0 || writer.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("Wrong response to HEAD for a decompressed file (%d, %d bytes)", writer.Code, writer.Body.Len())
+	}
+
+	if disposition := contentDisposition("città.fits"); disposition !=
+		`attachment; filename="città.fits"; filename*=UTF-8''citt%C3%A0.fits` {
+		t.Errorf("Wrong Content-Disposition for a non-ASCII name: %s", disposition)
+	}
+}
+
+func TestFitsHeaders(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	copyTestAcquisition(t, filepath.Join(repository, dirname),
+		"Raws/raw-asic1-2022.04.05.155404.fits",
+		"Hks/calibConf-2022.04.05.155408.fits",
+	)
+	_, router := newTestApp(t, repository)
+
+	request, _ := http.NewRequest("GET", "/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/1/header", nil)
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Response code is %v", writer.Code)
+	}
+
+	var hdus []FitsHdu
+	json.Unmarshal(writer.Body.Bytes(), &hdus)
+	if len(hdus) != 2 {
+		t.Fatalf("Wrong number of HDUs: %d", len(hdus))
+	}
+	if hdus[1].Type != "BINTABLE" || hdus[1].Name != "ASIC_RAW" || hdus[1].NumOfRows != 1 {
+		t.Errorf("Wrong HDU: %v", hdus[1])
+	}
+	if len(hdus[1].Columns) != 6 || hdus[1].Columns[0].Name != "ComputerDate" {
+		t.Errorf("Wrong columns: %v", hdus[1].Columns)
+	}
+
+	values := map[string]string{}
+	for _, card := range hdus[1].Cards {
+		values[card.Keyword] = card.Value
+	}
+	if values["ASIC_NUM"] != "1" || values["DATE"] != "2022-04-05 15:54:04" {
+		t.Errorf("Wrong cards: %v", hdus[1].Cards)
+	}
+
+	for _, url := range []string{
+		"/api/v1/acquisitions/2022-04-05T15:54:04/calconf/header",
+		"/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/2/header",
+		"/api/v1/acquisitions/2022-04-05T15:54:04/caldata/header",
+	} {
+		request, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		expected := http.StatusNotFound
+		if strings.Contains(url, "calconf") {
+			expected = http.StatusOK
+		}
+		if writer.Code != expected {
+			t.Errorf("Response code for %s is %v instead of %v", url, writer.Code, expected)
+		}
+	}
+}
+
+func TestSearchByHeader(t *testing.T) {
+	repository := t.TempDir()
+
+	copyTestAcquisition(t, filepath.Join(repository, "2018-04-06_14.20.35__testbackups"),
+		"Raws/raw-asic1-2018.04.06.142047.fits")
+	copyTestAcquisition(t, filepath.Join(repository, "2018-05-22_13.33.56__mytest"),
+		"Hks/hk-extern-2018.05.22.133356.fits")
+	copyTestAcquisition(t, filepath.Join(repository, "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"),
+		"Raws/raw-asic1-2022.04.05.155404.fits")
+	_, router := newTestApp(t, repository)
+
+	for _, tc := range []struct {
+		query    url.Values
+		expected []string
+	}{
+		{url.Values{"header": {"NSAMPLE>=50"}}, []string{"Test-CalibrationSource-Timeconstant"}},
+		{url.Values{"header": {"VERSION=1"}}, []string{"mytest", "testbackups"}},
+		{url.Values{"header": {"VERSION=1"}, "file": {"raw"}}, []string{"testbackups"}},
+		{url.Values{"header": {"VERSION=1"}, "file": {"sum,hk"}}, []string{"mytest"}},
+		{url.Values{"header": {"FILETYPE~raw"}}, []string{"Test-CalibrationSource-Timeconstant"}},
+		{url.Values{"header": {"DATE<2018-05-01"}}, []string{"testbackups"}},
+		{url.Values{"header": {"NSAMPLE>10", "VERSION!=3"}}, []string{"testbackups"}},
+		{url.Values{"header": {"UNKNOWN=1"}}, []string{}},
+		// Keywords whose value is not a number never match a numeric comparison
+		{url.Values{"header": {"DATE>0"}}, []string{}},
+		{url.Values{"header": {"FILETYPE<=0"}}, []string{}},
+	} {
+		request, _ := http.NewRequest("GET", "/api/v1/acquisitions?"+tc.query.Encode(), nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		if writer.Code != http.StatusOK {
+			t.Fatalf("Response code for %v is %v", tc.query, writer.Code)
+		}
+
+		var acqs []Acquisition
+		json.Unmarshal(writer.Body.Bytes(), &acqs)
+		names := []string{}
+		for _, acq := range acqs {
+			names = append(names, acq.Name)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("Wrong result for %v: %v instead of %v", tc.query, names, tc.expected)
+		}
+	}
+
+	for _, query := range []url.Values{
+		{"header": {"NSAMPLE"}},
+		{"header": {"NSAMPLE=1"}, "file": {"foo"}},
+	} {
+		request, _ := http.NewRequest("GET", "/api/v1/acquisitions?"+query.Encode(), nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		if writer.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %v is %v instead of %v", query, writer.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHkChannels(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2018-05-22_13.33.56__mytest"
+	folderPath := filepath.Join(repository, dirname)
+	copyTestAcquisition(t, folderPath, "Hks/hk-extern-2018.05.22.133356.fits")
+	testApp, router := newTestApp(t, repository)
+
+	getChannels := func() []HkChannel {
+		request, _ := http.NewRequest("GET", "/api/v1/acquisitions/2018-05-22T13:33:56/hkchannels", nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		if writer.Code != http.StatusOK {
+			t.Fatalf("Response code is %v", writer.Code)
+		}
+
+		var channels []HkChannel
+		json.Unmarshal(writer.Body.Bytes(), &channels)
+		return channels
+	}
+
+	if channels := getChannels(); len(channels) != 0 {
+		t.Fatalf("Wrong number of channels: %d", len(channels))
+	}
+
+	// The description of the channels is added after the acquisition
+	copyTestAcquisition(t, folderPath, "hkplot/data_description.ini")
+	if err := RefreshDbContents(testApp.db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	channels := getChannels()
+	if len(channels) != 204 {
+		t.Fatalf("Wrong number of channels: %d", len(channels))
+	}
+
+	byName := map[string]HkChannel{}
+	for _, channel := range channels {
+		byName[channel.Name] = channel
+	}
+	if ch := byName["IMACRTDate1"]; ch.Unit != "s" || ch.XName != "" || ch.RealName != "Timeline des HK IMACRT1" {
+		t.Errorf("Wrong channel: %v", ch)
+	}
+	if ch := byName["IMACRT1_HKs_0"]; ch.XName != "IMACRTDate1" || ch.DataType != 9 || ch.XDataOptions != 2 {
+		t.Errorf("Wrong channel: %v", ch)
+	}
+}
+
+func TestHkTimeSeries(t *testing.T) {
+	repository := t.TempDir()
+
+	copyTestAcquisition(t, filepath.Join(repository, "2019-05-07_18.11.29__RF_switch_cont_13_34"),
+		"Hks/hk-MMR-2019.05.07.181129.fits",
+		"Hks/conf-asics-2019.05.07.181132.fits",
+	)
+	_, router := newTestApp(t, repository)
+
+	get := func(url string, expectedCode int) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		if writer.Code != expectedCode {
+			t.Fatalf("Response code for %s is %v instead of %v", url, writer.Code, expectedCode)
+		}
+		return writer
+	}
+
+	const baseURL = "/api/v1/acquisitions/2019-05-07T18:11:29/mmrhk/timeseries"
+
+	var series HkTimeSeries
+	json.Unmarshal(get(baseURL+"?channel=MMR3_Temperature", http.StatusOK).Body.Bytes(), &series)
+	if series.Hdu != "MMR_HK" || len(series.Time) != 367 || len(series.Channels) != 1 {
+		t.Fatalf("Wrong time series: %s, %d samples, %d channels",
+			series.Hdu, len(series.Time), len(series.Channels))
+	}
+	if series.Channels[0].Name != "MMR3_Temperature" || len(series.Channels[0].Values) != 367 {
+		t.Errorf("Wrong channel: %s, %d samples", series.Channels[0].Name, len(series.Channels[0].Values))
+	}
+
+	// Restrict the time range
+	start, end := series.Time[100], series.Time[199]
+	var subset HkTimeSeries
+	json.Unmarshal(get(fmt.Sprintf("%s?channel=MMR3_Temperature&start=%d&end=%d", baseURL, start, end),
+		http.StatusOK).Body.Bytes(), &subset)
+	if len(subset.Time) != 100 || subset.Time[0] != start || subset.Time[99] != end {
+		t.Errorf("Wrong number of samples in time range: %d", len(subset.Time))
+	}
+
+	// Decimate the samples
+	var decimated HkTimeSeries
+	json.Unmarshal(get(baseURL+"?channel=MMR3_Temperature&channel=MMR3_CH1_R&points=10",
+		http.StatusOK).Body.Bytes(), &decimated)
+	if len(decimated.Time) > 10 || len(decimated.Channels) != 2 ||
+		len(decimated.Channels[1].Values) != len(decimated.Time) {
+		t.Errorf("Wrong decimation: %d samples", len(decimated.Time))
+	}
+
+	csvData := get(baseURL+"?channel=MMR3_Temperature&format=csv", http.StatusOK).Body.String()
+	lines := strings.Split(strings.TrimSpace(csvData), "\n")
+	if len(lines) != 368 || lines[0] != "time,MMR3_Temperature" {
+		t.Errorf("Wrong CSV file: %d lines, header %q", len(lines), lines[0])
+	}
+
+	var asic HkTimeSeries
+	json.Unmarshal(get("/api/v1/acquisitions/2019-05-07T18:11:29/asichk/timeseries?hdu=CONF_ASIC2&channel=Apol",
+		http.StatusOK).Body.Bytes(), &asic)
+	if asic.Hdu != "CONF_ASIC2" || len(asic.Time) != 72 {
+		t.Errorf("Wrong ASIC time series: %s, %d samples", asic.Hdu, len(asic.Time))
+	}
+
+	get(baseURL+"?channel=Foo", http.StatusBadRequest)
+	get(baseURL+"?start=yesterday", http.StatusBadRequest)
+	get(baseURL+"?format=xml", http.StatusBadRequest)
+	get("/api/v1/acquisitions/2019-05-07T18:11:29/externhk/timeseries", http.StatusNotFound)
+}
+
+func TestHkPlot(t *testing.T) {
+	repository := t.TempDir()
+
+	copyTestAcquisition(t, filepath.Join(repository, "2019-05-07_18.11.29__RF_switch_cont_13_34"),
+		"Hks/hk-MMR-2019.05.07.181129.fits")
+	copyTestAcquisition(t, filepath.Join(repository, "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"),
+		"Hks/calibData-2022.04.05.155404.fits")
+	_, router := newTestApp(t, repository)
+
+	for _, tc := range []struct {
+		url          string
+		expectedCode int
+		contentType  string
+		prefix       string
+	}{
+		{"/api/v1/acquisitions/2019-05-07T18:11:29/mmrhk/plot", http.StatusOK, "image/png", "\x89PNG"},
+		{"/api/v1/acquisitions/2019-05-07T18:11:29/mmrhk/plot?channel=MMR3_Temperature&format=svg&width=400&height=300",
+			http.StatusOK, "image/svg+xml", "<svg"},
+		{"/api/v1/acquisitions/2019-05-07T18:11:29/mmrhk/plot?width=10", http.StatusBadRequest, "", ""},
+		{"/api/v1/acquisitions/2019-05-07T18:11:29/mmrhk/plot?format=gif", http.StatusBadRequest, "", ""},
+		{"/api/v1/acquisitions/2022-04-05T15:54:04/caldata/plot", http.StatusBadRequest, "", ""},
+	} {
+		request, _ := http.NewRequest("GET", tc.url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		if writer.Code != tc.expectedCode {
+			t.Errorf("Response code for %s is %v instead of %v", tc.url, writer.Code, tc.expectedCode)
+			continue
+		}
+		if tc.expectedCode != http.StatusOK {
+			continue
+		}
+
+		if contentType := writer.Header().Get("Content-Type"); contentType != tc.contentType {
+			t.Errorf("Wrong content type for %s: %s", tc.url, contentType)
+		}
+		if !strings.HasPrefix(writer.Body.String(), tc.prefix) {
+			t.Errorf("Wrong plot for %s", tc.url)
+		}
+	}
+}
+
+func TestFileKinds(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	folderPath := filepath.Join(repository, dirname)
+	copyTestAcquisition(t, folderPath,
+		"Hks/calibConf-2022.04.05.155408.fits",
+		"Hks/calibData-2022.04.05.155404.fits",
+		"Raws/raw-asic1-2022.04.05.155404.fits",
+		"Raws/raw-asic2-2022.04.05.155404.fits",
+	)
+
+	// File kinds must be in the database before the repository is scanned
+	testApp, router := newTestApp(t, "")
+	config := Configuration{
+		FileKinds: []FileKind{
+			{Name: "calconf", Directory: "Hks", Mask: "calibConf-*.fits"},
+			{Name: "rawcopy", Directory: "Raws", Mask: "raw-asic*.fits", Multiple: true},
+		},
+	}
+	if err := InitDb(testApp.db, &config); err != nil {
+		t.Fatalf("Unable to initialize the database: %s", err)
+	}
+	if err := RefreshDbContents(testApp.db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+
+	writer := get("/api/v1/filekinds")
+	var kinds []FileKind
+	json.Unmarshal(writer.Body.Bytes(), &kinds)
+	if len(kinds) != 2 || kinds[0].Name != "calconf" || !kinds[1].Multiple {
+		t.Fatalf("Wrong list of file kinds: %v", kinds)
+	}
+
+	const acqURL = "/api/v1/acquisitions/2022-04-05T15:54:04"
+	writer = get(acqURL + "/files")
+	var files []DataFile
+	json.Unmarshal(writer.Body.Bytes(), &files)
+	if len(files) != 3 {
+		t.Fatalf("Wrong list of files: %v", files)
+	}
+
+	writer = get(acqURL + "/files?kind=rawcopy")
+	json.Unmarshal(writer.Body.Bytes(), &files)
+	if len(files) != 2 || files[1].BaseName() != "raw-asic2-2022.04.05.155404.fits" {
+		t.Fatalf("Wrong list of files: %v", files)
+	}
+
+	for _, tc := range []struct {
+		url  string
+		code int
+		size int64
+	}{
+		{acqURL + "/files/rawcopy", http.StatusOK, files[0].Size},
+		{acqURL + "/files/rawcopy/1", http.StatusOK, files[1].Size},
+		{acqURL + "/files/rawcopy/2", http.StatusNotFound, 0},
+		{acqURL + "/files/calconf", http.StatusOK, -1},
+		// Aliases for the default file kinds
+		{acqURL + "/calconf", http.StatusOK, -1},
+		{acqURL + "/caldata", http.StatusNotFound, 0},
+		{acqURL + "/files/unknown", http.StatusNotFound, 0},
+	} {
+		writer := get(tc.url)
+		if writer.Code != tc.code {
+			t.Errorf("Wrong response code for %s: %d", tc.url, writer.Code)
+		}
+		if tc.size > 0 && int64(writer.Body.Len()) != tc.size {
+			t.Errorf("Wrong size for %s: %d instead of %d", tc.url, writer.Body.Len(), tc.size)
+		}
+	}
+
+	writer = get(acqURL + "/files/rawcopy/1/header")
+	var hdus []FitsHdu
+	json.Unmarshal(writer.Body.Bytes(), &hdus)
+	if writer.Code != http.StatusOK || len(hdus) == 0 {
+		t.Errorf("Wrong headers for the second raw file: %d %v", writer.Code, hdus)
+	}
+
+	// File kinds are validated
+	config.FileKinds = append(config.FileKinds, FileKind{Name: "calconf", Mask: "*.fits"})
+	if err := InitDb(testApp.db, &config); err == nil {
+		t.Errorf("Duplicate file kinds were accepted")
+	}
+}
+
+func TestScanStatus(t *testing.T) {
+	testApp, _ := newTestApp(t, "")
+
+	repository := t.TempDir()
+	createSyntheticRepository(t, repository, 3)
+	if err := os.MkdirAll(filepath.Join(repository, "2018-13-45_99.99.99__wrongdate"), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+
+	if status := testApp.scanProgress.Status(); status.Running || status.FinishedAt != nil {
+		t.Fatalf("Wrong state before the scan: %v", status)
+	}
+
+	repositories := []Repository{{Name: DefaultRepositoryName, Path: repository}}
+	if err := ScanRepositories(testApp.db, repositories, 2, &testApp.scanProgress); err != nil {
+		t.Fatalf("Error running ScanRepositories: %s", err)
+	}
+
+	request, _ := http.NewRequest("GET", "/api/v1/scan", nil)
+	writer := httptest.NewRecorder()
+	if err := testApp.scanStatusHandler(writer, request); err != nil {
+		t.Fatalf("Error from the handler: %s", err)
+	}
+
+	var status ScanStatus
+	if err := json.Unmarshal(writer.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Invalid JSON: %s", err)
+	}
+	if status.Running || status.NumOfFolders != 4 || status.NumOfScannedFolders != 4 ||
+		status.NumOfErrors != 1 || status.Error != "" || status.FinishedAt == nil {
+		t.Fatalf("Wrong state after the scan: %s", writer.Body.String())
+	}
+
+	report, err := QueryIngestionReport(testApp.db, 0)
+	if err != nil || report == nil || report.ID != status.ReportID {
+		t.Fatalf("Wrong report ID %d (%v)", status.ReportID, err)
+	}
+
+	// A failed scan is reported as well
+	repositories[0].Path = filepath.Join(repository, "nonexistent")
+	err = ScanRepositories(testApp.db, repositories, 2, &testApp.scanProgress)
+	if status := testApp.scanProgress.Status(); err == nil || status.Running || status.Error == "" {
+		t.Fatalf("Wrong state after a failed scan: %v", status)
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	testApp, router := newTestApp(t, "")
+
+	repositories := []Repository{
+		{Name: "lab", Path: t.TempDir()},
+		{Name: "site", Path: t.TempDir()},
+	}
+	createSyntheticRepository(t, repositories[0].Path, 2)
+	copyTestAcquisition(t, filepath.Join(repositories[1].Path, "2018-05-22_13.33.56__mytest"),
+		"Hks/hk-extern-2018.05.22.133356.fits")
+	if err := ScanRepositories(testApp.db, repositories, 2, nil); err != nil {
+		t.Fatalf("Error running ScanRepositories: %s", err)
+	}
+
+	for query, expected := range map[string]int{
+		"":                           3,
+		"?repository=lab":            2,
+		"?repository=site":           1,
+		"?repository=lab,site":       3,
+		"?repository=lab&header=x=1": 0,
+		"?repository=unknown":        0,
+	} {
+		request, _ := http.NewRequest("GET", "/api/v1/acquisitions"+query, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		var acqList []Acquisition
+		if err := json.Unmarshal(writer.Body.Bytes(), &acqList); err != nil {
+			t.Fatalf("Invalid JSON for %q: %s", query, writer.Body.String())
+		}
+		if len(acqList) != expected {
+			t.Errorf("Wrong number of acquisitions for %q: %d instead of %d",
+				query, len(acqList), expected)
+		}
+	}
+
+	// Files in ZIP archives are put in a folder named after the repository
+	request, _ := http.NewRequest("GET", "/api/v1/acquisitions/2018-05-22T13:33:56/archive", nil)
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+
+	body := writer.Body.Bytes()
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Invalid ZIP archive: %s", err)
+	}
+	for _, f := range archive.File {
+		if !strings.HasPrefix(f.Name, "site/") {
+			t.Errorf("File %q is not in the folder of the repository", f.Name)
+		}
+	}
+	if _, err := archive.Open("site/Hks/hk-extern-2018.05.22.133356.fits"); err != nil {
+		t.Errorf("Missing HK file in the ZIP archive: %s", err)
+	}
+}
+
+func TestCompressedFiles(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	const rawFile = "Raws/raw-asic1-2022.04.05.155404.fits"
+	gzipTestAcquisition(t, filepath.Join(repository, dirname),
+		rawFile,
+		"Hks/calibConf-2022.04.05.155408.fits",
+	)
+	testApp, router := newTestApp(t, repository)
+
+	var raw RawDataFile
+	if err := testApp.db.Preload("Hdus").First(&raw).Error; err != nil {
+		t.Fatalf("Compressed raw file has not been ingested: %s", err)
+	}
+	if raw.Compression != compressionGzip || !strings.HasSuffix(raw.FileName, ".fits.gz") {
+		t.Errorf("Wrong compression for %s: %q", raw.FileName, raw.Compression)
+	}
+	if len(raw.Hdus) != 2 {
+		t.Errorf("Wrong number of HDUs in the compressed file: %d", len(raw.Hdus))
+	}
+
+	original, _ := os.ReadFile(filepath.Join("testdata", dirname, rawFile))
+	compressed, _ := os.ReadFile(filepath.Join(repository, dirname, rawFile+".gz"))
+	for _, c := range []struct {
+		query       string
+		code        int
+		expected    []byte
+		contentType string
+	}{
+		{"", http.StatusOK, compressed, "application/gzip"},
+		{"?decompress=false", http.StatusOK, compressed, "application/gzip"},
+		{"?decompress=true", http.StatusOK, original, "application/fits"},
+		{"?decompress=maybe", http.StatusBadRequest, nil, ""},
+	} {
+		request, _ := http.NewRequest("GET", "/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/1"+c.query, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		if writer.Code != c.code {
+			t.Errorf("Response code for %q is %v instead of %v", c.query, writer.Code, c.code)
+			continue
+		}
+		if c.expected != nil && !bytes.Equal(writer.Body.Bytes(), c.expected) {
+			t.Errorf("Wrong contents for %q", c.query)
+		}
+		if contentType := writer.Header().Get("Content-Type"); c.contentType != "" && contentType != c.contentType {
+			t.Errorf("Wrong Content-Type for %q: %q", c.query, contentType)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/api/v1/acquisitions/2022-04-05T15:54:04/calconf?decompress=1", nil)
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Response code for calconf is %v", writer.Code)
+	}
+	if disposition := writer.Header().Get("Content-Disposition"); !strings.Contains(disposition, `"calibConf-2022.04.05.155408.fits"`) {
+		t.Errorf("Wrong Content-Disposition: %q", disposition)
+	}
+
+	// If the file is truncated, the error is found after part of it has been
+	// sent, and the connection must be broken
+	if err := os.WriteFile(raw.FileName, compressed[:len(compressed)/2], 0644); err != nil {
+		t.Fatalf("Unable to truncate the file: %s", err)
+	}
+	request, _ = http.NewRequest("GET", "/api/v1/acquisitions/2022-04-05T15:54:04/rawdata/1?decompress=true", nil)
+	writer = httptest.NewRecorder()
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("The transfer of a truncated file has not been aborted (%v)", r)
+			}
+		}()
+		router.ServeHTTP(writer, request)
+	}()
+	if writer.Body.Len() == 0 {
+		t.Errorf("The truncated file has been reported before sending anything")
+	}
+}
+
+func TestTags(t *testing.T) {
+	repository := t.TempDir()
+	createSyntheticRepository(t, repository, 3)
+	testApp, router := newTestApp(t, repository)
+
+	// Tags can be modified only by authenticated users, so the handlers
+	// are called directly
+	addTags := func(acqTime string, tags string) *httptest.ResponseRecorder {
+		form := url.Values{"tag": {tags}}
+		request, _ := http.NewRequest("POST", "/api/v1/acquisitions/"+acqTime+"/tags",
+			strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request = mux.SetURLVars(request, map[string]string{"acq_id": acqTime})
+		writer := httptest.NewRecorder()
+		testApp.handleErrWrap(testApp.addTagHandler)(writer, request)
+		return writer
+	}
+
+	writer := addTags("2018-04-06T00:00:00", "Calibration, bad-weather")
+	var tags []Tag
+	if err := json.Unmarshal(writer.Body.Bytes(), &tags); err != nil || writer.Code != http.StatusOK {
+		t.Fatalf("Wrong response (%d): %s", writer.Code, writer.Body.String())
+	}
+	if len(tags) != 2 || tags[0].Name != "bad-weather" || tags[1].Name != "calibration" {
+		t.Errorf("Wrong tags: %v", tags)
+	}
+
+	for _, name := range []string{"calibration", "CALIBRATION"} {
+		if writer := addTags("2018-04-06T00:01:00", name); writer.Code != http.StatusOK {
+			t.Errorf("Unable to add tag %q: %s", name, writer.Body.String())
+		}
+	}
+	for _, name := range []string{"", " , ", "not valid!", "-calibration"} {
+		if writer := addTags("2018-04-06T00:01:00", name); writer.Code != http.StatusBadRequest {
+			t.Errorf("Response code for tag %q is %d instead of 400", name, writer.Code)
+		}
+	}
+
+	for query, expected := range map[string][]string{
+		"tag=calibration":                   {"2018-04-06T00:01:00", "2018-04-06T00:00:00"},
+		"tag=calibration,bad-weather":       {"2018-04-06T00:00:00"},
+		"tag=calibration&tag=Bad-Weather":   {"2018-04-06T00:00:00"},
+		"tag=cryo-cooldown":                 {},
+		"tag=calibration&repository=remote": {},
+	} {
+		request, _ := http.NewRequest("GET", "/api/v1/acquisitions?"+query, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		var acqs []Acquisition
+		if err := json.Unmarshal(writer.Body.Bytes(), &acqs); err != nil {
+			t.Fatalf("Invalid JSON for %q: %s", query, writer.Body.String())
+		}
+
+		var times []string
+		for _, acq := range acqs {
+			times = append(times, acq.AcquisitionTime)
+			if len(acq.Tags) == 0 {
+				t.Errorf("No tags for %s", acq.AcquisitionTime)
+			}
+		}
+		if strings.Join(times, " ") != strings.Join(expected, " ") {
+			t.Errorf("Wrong acquisitions for %q: %v", query, times)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/api/v1/acquisitions?tag=not+valid!", nil)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	if writer.Code != http.StatusBadRequest {
+		t.Errorf("Response code for an invalid tag is %d instead of 400", writer.Code)
+	}
+
+	tagCounts := func() string {
+		request, _ := http.NewRequest("GET", "/api/v1/tags", nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		var counts []TagCount
+		if err := json.Unmarshal(writer.Body.Bytes(), &counts); err != nil {
+			t.Fatalf("Invalid JSON: %s", writer.Body.String())
+		}
+
+		var result []string
+		for _, count := range counts {
+			result = append(result, fmt.Sprintf("%s:%d", count.Name, count.NumOfAcquisitions))
+		}
+		return strings.Join(result, " ")
+	}
+	if counts := tagCounts(); counts != "bad-weather:1 calibration:2" {
+		t.Errorf("Wrong list of tags: %s", counts)
+	}
+
+	// Tags that are no longer used disappear
+	request, _ = http.NewRequest("DELETE", "/api/v1/acquisitions/2018-04-06T00:00:00/tags/bad-weather", nil)
+	request = mux.SetURLVars(request, map[string]string{"acq_id": "2018-04-06T00:00:00", "tag": "bad-weather"})
+	writer = httptest.NewRecorder()
+	testApp.handleErrWrap(testApp.removeTagHandler)(writer, request)
+	if writer.Code != http.StatusOK || strings.TrimSpace(writer.Body.String()) != `[{"name":"calibration"}]` {
+		t.Errorf("Wrong response after removing a tag (%d): %s", writer.Code, writer.Body.String())
+	}
+	if counts := tagCounts(); counts != "calibration:2" {
+		t.Errorf("Wrong list of tags: %s", counts)
+	}
+
+	// Purged acquisitions lose their tags
+	if err := os.RemoveAll(filepath.Join(repository, "2018-04-06_00.01.00__synthetic")); err != nil {
+		t.Fatalf("Unable to remove the folder: %s", err)
+	}
+	if err := FlagMissingAcquisition(testApp.db, "2018-04-06_00.01.00__synthetic"); err != nil {
+		t.Fatalf("Unable to flag the acquisition as missing: %s", err)
+	}
+	if _, err := PurgeMissing(testApp.db); err != nil {
+		t.Fatalf("Unable to purge missing acquisitions: %s", err)
+	}
+	if counts := tagCounts(); counts != "calibration:1" {
+		t.Errorf("Wrong list of tags after the purge: %s", counts)
+	}
+
+	acq, err := QueryAcquisition(testApp.db, "2018-04-06T00:02:00")
+	if err != nil {
+		t.Fatalf("Unable to query the acquisition: %s", err)
+	}
+	if data, _ := json.Marshal(acq); !strings.Contains(string(data), `"tags":[]`) {
+		t.Errorf("Wrong JSON for an acquisition without tags: %s", data)
+	}
+}
+
+// loginCookie creates a new user and returns the cookie of a session opened
+// by it
+func loginCookie(t *testing.T, app *App, email string, superuser bool) *http.Cookie {
+	user, err := CreateUser(app.db, email, "password", superuser)
+	if err != nil {
+		t.Fatalf("Unable to create user %s: %s", email, err)
+	}
+
+	session, err := CreateSession(app.db, user)
+	if err != nil {
+		t.Fatalf("Unable to create a session: %s", err)
+	}
+
+	encoded, err := app.cookieEncoder.Encode("_cookie", session.UUID)
+	if err != nil {
+		t.Fatalf("Unable to encode the cookie: %s", err)
+	}
+
+	return &http.Cookie{Name: "_cookie", Value: encoded}
+}
+
+func TestComments(t *testing.T) {
+	repository := t.TempDir()
+	createSyntheticRepository(t, repository, 1)
+	testApp, router := newTestApp(t, repository)
+
+	alice := loginCookie(t, testApp, "alice@example.com", false)
+	bob := loginCookie(t, testApp, "bob@example.com", false)
+	admin := loginCookie(t, testApp, "admin@example.com", true)
+
+	const acqURL = "/api/v1/acquisitions/2018-04-06T00:00:00"
+	send := func(method string, url string, cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+
+	const text = "**Cold** start <script>alert(1)</script> [link](javascript:alert(1))"
+	writer := send("POST", acqURL+"/comments", alice, url.Values{"body": {text}}.Encode())
+	if writer.Code != http.StatusCreated {
+		t.Fatalf("Response code is %d: %s", writer.Code, writer.Body.String())
+	}
+	var comment Comment
+	if err := json.Unmarshal(writer.Body.Bytes(), &comment); err != nil {
+		t.Fatalf("Invalid JSON: %s", writer.Body.String())
+	}
+	if comment.Author != "alice@example.com" || comment.Body != text {
+		t.Errorf("Wrong comment: %v", comment)
+	}
+
+	html := string(comment.HTML())
+	if !strings.Contains(html, "<strong>Cold</strong>") ||
+		strings.Contains(html, "<script") || strings.Contains(html, "javascript:") {
+		t.Errorf("Unsafe rendering of the comment: %s", html)
+	}
+
+	if writer := send("POST", acqURL+"/comments", nil, "body=Hello"); writer.Code != http.StatusUnauthorized {
+		t.Errorf("Anonymous users can write comments (%d)", writer.Code)
+	}
+	if writer := send("POST", acqURL+"/comments", bob, "body=+"); writer.Code != http.StatusBadRequest {
+		t.Errorf("Empty comments are accepted (%d)", writer.Code)
+	}
+
+	// The page of the acquisition shows the comment and the buttons to
+	// modify it to its author only
+	for _, c := range []struct {
+		name    string
+		cookie  *http.Cookie
+		buttons bool
+	}{{"alice", alice, true}, {"bob", bob, false}, {"admin", admin, true}} {
+		request, _ := http.NewRequest("GET", acqURL, nil)
+		request.Header.Set("Accept", "text/html")
+		request.AddCookie(c.cookie)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		page := writer.Body.String()
+		if !strings.Contains(page, "<strong>Cold</strong>") || strings.Contains(page, "<script>alert") {
+			t.Errorf("Wrong rendering of the comment in the page")
+		}
+		if strings.Contains(page, "deleteComment('") != c.buttons {
+			t.Errorf("Wrong visibility of the buttons for %s", c.name)
+		}
+	}
+
+	commentURL := fmt.Sprintf("%s/comments/%d", acqURL, comment.ID)
+	if writer := send("PUT", commentURL, bob, "body=Hacked"); writer.Code != http.StatusForbidden {
+		t.Errorf("Response code for a PUT from another user is %d instead of 403", writer.Code)
+	}
+	if writer := send("PUT", commentURL, alice, "body=Warm+start"); writer.Code != http.StatusOK {
+		t.Errorf("Response code for a PUT from the author is %d", writer.Code)
+	}
+	if writer := send("PUT", acqURL+"/comments/1000", alice, "body=Warm+start"); writer.Code != http.StatusNotFound {
+		t.Errorf("Response code for a non-existing comment is %d instead of 404", writer.Code)
+	}
+	if writer := send("DELETE", commentURL, bob, ""); writer.Code != http.StatusForbidden {
+		t.Errorf("Response code for a DELETE from another user is %d instead of 403", writer.Code)
+	}
+
+	writer = send("GET", acqURL+"/comments", nil, "")
+	var comments []Comment
+	if err := json.Unmarshal(writer.Body.Bytes(), &comments); err != nil {
+		t.Fatalf("Invalid JSON: %s", writer.Body.String())
+	}
+	if len(comments) != 1 || comments[0].Body != "Warm start" || comments[0].Author != "alice@example.com" {
+		t.Errorf("Wrong list of comments: %v", comments)
+	}
+
+	if writer := send("DELETE", commentURL, admin, ""); writer.Code != http.StatusNoContent {
+		t.Errorf("Response code for a DELETE from an administrator is %d", writer.Code)
+	}
+	writer = send("GET", acqURL+"/comments", nil, "")
+	if strings.TrimSpace(writer.Body.String()) != "[]" {
+		t.Errorf("Comment has not been deleted: %s", writer.Body.String())
+	}
+
+	// Forms in the acquisition page bring the user back to the page
+	request, _ := http.NewRequest("POST", acqURL+"/comments", strings.NewReader("body=Hello"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "text/html")
+	request.AddCookie(alice)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	if location := writer.Header().Get("Location"); writer.Code != http.StatusFound ||
+		location != "/api/v1/acquisitions/2018-04-06_00.00.00__synthetic" {
+		t.Errorf("Wrong redirection (%d): %q", writer.Code, location)
+	}
+}
+
+func TestCampaigns(t *testing.T) {
+	repository := t.TempDir()
+	createSyntheticRepository(t, repository, 3)
+	testApp, router := newTestApp(t, repository)
+
+	user := loginCookie(t, testApp, "user@example.com", false)
+	admin := loginCookie(t, testApp, "admin@example.com", true)
+
+	send := func(method string, url string, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+	acquisitionTimes := func(query string) string {
+		writer := send("GET", "/api/v1/acquisitions?"+query, nil, nil)
+		var acqs []Acquisition
+		if err := json.Unmarshal(writer.Body.Bytes(), &acqs); err != nil {
+			t.Fatalf("Invalid JSON for %q: %s", query, writer.Body.String())
+		}
+
+		var times []string
+		for _, acq := range acqs {
+			times = append(times, acq.AcquisitionTime)
+		}
+		return strings.Join(times, " ")
+	}
+
+	// Only administrators can create campaigns
+	form := url.Values{
+		"name":        {"cryo-1"},
+		"description": {"First cooldown"},
+		"start_time":  {"2018-04-06T00:01:00"},
+		"end_time":    {"2018-04-06"},
+	}
+	if writer := send("POST", "/api/v1/campaigns", user, form); writer.Code == http.StatusCreated {
+		t.Errorf("Normal users can create campaigns")
+	}
+	writer := send("POST", "/api/v1/campaigns", admin, form)
+	if writer.Code != http.StatusCreated {
+		t.Fatalf("Response code is %d: %s", writer.Code, writer.Body.String())
+	}
+	var campaign Campaign
+	if err := json.Unmarshal(writer.Body.Bytes(), &campaign); err != nil {
+		t.Fatalf("Invalid JSON: %s", writer.Body.String())
+	}
+	if campaign.StartTime != "2018-04-06T00:01:00" || campaign.EndTime != "2018-04-06T23:59:59" {
+		t.Errorf("Wrong time span: %s - %s", campaign.StartTime, campaign.EndTime)
+	}
+
+	for _, invalid := range []url.Values{
+		{"name": {"cryo-1"}},
+		{"name": {"not valid!"}},
+		{"name": {"cryo-2"}, "start_time": {"yesterday"}},
+		{"name": {"cryo-2"}, "start_time": {"2018-04-07"}, "end_time": {"2018-04-06"}},
+		{"name": {"cryo-2"}, "name_mask": {"[synthetic"}},
+	} {
+		if writer := send("POST", "/api/v1/campaigns", admin, invalid); writer.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %v is %d instead of 400", invalid, writer.Code)
+		}
+	}
+
+	// Assign acquisitions manually and through the rules
+	const campaignURL = "/api/v1/campaigns/cryo-1"
+	writer = send("POST", campaignURL+"/acquisitions", admin,
+		url.Values{"acquisition": {"2018-04-06T00:00:00"}})
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Unable to assign an acquisition (%d): %s", writer.Code, writer.Body.String())
+	}
+	writer = send("POST", campaignURL+"/acquisitions", admin,
+		url.Values{"acquisition": {"2019-01-01T00:00:00"}})
+	if writer.Code != http.StatusBadRequest {
+		t.Errorf("Response code for a nonexistent acquisition is %d instead of 400", writer.Code)
+	}
+
+	writer = send("POST", campaignURL+"/acquisitions", admin, url.Values{"apply_rules": {"true"}})
+	if err := json.Unmarshal(writer.Body.Bytes(), &campaign); err != nil {
+		t.Fatalf("Invalid JSON: %s", writer.Body.String())
+	}
+	if campaign.NumOfAcquisitions != 3 {
+		t.Errorf("Wrong number of acquisitions: %d", campaign.NumOfAcquisitions)
+	}
+
+	writer = send("DELETE", campaignURL+"/acquisitions/2018-04-06T00:02:00", admin, nil)
+	if writer.Code != http.StatusNoContent {
+		t.Errorf("Unable to remove an acquisition (%d): %s", writer.Code, writer.Body.String())
+	}
+	if times := acquisitionTimes("campaign=cryo-1"); times != "2018-04-06T00:01:00 2018-04-06T00:00:00" {
+		t.Errorf("Wrong acquisitions in the campaign: %s", times)
+	}
+
+	// New acquisitions are assigned automatically only to campaigns that
+	// ask for it
+	writer = send("POST", "/api/v1/campaigns", admin, url.Values{
+		"name":        {"cryo-2"},
+		"start_time":  {"2018-04-06T00:03:00"},
+		"name_mask":   {"synth*"},
+		"auto_assign": {"true"},
+	})
+	if writer.Code != http.StatusCreated {
+		t.Fatalf("Response code is %d: %s", writer.Code, writer.Body.String())
+	}
+	createSyntheticRepository(t, repository, 5)
+	if err := RefreshDbContents(testApp.db, repository); err != nil {
+		t.Fatalf("Error running RefreshDbContents: %s", err)
+	}
+	if times := acquisitionTimes("campaign=cryo-2"); times != "2018-04-06T00:04:00 2018-04-06T00:03:00" {
+		t.Errorf("Wrong acquisitions in the campaign: %s", times)
+	}
+	if times := acquisitionTimes("campaign=cryo-1,cryo-2&tag=nothing"); times != "" {
+		t.Errorf("Wrong acquisitions for two campaigns and a tag: %s", times)
+	}
+
+	// The archive contains one folder per acquisition, and the manifest
+	writer = send("GET", campaignURL+"/archive", nil, nil)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Unable to download the archive (%d): %s", writer.Code, writer.Body.String())
+	}
+	reader, err := zip.NewReader(bytes.NewReader(writer.Body.Bytes()), int64(writer.Body.Len()))
+	if err != nil {
+		t.Fatalf("Invalid ZIP archive: %s", err)
+	}
+	names := map[string]bool{}
+	for _, f := range reader.File {
+		names[f.Name] = true
+	}
+	for _, name := range []string{
+		"cryo-1/manifest.json",
+		"cryo-1/2018-04-06_00.00.00__synthetic/Raws/raw-asic1-2018.04.06.142047.fits",
+		"cryo-1/2018-04-06_00.01.00__synthetic/Raws/raw-asic1-2018.04.06.142047.fits",
+	} {
+		if !names[name] {
+			t.Errorf("File %s is not in the archive", name)
+		}
+	}
+	if names["cryo-1/2018-04-06_00.02.00__synthetic/Raws/raw-asic1-2018.04.06.142047.fits"] {
+		t.Errorf("The archive contains an acquisition that does not belong to the campaign")
+	}
+
+	// Selecting only the housekeeping files works for campaigns too
+	writer = send("GET", campaignURL+"/archive?format=tar.gz&content=hk", nil, nil)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Unable to download the tar.gz archive (%d): %s", writer.Code, writer.Body.String())
+	}
+	tarNames := archiveNames(t, "tar.gz", writer.Body.Bytes())
+	if !tarNames["cryo-1/manifest.json"] ||
+		!tarNames["cryo-1/2018-04-06_00.00.00__synthetic/Hks/conf-asics-2018.04.06.142036.fits"] ||
+		tarNames["cryo-1/2018-04-06_00.00.00__synthetic/Raws/raw-asic1-2018.04.06.142047.fits"] {
+		t.Errorf("Wrong contents of the tar.gz archive: %v", tarNames)
+	}
+
+	writer = send("GET", campaignURL+"/manifest", nil, nil)
+	var manifest CampaignManifest
+	if err := json.Unmarshal(writer.Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("Invalid JSON: %s", writer.Body.String())
+	}
+	if manifest.Name != "cryo-1" || manifest.QuteDBVersion != QuteDBVersion ||
+		len(manifest.Acquisitions) != 2 || len(manifest.Acquisitions[0].Files) == 0 {
+		t.Fatalf("Wrong manifest: %s", writer.Body.String())
+	}
+	if name := manifest.Acquisitions[0].Files[0].FileName; !names[name] {
+		t.Errorf("File %s is listed in the manifest but not in the archive", name)
+	}
+
+	// Partial updates leave the other fields untouched
+	writer = send("PUT", campaignURL, admin, url.Values{"description": {"Cooldown #1"}})
+	if err := json.Unmarshal(writer.Body.Bytes(), &campaign); err != nil {
+		t.Fatalf("Invalid JSON: %s", writer.Body.String())
+	}
+	if campaign.Description != "Cooldown #1" || campaign.StartTime != "2018-04-06T00:01:00" {
+		t.Errorf("Wrong campaign after the update: %v", campaign)
+	}
+
+	if writer := send("DELETE", campaignURL, admin, nil); writer.Code != http.StatusNoContent {
+		t.Errorf("Unable to delete the campaign (%d): %s", writer.Code, writer.Body.String())
+	}
+	if writer := send("GET", campaignURL, nil, nil); writer.Code != http.StatusNotFound {
+		t.Errorf("Response code for a deleted campaign is %d instead of 404", writer.Code)
+	}
+	if times := acquisitionTimes("campaign=cryo-1"); times != "" {
+		t.Errorf("Acquisitions still belong to a deleted campaign: %s", times)
+	}
+
+	writer = send("GET", "/api/v1/campaigns", nil, nil)
+	var campaigns []Campaign
+	if err := json.Unmarshal(writer.Body.Bytes(), &campaigns); err != nil {
+		t.Fatalf("Invalid JSON: %s", writer.Body.String())
+	}
+	if len(campaigns) != 1 || campaigns[0].Name != "cryo-2" || campaigns[0].NumOfAcquisitions != 2 {
+		t.Errorf("Wrong list of campaigns: %s", writer.Body.String())
+	}
+
+	// Pages
+	for _, page := range []string{"/campaigns", "/campaigns/cryo-2"} {
+		writer := send("GET", page, admin, nil)
+		if writer.Code != http.StatusOK || !strings.Contains(writer.Body.String(), "cryo-2") {
+			t.Errorf("Wrong page %s (%d)", page, writer.Code)
+		}
+	}
+}
+
+func TestAcquisitionListPages(t *testing.T) {
+	repository := t.TempDir()
+	copyTestAcquisition(t, filepath.Join(repository, "2018-04-06_14.20.35__testbackups"),
+		"Raws/raw-asic1-2018.04.06.142047.fits")
+	copyTestAcquisition(t, filepath.Join(repository, "2018-05-22_13.33.56__mytest"),
+		"Hks/hk-extern-2018.05.22.133356.fits")
+	copyTestAcquisition(t, filepath.Join(repository, "2018-05-22_13.38.15__test_backhome"),
+		"Hks/hk-extern-2018.05.22.133816.fits")
+	copyTestAcquisition(t, filepath.Join(repository, "2018-05-22_15.22.22__test_withGPS"),
+		"Hks/hk-extern-2018.05.22.152222.fits")
+	copyTestAcquisition(t, filepath.Join(repository, "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"),
+		"Raws/raw-asic2-2022.04.05.155404.fits",
+		"Sums/science-asic2-2022.04.05.155404.fits")
+	testApp, router := newTestApp(t, repository)
+
+	get := func(query string) (*httptest.ResponseRecorder, string) {
+		request, _ := http.NewRequest("GET", "/api/v1/acquisitions?"+query, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		var acqs []Acquisition
+		if writer.Code == http.StatusOK {
+			if err := json.Unmarshal(writer.Body.Bytes(), &acqs); err != nil {
+				t.Fatalf("Invalid JSON for %q: %s", query, writer.Body.String())
+			}
+		}
+
+		var names []string
+		for _, acq := range acqs {
+			names = append(names, acq.Name)
+		}
+		return writer, strings.Join(names, " ")
+	}
+
+	for query, expected := range map[string]string{
+		"":                                "Test-CalibrationSource-Timeconstant test_withGPS test_backhome mytest testbackups",
+		"start=2018-05-22&end=2018-05-22": "test_withGPS test_backhome mytest",
+		"end=2018-05-22T13:38:15":         "test_backhome mytest testbackups",
+		"name=TEST_":                      "test_withGPS test_backhome",
+		"name=%25":                        "",
+		"name_regexp=^test[a-z]":          "testbackups",
+		"has_raw=true":                    "Test-CalibrationSource-Timeconstant testbackups",
+		"has_sum=false&has_hk=false":      "testbackups",
+		"asic=2":                          "Test-CalibrationSource-Timeconstant",
+		"asic=1,3":                        "testbackups",
+		"sort=name":                       "Test-CalibrationSource-Timeconstant mytest test_backhome test_withGPS testbackups",
+		"sort=name&order=desc&limit=2":    "testbackups test_withGPS",
+		"order=asc&limit=2&offset=3":      "test_withGPS Test-CalibrationSource-Timeconstant",
+	} {
+		writer, names := get(query)
+		if writer.Code != http.StatusOK {
+			t.Errorf("Response code for %q is %d: %s", query, writer.Code, writer.Body.String())
+		} else if names != expected {
+			t.Errorf("Wrong acquisitions for %q: %q", query, names)
+		}
+	}
+
+	for _, query := range []string{
+		"start=yesterday",
+		"name_regexp=(",
+		"has_raw=maybe",
+		"asic=0",
+		"sort=size",
+		"order=random",
+		"limit=-1",
+		"cursor=garbage",
+		"offset=1&cursor=eyJzIjoidGltZSIsImQiOnRydWUsInYiOiIiLCJpIjowfQ",
+	} {
+		if writer, _ := get(query); writer.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %q is %d instead of 400", query, writer.Code)
+		}
+	}
+
+	// Walk through the pages using offsets and cursors
+	writer, names := get("sort=name&limit=2&offset=2")
+	if names != "test_backhome test_withGPS" || writer.Header().Get("X-Total-Count") != "5" {
+		t.Errorf("Wrong page: %q (total %s)", names, writer.Header().Get("X-Total-Count"))
+	}
+	link := writer.Header().Get("Link")
+	if !strings.Contains(link, "offset=4") || !strings.Contains(link, `rel="next"`) ||
+		!strings.Contains(link, `rel="prev"`) {
+		t.Errorf("Wrong links: %s", link)
+	}
+
+	var pages []string
+	query := "has_hk=true&limit=2"
+	for i := 0; query != ""; i++ {
+		if i > 5 {
+			t.Fatalf("Too many pages")
+		}
+
+		writer, names := get(query)
+		pages = append(pages, names)
+		query = ""
+		if cursor := writer.Header().Get("X-Next-Cursor"); cursor != "" {
+			query = "has_hk=true&limit=2&cursor=" + cursor
+		}
+	}
+	if strings.Join(pages, "|") != "test_withGPS test_backhome|mytest" {
+		t.Errorf("Wrong pages: %v", pages)
+	}
+
+	// Cursors do not work with a different sort order
+	writer, _ = get("limit=1")
+	if writer, _ := get("sort=name&cursor=" + writer.Header().Get("X-Next-Cursor")); writer.Code != http.StatusBadRequest {
+		t.Errorf("Response code for a mismatched cursor is %d instead of 400", writer.Code)
+	}
+
+	// The home page shows one page at a time
+	request, _ := http.NewRequest("GET", "/?limit=2&name=test", nil)
+	request.AddCookie(loginCookie(t, testApp, "user@example.com", false))
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	page := writer.Body.String()
+	if !strings.Contains(page, "Tests 1&ndash;2 of 5") || !strings.Contains(page, "offset=2") ||
+		!strings.Contains(page, "Test-CalibrationSource-Timeconstant") || strings.Contains(page, ">mytest<") {
+		t.Errorf("Wrong home page: %s", page)
+	}
+}
+
+func TestAcquisitionIdentifiers(t *testing.T) {
+	repository := t.TempDir()
+	createSyntheticRepository(t, repository, 2)
+
+	// Two folders started in the same second
+	const first = "2018-04-06_00.00.00__synthetic"
+	const second = "2018-04-06_00.00.00__twin"
+	if err := os.CopyFS(filepath.Join(repository, second), os.DirFS(filepath.Join(repository, first))); err != nil {
+		t.Fatalf("Unable to copy the acquisition: %s", err)
+	}
+	_, router := newTestApp(t, repository)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+
+	writer := get("/api/v1/acquisitions/2018-04-06T00:00:00")
+	if writer.Code != http.StatusConflict {
+		t.Fatalf("Response code for an ambiguous time is %d instead of 409", writer.Code)
+	}
+	for _, name := range []string{first, second} {
+		if !strings.Contains(writer.Body.String(), "/api/v1/acquisitions/"+name) {
+			t.Errorf("The error does not mention %s: %s", name, writer.Body.String())
+		}
+	}
+	if writer := get("/api/v1/acquisitions/2018-04-06T00:00:00/rawdata"); writer.Code != http.StatusConflict {
+		t.Errorf("Response code for the raw files of an ambiguous time is %d instead of 409", writer.Code)
+	}
+
+	var acq Acquisition
+	writer = get("/api/v1/acquisitions/" + second)
+	if err := json.Unmarshal(writer.Body.Bytes(), &acq); err != nil {
+		t.Fatalf("Invalid JSON (%d): %s", writer.Code, writer.Body.String())
+	}
+	if acq.Directoryname != second || acq.URL != "/api/v1/acquisitions/"+second {
+		t.Errorf("Wrong acquisition: %s", writer.Body.String())
+	}
+
+	// The numeric ID identifies the same acquisition
+	var byID Acquisition
+	writer = get(fmt.Sprintf("/api/v1/acquisitions/%d", acq.ID))
+	if err := json.Unmarshal(writer.Body.Bytes(), &byID); err != nil || byID.Directoryname != second {
+		t.Errorf("Wrong acquisition for ID %d: %s", acq.ID, writer.Body.String())
+	}
+
+	for _, url := range []string{
+		"/api/v1/acquisitions/" + first + "/rawdata/1",
+		"/api/v1/acquisitions/" + second + "/rawdata/1/header",
+		"/api/v1/acquisitions/2018-04-06T00:01:00/files",
+	} {
+		if writer := get(url); writer.Code != http.StatusOK {
+			t.Errorf("Response code for %s is %d", url, writer.Code)
+		}
+	}
+	for _, url := range []string{
+		"/api/v1/acquisitions/9999",
+		"/api/v1/acquisitions/2018-04-06_00.00.00__nothing/rawdata",
+		"/api/v1/acquisitions/2018-04-06T00:05:00/files",
+	} {
+		if writer := get(url); writer.Code != http.StatusNotFound {
+			t.Errorf("Response code for %s is %d instead of 404", url, writer.Code)
+		}
+	}
+
+	// Every acquisition in the list has its own URL
+	var acqs []Acquisition
+	writer = get("/api/v1/acquisitions")
+	if err := json.Unmarshal(writer.Body.Bytes(), &acqs); err != nil || len(acqs) != 3 {
+		t.Fatalf("Wrong list of acquisitions: %s", writer.Body.String())
+	}
+	urls := map[string]bool{}
+	for _, acq := range acqs {
+		urls[acq.URL] = true
+	}
+	if len(urls) != 3 {
+		t.Errorf("URLs are not unique: %v", urls)
+	}
+}
+
+// archiveNames returns the names of the files in a ZIP or tar archive, with
+// an optional gzip compression
+func archiveNames(t *testing.T, format string, body []byte) map[string]bool {
+	names := map[string]bool{}
+	if format == "zip" {
+		archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("Invalid ZIP archive: %s", err)
+		}
+		for _, f := range archive.File {
+			names[f.Name] = true
+		}
+		return names
+	}
+
+	var reader io.Reader = bytes.NewReader(body)
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			t.Fatalf("Invalid gzip stream: %s", err)
+		}
+		reader = gz
+	}
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Invalid tar archive: %s", err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			t.Fatalf("Unable to read %s from the tar archive: %s", header.Name, err)
+		}
+		names[header.Name] = true
+	}
+	return names
+}
+
+// readArchiveManifest decodes the file "name" in a ZIP archive into "manifest"
+func readArchiveManifest(t *testing.T, body []byte, name string, manifest interface{}) {
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Invalid ZIP archive: %s", err)
+	}
+
+	f, err := archive.Open(name)
+	if err != nil {
+		t.Fatalf("Unable to open %s in the archive: %s", name, err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(manifest); err != nil {
+		t.Fatalf("Invalid manifest %s: %s", name, err)
+	}
+}
+
+func TestArchiveFormats(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"
+	copyTestAcquisition(t, filepath.Join(repository, dirname),
+		"Raws/raw-asic1-2022.04.05.155404.fits",
+		"Raws/raw-asic2-2022.04.05.155404.fits",
+		"Sums/science-asic1-2022.04.05.155404.fits",
+		"Sums/science-asic2-2022.04.05.155404.fits",
+		"Hks/conf-asics-2022.04.05.155407.fits")
+	_, router := newTestApp(t, repository)
+
+	const url = "/api/v1/acquisitions/2022-04-05T15:54:04/archive"
+	// RefreshDbContents puts acquisitions in the repository "default"
+	const root = "default"
+	raw1 := root + "/Raws/raw-asic1-2022.04.05.155404.fits"
+	raw2 := root + "/Raws/raw-asic2-2022.04.05.155404.fits"
+	sum1 := root + "/Sums/science-asic1-2022.04.05.155404.fits"
+	sum2 := root + "/Sums/science-asic2-2022.04.05.155404.fits"
+	hk := root + "/Hks/conf-asics-2022.04.05.155407.fits"
+
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		request, _ := http.NewRequest("GET", url+"?format="+format, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		if writer.Code != http.StatusOK {
+			t.Fatalf("Unable to download the %s archive (%d): %s", format, writer.Code, writer.Body.String())
+		}
+
+		expected := fmt.Sprintf("attachment; filename=\"%s.%s\"", dirname, format)
+		if value := writer.Header().Get("Content-Disposition"); value != expected {
+			t.Errorf("Wrong Content-Disposition for %s: %q", format, value)
+		}
+
+		names := archiveNames(t, format, writer.Body.Bytes())
+		for _, name := range []string{root + "/", raw1, raw2, sum1, hk} {
+			if !names[name] {
+				t.Errorf("File %s is not in the %s archive", name, format)
+			}
+		}
+	}
+
+	for query, expected := range map[string][]string{
+		"?content=hk":              {hk},
+		"?content=raw,sum&asic=1":  {raw1, sum1},
+		"?content=raw&asic=2":      {raw2},
+		"?asic=1&format=tar":       {raw1, sum1, hk},
+		"?content=sum,hk&asic=1,2": {sum1, sum2, hk},
+	} {
+		request, _ := http.NewRequest("GET", url+query, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		if writer.Code != http.StatusOK {
+			t.Fatalf("Unable to download the archive for %q (%d): %s", query, writer.Code, writer.Body.String())
+		}
+
+		format := "zip"
+		if strings.Contains(query, "format=tar") {
+			format = "tar"
+		}
+		names := archiveNames(t, format, writer.Body.Bytes())
+		for _, name := range expected {
+			if !names[name] {
+				t.Errorf("File %s is not in the archive for %q", name, query)
+			}
+		}
+		if !names[root+"/manifest.json"] {
+			t.Errorf("The manifest is not in the archive for %q", query)
+		}
+		numOfFiles := 0
+		for name := range names {
+			if !strings.HasSuffix(name, "/") && name != root+"/manifest.json" {
+				numOfFiles++
+			}
+		}
+		if numOfFiles != len(expected) {
+			t.Errorf("Wrong number of files in the archive for %q: %v", query, names)
+		}
+	}
+
+	// The manifest describes only the files in the archive
+	request, _ := http.NewRequest("GET", url+"?content=raw&asic=2", nil)
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	var manifest BundleManifest
+	readArchiveManifest(t, writer.Body.Bytes(), root+"/manifest.json", &manifest)
+	contents, _ := os.ReadFile(filepath.Join(repository, dirname, "Raws/raw-asic2-2022.04.05.155404.fits"))
+	hash := sha256.Sum256(contents)
+	if manifest.QuteDBVersion != QuteDBVersion || len(manifest.Acquisitions) != 1 {
+		t.Fatalf("Wrong manifest: %s", writer.Body.String())
+	}
+	if acq := manifest.Acquisitions[0]; acq.AcquisitionTime != "2022-04-05T15:54:04" || len(acq.Files) != 1 {
+		t.Fatalf("Wrong acquisition in the manifest: %v", acq)
+	}
+	if file := manifest.Acquisitions[0].Files[0]; file.Kind != "raw" || file.AsicNumber != 2 ||
+		file.FileName != raw2 || file.Size != int64(len(contents)) ||
+		file.Sha256 != hex.EncodeToString(hash[:]) {
+		t.Errorf("Wrong file in the manifest: %v", file)
+	}
+
+	for _, query := range []string{"?format=rar", "?content=foo", "?asic=0", "?asic=x"} {
+		request, _ := http.NewRequest("GET", url+query, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		if writer.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %q is %d instead of 400", query, writer.Code)
+		}
+		if writer.Header().Get("Content-Disposition") != "" {
+			t.Errorf("Response for %q is sent as a file", query)
+		}
+	}
+}
+
+func TestMultipleBundle(t *testing.T) {
+	repository := t.TempDir()
+	createSyntheticRepository(t, repository, 3)
+	testApp, router := newTestApp(t, repository)
+	testApp.config = &Configuration{}
+
+	send := func(query string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", "/api/v1/archive"+query, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+
+	// Acquisitions can be identified by time or folder name, and those
+	// listed twice are put in the archive once
+	const query = "?acquisition=2018-04-06T00:02:00,2018-04-06_00.00.00__synthetic&acquisition=2018-04-06T00:00:00"
+	writer := send(query)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Unable to download the archive (%d): %s", writer.Code, writer.Body.String())
+	}
+	if value := writer.Header().Get("Content-Disposition"); value != `attachment; filename="acquisitions.zip"` {
+		t.Errorf("Wrong Content-Disposition: %q", value)
+	}
+
+	names := archiveNames(t, "zip", writer.Body.Bytes())
+	for _, name := range []string{
+		"2018-04-06_00.00.00__synthetic/Raws/raw-asic1-2018.04.06.142047.fits",
+		"2018-04-06_00.00.00__synthetic/Hks/conf-asics-2018.04.06.142036.fits",
+		"2018-04-06_00.02.00__synthetic/Raws/raw-asic1-2018.04.06.142047.fits",
+	} {
+		if !names[name] {
+			t.Errorf("File %s is not in the archive", name)
+		}
+	}
+	if names["2018-04-06_00.01.00__synthetic/"] {
+		t.Errorf("The archive contains an acquisition that has not been selected")
+	}
+
+	var manifest BundleManifest
+	readArchiveManifest(t, writer.Body.Bytes(), "manifest.json", &manifest)
+	if len(manifest.Acquisitions) != 2 ||
+		manifest.Acquisitions[1].Directoryname != "2018-04-06_00.02.00__synthetic" {
+		t.Errorf("Wrong acquisitions in the manifest: %v", manifest.Acquisitions)
+	}
+
+	// The parameters of the other archives work here too
+	names = archiveNames(t, "tar", send(query+"&format=tar&content=hk").Body.Bytes())
+	if !names["2018-04-06_00.02.00__synthetic/Hks/conf-asics-2018.04.06.142036.fits"] ||
+		names["2018-04-06_00.02.00__synthetic/Raws/raw-asic1-2018.04.06.142047.fits"] {
+		t.Errorf("Wrong contents of the tar archive: %v", names)
+	}
+
+	for q, code := range map[string]int{
+		"":                                      http.StatusBadRequest,
+		"?acquisition=":                         http.StatusBadRequest,
+		"?acquisition=nonexistent":              http.StatusNotFound,
+		"?acquisition=2018-04-06T00:00:00,9999": http.StatusNotFound,
+	} {
+		if writer := send(q); writer.Code != code {
+			t.Errorf("Response code for %q is %d instead of %d", q, writer.Code, code)
+		}
+	}
+
+	// Check the limit on the size of the archive, computed using the sizes
+	// recorded in the database
+	var size int64
+	var raws []RawDataFile
+	testApp.db.Find(&raws)
+	for _, raw := range raws {
+		size += raw.Size
+	}
+	testApp.config.MaxBundleSize = size - 1
+	writer = send("?acquisition=2018-04-06T00:00:00,2018-04-06T00:01:00,2018-04-06T00:02:00&content=raw")
+	if writer.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Response code is %d instead of 413 for an archive that is too large", writer.Code)
+	}
+	if writer.Header().Get("Content-Disposition") != "" {
+		t.Errorf("An archive that is too large is sent as a file")
+	}
+	if writer := send("?acquisition=2018-04-06T00:00:00&content=raw"); writer.Code != http.StatusOK {
+		t.Errorf("Response code is %d instead of 200 for an archive within the limit", writer.Code)
+	}
+
+	testApp.config.MaxBundleSize = 0
+	writer = send("?acquisition=2018-04-06T00:00:00,2018-04-06T00:01:00,2018-04-06T00:02:00&content=raw")
+	if writer.Code != http.StatusOK {
+		t.Errorf("Response code is %d instead of 200 when there is no limit", writer.Code)
+	}
+}
+
+// writeScienceFile creates a science file with "numOfRows" rows, one every
+// second starting from 2022-04-05T15:54:04
+func writeScienceFile(t *testing.T, fileName string, numOfRows int) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("Unable to create %s: %s", fileName, err)
+	}
+	defer f.Close()
+
+	fits, err := fitsio.Create(f)
+	if err != nil {
+		t.Fatalf("Unable to create FITS file: %s", err)
+	}
+	primary, _ := fitsio.NewPrimaryHDU(nil)
+	if err := fits.Write(primary); err != nil {
+		t.Fatalf("Unable to write the primary HDU: %s", err)
+	}
+
+	table, err := fitsio.NewTable("ASIC_SUMS", []fitsio.Column{
+		{Name: "ComputerDate", Format: "1K", Unit: "ms since 1970-01-01T00:00:00", Bscale: 1},
+		{Name: "NbSamplesPerSum", Format: "1I", Bscale: 1, Bzero: 32768},
+		{Name: "pixel1", Format: "1J", Unit: "ADU", Bscale: 1},
+		{Name: "pixel2", Format: "1J", Unit: "ADU", Bscale: 1},
+	}, fitsio.BINARY_TBL)
+	if err != nil {
+		t.Fatalf("Unable to create table: %s", err)
+	}
+	table.Header().Append(
+		fitsio.Card{Name: "INSTRUME", Value: "QUBIC"},
+		fitsio.Card{Name: "ASIC_NUM", Value: 1, Comment: "ASIC NUM"},
+	)
+
+	start := time.Date(2022, 4, 5, 15, 54, 4, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	for i := 0; i < numOfRows; i++ {
+		timeMs := start + int64(i)*1000
+		samples := int16(i)
+		pixel1, pixel2 := int32(100+i), int32(200+i)
+		if err := table.Write(&timeMs, &samples, &pixel1, &pixel2); err != nil {
+			t.Fatalf("Unable to write row %d: %s", i, err)
+		}
+	}
+	if err := fits.Write(table); err != nil {
+		t.Fatalf("Unable to write the table: %s", err)
+	}
+	if err := fits.Close(); err != nil {
+		t.Fatalf("Unable to close the FITS file: %s", err)
+	}
+}
+
+func TestFitsSubset(t *testing.T) {
+	repository := t.TempDir()
+
+	const dirname = "2022-04-05_15.54.04__subset"
+	writeScienceFile(t, filepath.Join(repository, dirname, "Sums/science-asic1-2022.04.05.155404.fits"), 10)
+	copyTestAcquisition(t, filepath.Join(repository, "2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant"),
+		"Raws/raw-asic1-2022.04.05.155404.fits")
+	_, router := newTestApp(t, repository)
+
+	send := func(url string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+
+	const url = "/api/v1/acquisitions/" + dirname + "/sumdata/1/subset"
+	writer := send(url + "?first_row=2&last_row=7&end=2022-04-05T15:54:10&column=ComputerDate,pixel2,NbSamplesPerSum")
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Unable to download the subset (%d): %s", writer.Code, writer.Body.String())
+	}
+	if value := writer.Header().Get("Content-Disposition"); value != `attachment; filename="science-asic1-2022.04.05.155404-subset.fits"` {
+		t.Errorf("Wrong Content-Disposition: %q", value)
+	}
+
+	f, err := fitsio.Open(writer.Body)
+	if err != nil {
+		t.Fatalf("Invalid FITS file: %s", err)
+	}
+	defer f.Close()
+	if len(f.HDUs()) != 2 {
+		t.Fatalf("Wrong number of HDUs: %d", len(f.HDUs()))
+	}
+	table, ok := f.HDU(1).(*fitsio.Table)
+	if !ok || table.Name() != "ASIC_SUMS" {
+		t.Fatalf("The second HDU is not the table ASIC_SUMS")
+	}
+
+	// Rows 2-7 are requested, but the time range excludes rows 7
+	if table.NumRows() != 5 || table.NumCols() != 3 {
+		t.Fatalf("Wrong size of the table: %d rows, %d columns", table.NumRows(), table.NumCols())
+	}
+	for i, name := range []string{"ComputerDate", "pixel2", "NbSamplesPerSum"} {
+		if table.Col(i).Name != name {
+			t.Errorf("Column %d is %q instead of %q", i, table.Col(i).Name, name)
+		}
+	}
+	if table.Col(1).Unit != "ADU" || table.Col(2).Bzero != 32768 {
+		t.Errorf("The units and scaling of the columns have not been preserved")
+	}
+
+	rows, err := table.Read(0, table.NumRows())
+	if err != nil {
+		t.Fatalf("Unable to read the table: %s", err)
+	}
+	row := 2
+	for rows.Next() {
+		var timeMs int64
+		var pixel2 int32
+		var samples int16
+		if err := rows.Scan(&timeMs, &pixel2, &samples); err != nil {
+			t.Fatalf("Unable to read row: %s", err)
+		}
+		if pixel2 != int32(200+row) || samples != int16(row) {
+			t.Errorf("Wrong values in row %d: %d, %d", row, pixel2, samples)
+		}
+		row++
+	}
+	rows.Close()
+
+	header := table.Header()
+	for key, expected := range map[string]interface{}{
+		"INSTRUME": "QUBIC",
+		"ASIC_NUM": 1,
+		"QDBVERS":  QuteDBVersion,
+		"QDBSRC":   "science-asic1-2022.04.05.155404.fits",
+		"QDBNROWS": 10,
+		"QDBFROW":  2,
+		"QDBLROW":  7,
+		"QDBTEND":  int(time.Date(2022, 4, 5, 15, 54, 10, 0, time.UTC).UnixNano() / int64(time.Millisecond)),
+	} {
+		card := header.Get(key)
+		if card == nil {
+			t.Errorf("Keyword %s is missing", key)
+		} else if card.Value != expected {
+			t.Errorf("Wrong value for %s: %v (%T) instead of %v", key, card.Value, card.Value, expected)
+		}
+	}
+	if card := header.Get("QDBTSTA"); card != nil {
+		t.Errorf("QDBTSTA should not be present, as no start time was requested")
+	}
+
+	// Without parameters, the whole table is returned
+	f, err = fitsio.Open(send(url).Body)
+	if err != nil {
+		t.Fatalf("Invalid FITS file: %s", err)
+	}
+	if table := f.HDU(1).(*fitsio.Table); table.NumRows() != 10 || table.NumCols() != 4 {
+		t.Errorf("Wrong size of the whole table: %d rows, %d columns", table.NumRows(), table.NumCols())
+	}
+	f.Close()
+
+	// Equivalent parameters give the same entity tag, which can be used in
+	// conditional requests
+	etag := send(url).Header().Get("ETag")
+	if etag == "" || send(url+"?first_row=0").Header().Get("ETag") != etag {
+		t.Errorf("Wrong ETag for equivalent subsets: %q", etag)
+	}
+	if send(url+"?first_row=1").Header().Get("ETag") == etag {
+		t.Errorf("Different subsets have the same ETag")
+	}
+	request, _ := http.NewRequest("GET", url, nil)
+	request.Header.Set("If-None-Match", etag)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	if writer.Code != http.StatusNotModified {
+		t.Errorf("Response code for a matching If-None-Match is %d instead of 304", writer.Code)
+	}
+
+	// Raw files work in the same way
+	writer = send("/api/v1/acquisitions/2022-04-05_15.54.04__Test-CalibrationSource-Timeconstant/rawdata/1/subset?column=pixelNum,Raw")
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Unable to download the subset of the raw file (%d): %s", writer.Code, writer.Body.String())
+	}
+	f, err = fitsio.Open(writer.Body)
+	if err != nil {
+		t.Fatalf("Invalid FITS file: %s", err)
+	}
+	if table := f.HDU(1).(*fitsio.Table); table.NumRows() != 1 || table.NumCols() != 2 ||
+		table.Header().Get("FILETYPE") == nil {
+		t.Errorf("Wrong subset of the raw file")
+	}
+	f.Close()
+
+	for query, code := range map[string]int{
+		"?column=foo":             http.StatusBadRequest,
+		"?first_row=5&last_row=2": http.StatusBadRequest,
+		"?first_row=-1":           http.StatusBadRequest,
+		"?last_row=x":             http.StatusBadRequest,
+		"?start=yesterday":        http.StatusBadRequest,
+		"?hdu=3":                  http.StatusBadRequest,
+		"?first_row=20":           http.StatusOK,
+	} {
+		if writer := send(url + query); writer.Code != code {
+			t.Errorf("Response code for %q is %d instead of %d: %s", query, writer.Code, code, writer.Body.String())
+		}
+	}
+	if writer := send("/api/v1/acquisitions/" + dirname + "/sumdata/2/subset"); writer.Code != http.StatusNotFound {
+		t.Errorf("Response code for a missing ASIC is %d instead of 404", writer.Code)
+	}
+}
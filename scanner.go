@@ -0,0 +1,801 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that scans the acquisition folders in the
+// repository. Folders are read concurrently, while the database is updated by
+// one goroutine only.
+
+package qutedb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultScanWorkers is the number of goroutines used by RefreshDbContents to
+// scan the acquisition folders. Scanning is mostly limited by the speed of
+// the storage, so it is worth using more goroutines than CPUs.
+const DefaultScanWorkers = 4
+
+// scanBatchSize is the number of folders whose changes are saved in the
+// database within the same transaction
+const scanBatchSize = 50
+
+// scanWindowPerWorker is the number of folders per worker that can be
+// scanned ahead of the first folder whose changes have not been saved yet
+const scanWindowPerWorker = 4
+
+// A folderScan contains what has been found in an acquisition folder. It is
+// produced by scanFolder, which only reads the filesystem and can therefore
+// be run concurrently, and it is saved in the database by apply.
+type folderScan struct {
+	repository string
+	folderPath string
+	changes    FolderChanges
+
+	// The acquisition as it is in the database, or a new one if the folder
+	// has never been scanned before
+	acq Acquisition
+
+	newRawFiles   []RawDataFile
+	newSumFiles   []SumDataFile
+	newDataFiles  []DataFile
+	newHkChannels []HkChannel
+	legacyUpdates map[string]interface{}
+
+	// Files of kinds that allow only one file per acquisition, which are no
+	// longer in the folder and have been replaced by other files
+	replacedDataFiles []DataFile
+}
+
+// scanFolder reads the contents of the acquisition folder "folderPath", which
+// belongs to the repository named "repository", and looks for the files that
+// are not yet in the database. If the acquisition is already in the database,
+// "known" must contain it together with its raw, science and data files, and
+// "hasHkChannels" must tell if its housekeeping channels have already been
+// loaded. The function does not modify "known", and it does not check whether
+// "folderPath" is really within the repository or not. Folders that cannot be
+// ingested are marked as skipped, and the reason is recorded in the changes.
+func scanFolder(
+	repository string,
+	folderPath string,
+	known *Acquisition,
+	hasHkChannels bool,
+	fileKinds []FileKind,
+) *folderScan {
+	dirname := filepath.Base(folderPath)
+	scan := folderScan{
+		repository:    repository,
+		folderPath:    folderPath,
+		changes:       FolderChanges{Directoryname: dirname},
+		legacyUpdates: map[string]interface{}{},
+	}
+	changes := &scan.changes
+
+	name, acquisitionTime, err := parseFolderName(dirname)
+	if err != nil {
+		changes.skip(folderPath, "%s", err)
+		return &scan
+	}
+
+	listing := checkFolder(changes, folderPath, fileKinds)
+	if changes.Skipped {
+		return &scan
+	}
+
+	if known == nil {
+		changes.NewAcquisition = true
+		scan.acq = Acquisition{
+			Name:            name,
+			Directoryname:   dirname,
+			Repository:      repository,
+			FolderPath:      folderPath,
+			AcquisitionTime: TimeToCanonicalStr(acquisitionTime),
+		}
+	} else {
+		scan.acq = *known
+		// Files might be replaced below, and "known" must not be modified
+		scan.acq.Files = append([]DataFile(nil), known.Files...)
+	}
+	acq := &scan.acq
+
+	knownFiles := map[string]bool{}
+	knownKinds := map[string]*DataFile{}
+	for _, raw := range acq.RawFiles {
+		knownFiles[raw.FileName] = true
+	}
+	for _, sum := range acq.SumFiles {
+		knownFiles[sum.FileName] = true
+	}
+	for i, file := range acq.Files {
+		knownFiles[file.FileName] = true
+		knownKinds[file.Kind] = &acq.Files[i]
+	}
+
+	// Check for the presence of files that are not yet known
+	for _, kind := range fileKinds {
+		dir := path.Join(folderPath, kind.Directory)
+
+		var filenames []string
+		var recorded *DataFile
+		if kind.Multiple {
+			filenames = listing.match(dir, kind.Mask)
+		} else if recorded = knownKinds[kind.Name]; recorded == nil || !fileExists(recorded.FileName) {
+			if filename := findOneMatchingFile(changes, listing, dir, kind.Mask); filename != "" {
+				filenames = []string{filename}
+			}
+		}
+
+		for _, filename := range filenames {
+			if knownFiles[filename] {
+				continue
+			}
+
+			info, err := computeFileInfo(filename)
+			if err != nil {
+				changes.warn(filename, "Unable to read the file: %s", err)
+				continue
+			}
+
+			// The file that is no longer in the folder is removed from the
+			// database instead of being flagged as missing
+			if recorded != nil {
+				changes.warn(filename, "The file replaces %q, which is no longer in the folder",
+					filepath.Base(recorded.FileName))
+				scan.replacedDataFiles = append(scan.replacedDataFiles, *recorded)
+				if legacy, ok := legacyFileFields[kind.Name]; ok && *legacy.field(acq) == recorded.FileName {
+					*legacy.field(acq) = ""
+				}
+			}
+
+			changes.NewDataFiles = append(changes.NewDataFiles, filename)
+			scan.newDataFiles = append(scan.newDataFiles, DataFile{
+				Kind:     kind.Name,
+				FileName: filename,
+				FileInfo: info,
+				Hdus:     loadFitsHeaders(filename),
+			})
+
+			if legacy, ok := legacyFileFields[kind.Name]; ok && *legacy.field(acq) == "" {
+				*legacy.field(acq) = filename
+				scan.legacyUpdates[legacy.column] = filename
+			}
+		}
+	}
+
+	if len(scan.replacedDataFiles) > 0 {
+		replaced := map[int]bool{}
+		for _, file := range scan.replacedDataFiles {
+			replaced[file.ID] = true
+		}
+
+		files := acq.Files[:0]
+		for _, file := range acq.Files {
+			if !replaced[file.ID] {
+				files = append(files, file)
+			}
+		}
+		acq.Files = files
+	}
+
+	// The description of the housekeeping channels might have been copied
+	// after the acquisition was added to the database
+	if !hasHkChannels {
+		scan.newHkChannels = loadHkChannels(folderPath)
+		changes.NewHkChannels = len(scan.newHkChannels)
+	}
+
+	rawFiles, asicNumbers := findAsicFiles(changes, listing, RawDirName(folderPath), rawFileMask)
+	for i, filename := range rawFiles {
+		if knownFiles[filename] {
+			continue
+		}
+
+		info, err := computeFileInfo(filename)
+		if err != nil {
+			changes.warn(filename, "Unable to read the file: %s", err)
+			continue
+		}
+
+		scan.newRawFiles = append(scan.newRawFiles, RawDataFile{
+			FileName:   filename,
+			AsicNumber: asicNumbers[i],
+			FileInfo:   info,
+			Hdus:       loadFitsHeaders(filename),
+		})
+		changes.NewRawFiles = append(changes.NewRawFiles, filename)
+	}
+
+	sumFiles, asicNumbers := findAsicFiles(changes, listing, SumDirName(folderPath), sumFileMask)
+	for i, filename := range sumFiles {
+		if knownFiles[filename] {
+			continue
+		}
+
+		info, err := computeFileInfo(filename)
+		if err != nil {
+			changes.warn(filename, "Unable to read the file: %s", err)
+			continue
+		}
+
+		scan.newSumFiles = append(scan.newSumFiles, SumDataFile{
+			FileName:   filename,
+			AsicNumber: asicNumbers[i],
+			FileInfo:   info,
+			Hdus:       loadFitsHeaders(filename),
+		})
+		changes.NewSumFiles = append(changes.NewSumFiles, filename)
+	}
+
+	return &scan
+}
+
+// apply saves the result of the scan in the database. It should be called
+// within a transaction. Skipped folders are ignored, so an error is returned
+// only if the database cannot be updated.
+func (scan *folderScan) apply(db *gorm.DB) error {
+	changes := &scan.changes
+	if changes.Skipped {
+		return nil
+	}
+
+	acq := &scan.acq
+	if changes.NewAcquisition {
+		acq.RawFiles = scan.newRawFiles
+		acq.SumFiles = scan.newSumFiles
+		acq.Files = scan.newDataFiles
+		acq.HkChannels = scan.newHkChannels
+
+		log.WithFields(log.Fields{
+			"directory_name":    acq.Directoryname,
+			"num_of_raw_files":  len(acq.RawFiles),
+			"num_of_sum_files":  len(acq.SumFiles),
+			"num_of_data_files": len(acq.Files),
+		}).Info("Going to create new acquisition")
+
+		campaign, err := campaignByRules(db, acq)
+		if err != nil {
+			return err
+		}
+		acq.Campaign = campaign
+
+		if err := db.Create(acq).Error; err != nil {
+			return fmt.Errorf("Error while creating a new acquisition for \"%s\": %s",
+				scan.folderPath, err)
+		}
+
+		return nil
+	}
+
+	// The folder might have been moved within the repository, or to another
+	// repository
+	if acq.FolderPath != scan.folderPath || acq.Repository != scan.repository {
+		acq.FolderPath = scan.folderPath
+		acq.Repository = scan.repository
+		if err := db.Model(acq).UpdateColumns(map[string]interface{}{
+			"folder_path": scan.folderPath,
+			"repository":  scan.repository,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if changes.MissingFiles, err = updateMissingFlags(db, acq); err != nil {
+		return err
+	}
+
+	if err := fillMissingFileInfo(db, acq); err != nil {
+		return err
+	}
+
+	if changes.IsEmpty() {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"changes": changes,
+	}).Info("Going to update an existing acquisition")
+
+	err = func() error {
+		if len(scan.legacyUpdates) > 0 {
+			if err := db.Model(acq).Updates(scan.legacyUpdates).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, raw := range scan.newRawFiles {
+			raw.AcquisitionID = int(acq.ID)
+			if err := db.Create(&raw).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, sum := range scan.newSumFiles {
+			sum.AcquisitionID = int(acq.ID)
+			if err := db.Create(&sum).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, file := range scan.replacedDataFiles {
+			if err := db.Delete(&file).Error; err != nil {
+				return err
+			}
+		}
+		if len(scan.replacedDataFiles) > 0 {
+			if err := deleteOrphanHeaders(db); err != nil {
+				return err
+			}
+		}
+
+		for _, file := range scan.newDataFiles {
+			file.AcquisitionID = int(acq.ID)
+			if err := db.Create(&file).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, channel := range scan.newHkChannels {
+			channel.AcquisitionID = int(acq.ID)
+			if err := db.Create(&channel).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}()
+	if err != nil {
+		return fmt.Errorf("Error while updating the acquisition for \"%s\": %s",
+			scan.folderPath, err)
+	}
+
+	return nil
+}
+
+// An acquisitionFolder is a folder found while walking a repository
+type acquisitionFolder struct {
+	repository string
+	path       string
+}
+
+// findAcquisitionFolders walks the repositories and returns the acquisition
+// folders. Problems found while walking the repositories are recorded in
+// "report". Repositories that cannot be read are skipped, and an error is
+// returned only if none of them can be read.
+func findAcquisitionFolders(repositories []Repository, report *IngestionReport) ([]acquisitionFolder, error) {
+	var folders []acquisitionFolder
+	seenNames := map[string]string{}
+	var lastErr error
+	numOfFailures := 0
+	for _, repo := range repositories {
+		err := filepath.Walk(repo.Path, func(
+			path string,
+			info os.FileInfo,
+			err error,
+		) error {
+			if err != nil {
+				if path == repo.Path {
+					return err
+				}
+
+				// Do not stop the scan because of a directory that cannot be read
+				report.addProblem(IngestionProblem{
+					Path:     path,
+					Severity: severityError,
+					Message:  fmt.Sprintf("Unable to read the directory: %s", err),
+				})
+				return nil
+			}
+
+			log.WithFields(log.Fields{
+				"folder_name": path,
+			}).Debug("Walking into directory")
+
+			if !info.IsDir() {
+				return nil
+			}
+
+			if isAcquisitionFolder(path) {
+				// Acquisitions are identified by the name of their folder,
+				// even if they are in different repositories
+				if other, ok := seenNames[info.Name()]; ok {
+					report.NumOfFolders++
+					report.NumOfSkippedFolders++
+					report.addProblem(IngestionProblem{
+						Path:     path,
+						Severity: severityError,
+						Message:  fmt.Sprintf("The folder has the same name as %q", other),
+					})
+					return filepath.SkipDir
+				}
+				seenNames[info.Name()] = path
+				folders = append(folders, acquisitionFolder{repository: repo.Name, path: path})
+
+				// Acquisition folders are scanned by scanFolder, so don't
+				// walk into them
+				return filepath.SkipDir
+			}
+
+			if looksLikeAcquisitionFolder(path) {
+				report.addProblem(IngestionProblem{
+					Path:     path,
+					Severity: severityWarning,
+					Message: fmt.Sprintf("The name of the folder does not match the pattern %q",
+						acquisitionFolderMask),
+				})
+			}
+
+			return nil
+		})
+		if err != nil {
+			report.addProblem(IngestionProblem{
+				Path:     repo.Path,
+				Severity: severityError,
+				Message:  fmt.Sprintf("Unable to read repository %q: %s", repo.Name, err),
+			})
+			lastErr = err
+			numOfFailures++
+		}
+	}
+
+	if numOfFailures == len(repositories) {
+		return nil, lastErr
+	}
+
+	return folders, nil
+}
+
+// loadKnownAcquisitions returns all the acquisitions in the database,
+// together with their raw, science and data files, indexed by the name of
+// their folder. The second result contains the IDs of the acquisitions whose
+// housekeeping channels have already been loaded.
+func loadKnownAcquisitions(db *gorm.DB) (map[string]*Acquisition, map[uint]bool, error) {
+	var acqList []Acquisition
+	if err := db.
+		Preload("RawFiles").
+		Preload("SumFiles").
+		Preload("Files").
+		Find(&acqList).Error; err != nil {
+		return nil, nil, err
+	}
+
+	known := make(map[string]*Acquisition, len(acqList))
+	for i := range acqList {
+		known[acqList[i].Directoryname] = &acqList[i]
+	}
+
+	var ids []uint
+	if err := db.Model(&HkChannel{}).Pluck("DISTINCT acquisition_id", &ids).Error; err != nil {
+		return nil, nil, err
+	}
+
+	hasHkChannels := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		hasHkChannels[id] = true
+	}
+
+	return known, hasHkChannels, nil
+}
+
+// ScanStatus describes the state of the scan of the repository
+type ScanStatus struct {
+	Running bool `json:"running"`
+	// Number of acquisition folders found in the repository, and number of
+	// folders that have already been scanned
+	NumOfFolders        int `json:"num_of_folders"`
+	NumOfScannedFolders int `json:"num_of_scanned_folders"`
+	// Number of folders and directories that could not be ingested
+	NumOfErrors int `json:"num_of_errors"`
+	// Error that stopped the scan, if any
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// ID of the ingestion report produced by the scan, once it is complete
+	ReportID uint `json:"report_id,omitempty"`
+}
+
+// A ScanProgress keeps track of the progress of a scan of the repository, so
+// that it can be queried while the scan is running. It is safe to use it
+// from several goroutines, and a nil *ScanProgress is valid and does nothing.
+type ScanProgress struct {
+	mutex  sync.Mutex
+	status ScanStatus
+}
+
+// Status returns a copy of the current state of the scan
+func (progress *ScanProgress) Status() ScanStatus {
+	if progress == nil {
+		return ScanStatus{}
+	}
+
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	return progress.status
+}
+
+// start resets the state at the beginning of a new scan
+func (progress *ScanProgress) start(startedAt time.Time) {
+	if progress == nil {
+		return
+	}
+
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.status = ScanStatus{
+		Running:   true,
+		StartedAt: &startedAt,
+	}
+}
+
+// foldersFound records how many acquisition folders are going to be scanned
+// and how many errors have been found while walking the repository
+func (progress *ScanProgress) foldersFound(numOfFolders int, numOfErrors int) {
+	if progress == nil {
+		return
+	}
+
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.status.NumOfFolders = numOfFolders
+	progress.status.NumOfErrors = numOfErrors
+}
+
+// folderScanned records that a folder has been scanned
+func (progress *ScanProgress) folderScanned(changes *FolderChanges) {
+	if progress == nil {
+		return
+	}
+
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.status.NumOfScannedFolders++
+	if changes.Skipped {
+		progress.status.NumOfErrors++
+	}
+}
+
+// finish records the end of the scan. "err" is the error that stopped the
+// scan, or nil if the scan was completed.
+func (progress *ScanProgress) finish(report *IngestionReport, err error) {
+	if progress == nil {
+		return
+	}
+
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	finishedAt := time.Now().UTC()
+	progress.status.Running = false
+	progress.status.FinishedAt = &finishedAt
+	progress.status.ReportID = report.ID
+	if err != nil {
+		progress.status.Error = err.Error()
+	}
+}
+
+// numOfErrors returns the number of problems in the report that prevented a
+// folder or a directory from being ingested
+func (report *IngestionReport) numOfErrors() int {
+	result := 0
+	for _, problem := range report.Problems {
+		if problem.Severity == severityError {
+			result++
+		}
+	}
+
+	return result
+}
+
+// ScanRepositories works like RefreshDbContents, but it scans all the
+// repositories in "repositories" and uses "numOfWorkers" goroutines to scan
+// the acquisition folders. The database is updated by the calling goroutine,
+// using one transaction every scanBatchSize folders. If "progress" is not
+// nil, it is updated while the scan runs.
+func ScanRepositories(db *gorm.DB, repositories []Repository, numOfWorkers int, progress *ScanProgress) error {
+	report := IngestionReport{
+		StartedAt: time.Now().UTC(),
+		Trigger:   "scan",
+	}
+
+	progress.start(report.StartedAt)
+	err := scanRepositories(db, repositories, numOfWorkers, &report, progress)
+	progress.finish(&report, err)
+
+	return err
+}
+
+// scanRepositories implements ScanRepositories, saving the result in "report"
+func scanRepositories(
+	db *gorm.DB,
+	repositories []Repository,
+	numOfWorkers int,
+	report *IngestionReport,
+	progress *ScanProgress,
+) error {
+	if numOfWorkers < 1 {
+		numOfWorkers = 1
+	}
+
+	folders, err := findAcquisitionFolders(repositories, report)
+	if err != nil {
+		return err
+	}
+	progress.foldersFound(len(folders), report.numOfErrors())
+
+	fileKinds, err := QueryFileKinds(db)
+	if err != nil {
+		return err
+	}
+
+	known, hasHkChannels, err := loadKnownAcquisitions(db)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"num_of_folders": len(folders),
+		"num_of_workers": numOfWorkers,
+	}).Info("Scanning the acquisition folders")
+
+	// Results are tagged with the index of the folder, so that they can be
+	// applied in the same order as the folders have been found: in this way,
+	// the IDs of new acquisitions do not depend on the order in which the
+	// workers complete their job
+	type scanResult struct {
+		index int
+		scan  *folderScan
+	}
+
+	// A folder can be scanned only if there is room in "window", which is
+	// freed once the changes in the folder are applied. In this way, a slow
+	// folder does not make the results of the next ones pile up in memory.
+	window := make(chan struct{}, numOfWorkers*scanWindowPerWorker)
+	jobs := make(chan int)
+	results := make(chan scanResult)
+	var wg sync.WaitGroup
+	for i := 0; i < numOfWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				folder := folders[index]
+				log.WithFields(log.Fields{
+					"repository":  folder.repository,
+					"folder_name": folder.path,
+				}).Info("Processing folder")
+
+				acq := known[filepath.Base(folder.path)]
+				results <- scanResult{
+					index: index,
+					scan: scanFolder(folder.repository, folder.path, acq,
+						acq != nil && hasHkChannels[acq.ID], fileKinds),
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for index := range folders {
+			window <- struct{}{}
+			jobs <- index
+		}
+		close(jobs)
+
+		wg.Wait()
+		close(results)
+	}()
+
+	seenFolders := map[string]bool{}
+	var batch []*folderScan
+	flush := func() error {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, scan := range batch {
+				if err := scan.apply(tx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, scan := range batch {
+			changes := &scan.changes
+			report.addFolder(changes)
+			if changes.Skipped {
+				continue
+			}
+			seenFolders[changes.Directoryname] = true
+
+			if !changes.IsEmpty() {
+				log.WithFields(log.Fields{
+					"changes": changes,
+				}).Info("Folder has been refreshed")
+			}
+			if len(changes.MissingFiles) > 0 {
+				log.WithFields(log.Fields{
+					"directory_name": changes.Directoryname,
+					"missing_files":  changes.MissingFiles,
+				}).Warning("Some files are no longer present in the repository")
+			}
+		}
+
+		batch = batch[:0]
+		return nil
+	}
+
+	// Results that cannot be applied yet because some folder before them is
+	// still being scanned
+	waiting := map[int]*folderScan{}
+	nextIndex := 0
+	for result := range results {
+		progress.folderScanned(&result.scan.changes)
+
+		waiting[result.index] = result.scan
+		for scan, ok := waiting[nextIndex]; ok; scan, ok = waiting[nextIndex] {
+			delete(waiting, nextIndex)
+			nextIndex++
+			<-window
+
+			// After an error, keep reading the results so that the workers
+			// can terminate
+			if err != nil {
+				continue
+			}
+
+			batch = append(batch, scan)
+			if len(batch) >= scanBatchSize {
+				err = flush()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if err := flagMissingAcquisitions(db, seenFolders); err != nil {
+		return err
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	log.WithFields(log.Fields{
+		"num_of_folders":          report.NumOfFolders,
+		"num_of_new_acquisitions": report.NumOfNewAcquisitions,
+		"num_of_skipped_folders":  report.NumOfSkippedFolders,
+		"num_of_warnings":         report.NumOfWarnings,
+	}).Info("The repository has been scanned")
+
+	return saveIngestionReport(db, report)
+}
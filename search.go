@@ -0,0 +1,133 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file implements the search of acquisitions by the values of the
+// keywords in the headers of their FITS files
+
+package qutedb
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A HeaderPredicate is a condition on the value of a keyword in the header of
+// a FITS file. The field "Operator" can be one of "=", "!=", "<", "<=", ">",
+// ">=" (comparison) and "~" (substring).
+type HeaderPredicate struct {
+	Keyword  string
+	Operator string
+	Value    string
+}
+
+var headerPredicateRegexp = regexp.MustCompile(`^([A-Za-z0-9_-]+)(!=|<=|>=|=|<|>|~)(.*)$`)
+
+// ParseHeaderPredicate parses a string like "ASIC_NUM=1" or "NSAMPLE>=100"
+func ParseHeaderPredicate(str string) (HeaderPredicate, error) {
+	match := headerPredicateRegexp.FindStringSubmatch(str)
+	if match == nil {
+		return HeaderPredicate{}, fmt.Errorf("Invalid condition on header keyword: %q", str)
+	}
+
+	return HeaderPredicate{
+		Keyword:  strings.ToUpper(match[1]),
+		Operator: match[2],
+		Value:    match[3],
+	}, nil
+}
+
+// condition returns the SQL condition on the table "fits_cards" that
+// implements the predicate. Comparisons are numeric if the value in the
+// predicate is a number, and lexicographic otherwise; in the first case,
+// keywords whose value is not a number never match. Substring matches are
+// case-insensitive.
+func (pred HeaderPredicate) condition() (string, []interface{}) {
+	if pred.Operator == "~" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(pred.Value)
+		return `fits_cards.keyword = ? AND fits_cards.value LIKE ? ESCAPE '\'`,
+			[]interface{}{pred.Keyword, "%" + escaped + "%"}
+	}
+
+	if number, err := strconv.ParseFloat(pred.Value, 64); err == nil {
+		return fmt.Sprintf("fits_cards.keyword = ? AND fits_cards.number %s ?", pred.Operator),
+			[]interface{}{pred.Keyword, number}
+	}
+
+	return fmt.Sprintf("fits_cards.keyword = ? AND fits_cards.value %s ?", pred.Operator),
+		[]interface{}{pred.Keyword, pred.Value}
+}
+
+// headerFileTables maps the kinds of files accepted by FilterByHeaders to the
+// tables containing them
+var headerFileTables = map[string]string{
+	"raw": "raw_data_files",
+	"sum": "sum_data_files",
+	"hk":  "data_files",
+}
+
+// FilterByHeaders restricts a query on the table "acquisitions" to those
+// acquisitions that contain at least one file matching each predicate. Each
+// predicate is checked independently, so different predicates can be
+// satisfied by different files. The list "fileKinds" can contain "raw", "sum"
+// and "hk" (any DataFile), and it restricts the search to the corresponding
+// files; if it is empty, all the files are considered.
+func FilterByHeaders(db *gorm.DB, predicates []HeaderPredicate, fileKinds []string) (*gorm.DB, error) {
+	if len(fileKinds) == 0 {
+		fileKinds = []string{"raw", "sum", "hk"}
+	}
+
+	var tables []string
+	for _, kind := range fileKinds {
+		table, ok := headerFileTables[kind]
+		if !ok {
+			return nil, fmt.Errorf("Unknown kind of file: %q", kind)
+		}
+		tables = append(tables, table)
+	}
+
+	for _, pred := range predicates {
+		cond, condArgs := pred.condition()
+
+		var subqueries []string
+		var args []interface{}
+		for _, table := range tables {
+			subqueries = append(subqueries, fmt.Sprintf(`SELECT %[1]s.acquisition_id FROM %[1]s
+				JOIN fits_hdus ON fits_hdus.file_type = '%[1]s' AND fits_hdus.file_id = %[1]s.id
+				JOIN fits_cards ON fits_cards.fits_hdu_id = fits_hdus.id
+				WHERE %[2]s`, table, cond))
+			args = append(args, condArgs...)
+		}
+
+		db = db.Where(
+			fmt.Sprintf("acquisitions.id IN (%s)", strings.Join(subqueries, " UNION ")),
+			args...,
+		)
+	}
+
+	return db, nil
+}
@@ -0,0 +1,171 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file contains the code that lets users attach tags to acquisitions,
+// e.g., "calibration" or "bad-weather"
+
+package qutedb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A Tag is a short label that users can attach to acquisitions. The same tag
+// can be attached to many acquisitions.
+type Tag struct {
+	ID   uint   `json:"-" gorm:"primary_key"`
+	Name string `json:"name" gorm:"unique_index"`
+}
+
+// A TagCount reports how many acquisitions have a tag
+type TagCount struct {
+	Name              string `json:"name"`
+	NumOfAcquisitions int    `json:"num_of_acquisitions"`
+}
+
+// tagNameRe matches valid tag names. Tags are always saved in lowercase.
+var tagNameRe = regexp.MustCompile("^[a-z0-9][-_.a-z0-9]{0,63}$")
+
+// normalizeTagName converts "name" to lowercase and checks that it is a
+// valid tag name
+func normalizeTagName(name string) (string, error) {
+	result := strings.ToLower(strings.TrimSpace(name))
+	if !tagNameRe.MatchString(result) {
+		return "", fmt.Errorf("invalid tag %q: tags must be made of letters, digits, '-', '_' and '.'", name)
+	}
+
+	return result, nil
+}
+
+// AddTag attaches the tag "name" to the acquisition. Nothing happens if the
+// acquisition already has the tag.
+func AddTag(db *gorm.DB, acq *Acquisition, name string) error {
+	name, err := normalizeTagName(name)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var tag Tag
+		if err := tx.Where(Tag{Name: name}).FirstOrCreate(&tag).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(acq).Association("Tags").Append(tag).Error
+	})
+}
+
+// RemoveTag detaches the tag "name" from the acquisition. Tags that are no
+// longer attached to any acquisition are removed from the database.
+func RemoveTag(db *gorm.DB, acq *Acquisition, name string) error {
+	name, err := normalizeTagName(name)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var tag Tag
+		if err := tx.Where("name = ?", name).First(&tag).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+
+		if err := tx.Model(acq).Association("Tags").Delete(tag).Error; err != nil {
+			return err
+		}
+
+		return deleteUnusedTags(tx)
+	})
+}
+
+// deleteUnusedTags removes the tags that are not attached to any acquisition,
+// as well as the links to acquisitions that are no longer in the database
+func deleteUnusedTags(db *gorm.DB) error {
+	if err := db.Exec("DELETE FROM acquisition_tags WHERE acquisition_id NOT IN (?)",
+		db.Table("acquisitions").Select("id").QueryExpr()).Error; err != nil {
+		return err
+	}
+
+	return db.
+		Where("id NOT IN (?)", db.Table("acquisition_tags").Select("tag_id").QueryExpr()).
+		Delete(Tag{}).Error
+}
+
+// preloadTags makes "db" load the tags of the acquisitions, sorted by name
+func preloadTags(db *gorm.DB) *gorm.DB {
+	return db.Preload("Tags", func(db *gorm.DB) *gorm.DB {
+		return db.Order("tags.name")
+	})
+}
+
+// QueryTags returns all the tags in the database, sorted by name, together
+// with the number of acquisitions that have them
+func QueryTags(db *gorm.DB) ([]TagCount, error) {
+	tags := []TagCount{}
+	if err := db.Table("tags").
+		Select("tags.name AS name, COUNT(acquisition_tags.acquisition_id) AS num_of_acquisitions").
+		Joins("JOIN acquisition_tags ON acquisition_tags.tag_id = tags.id").
+		Group("tags.name").
+		Order("tags.name").
+		Scan(&tags).Error; err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// FilterByTags restricts "query" to the acquisitions that have all the tags
+// in "names"
+func FilterByTags(query *gorm.DB, names []string) (*gorm.DB, error) {
+	if len(names) == 0 {
+		return query, nil
+	}
+
+	unique := map[string]bool{}
+	for _, name := range names {
+		tag, err := normalizeTagName(name)
+		if err != nil {
+			return nil, err
+		}
+		unique[tag] = true
+	}
+
+	var tags []string
+	for tag := range unique {
+		tags = append(tags, tag)
+	}
+
+	return query.Where(`acquisitions.id IN (
+		SELECT acquisition_tags.acquisition_id FROM acquisition_tags
+		JOIN tags ON tags.id = acquisition_tags.tag_id
+		WHERE tags.name IN (?)
+		GROUP BY acquisition_tags.acquisition_id
+		HAVING COUNT(*) = ?)`, tags, len(tags)), nil
+}
@@ -0,0 +1,890 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file implements the decompression of FITS files whose images have been
+// compressed using the tiled image convention (e.g., by fpack). Only lossless
+// compression of integer images is supported, using the RICE_1, GZIP_1,
+// GZIP_2, and NOCOMPRESS algorithms.
+//
+// See https://fits.gsfc.nasa.gov/registry/tilecompression.html
+
+package qutedb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	fitsBlockSize = 2880
+	fitsCardSize  = 80
+)
+
+// UnsupportedCompressionError is returned when a compressed image cannot be
+// decompressed by QuTeDB
+type UnsupportedCompressionError struct {
+	Message string
+}
+
+func (e UnsupportedCompressionError) Error() string {
+	return e.Message
+}
+
+func unsupportedCompression(format string, args ...interface{}) error {
+	return UnsupportedCompressionError{fmt.Sprintf(format, args...)}
+}
+
+// A rawFitsHeader is the list of the cards in the header of a HDU, as they
+// appear in the file. The END card is not included.
+type rawFitsHeader []string
+
+// readRawFitsHeader reads the header of the next HDU. It returns io.EOF if
+// there are no more HDUs.
+func readRawFitsHeader(r io.Reader) (rawFitsHeader, error) {
+	var header rawFitsHeader
+	block := make([]byte, fitsBlockSize)
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if err == io.EOF && len(header) == 0 {
+				return nil, io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		for pos := 0; pos < fitsBlockSize; pos += fitsCardSize {
+			card := string(block[pos : pos+fitsCardSize])
+			if strings.TrimRight(card, " ") == "END" {
+				return header, nil
+			}
+			header = append(header, card)
+		}
+	}
+}
+
+// keyword returns the keyword of a card
+func cardKeyword(card string) string {
+	return strings.TrimSpace(card[:8])
+}
+
+// cardValue returns the value of a card as a string. The quotes around
+// strings are removed.
+func cardValue(card string) string {
+	if len(card) < 10 || card[8:10] != "= " {
+		return ""
+	}
+
+	value := strings.TrimSpace(card[10:])
+	if strings.HasPrefix(value, "'") {
+		// Quotes within strings are escaped by doubling them
+		var result strings.Builder
+		for i := 1; i < len(value); i++ {
+			if value[i] == '\'' {
+				if i+1 < len(value) && value[i+1] == '\'' {
+					result.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			result.WriteByte(value[i])
+		}
+		return strings.TrimRight(result.String(), " ")
+	}
+
+	if pos := strings.IndexByte(value, '/'); pos >= 0 {
+		value = value[:pos]
+	}
+	return strings.TrimSpace(value)
+}
+
+// get returns the value of "keyword", and false if the keyword is missing
+func (header rawFitsHeader) get(keyword string) (string, bool) {
+	for _, card := range header {
+		if cardKeyword(card) == keyword {
+			return cardValue(card), true
+		}
+	}
+
+	return "", false
+}
+
+// getInt returns the value of the integer keyword "keyword", or "def" if
+// the keyword is missing
+func (header rawFitsHeader) getInt(keyword string, def int) (int, error) {
+	str, ok := header.get(keyword)
+	if !ok {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for keyword %s", str, keyword)
+	}
+
+	return value, nil
+}
+
+// dataSize returns the number of bytes in the data unit of the HDU, without
+// the padding at the end
+func (header rawFitsHeader) dataSize() (int, error) {
+	bitpix, err := header.getInt("BITPIX", 8)
+	if err != nil {
+		return 0, err
+	}
+
+	naxis, err := header.getInt("NAXIS", 0)
+	if err != nil || naxis == 0 {
+		return 0, err
+	}
+
+	size := 1
+	for i := 1; i <= naxis; i++ {
+		n, err := header.getInt(fmt.Sprintf("NAXIS%d", i), 0)
+		if err != nil {
+			return 0, err
+		}
+		size *= n
+	}
+
+	pcount, err := header.getInt("PCOUNT", 0)
+	if err != nil {
+		return 0, err
+	}
+	gcount, err := header.getInt("GCOUNT", 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if bitpix < 0 {
+		bitpix = -bitpix
+	}
+	return bitpix / 8 * gcount * (pcount + size), nil
+}
+
+// isCompressedImage returns true if the HDU contains a compressed image
+func (header rawFitsHeader) isCompressedImage() bool {
+	xtension, _ := header.get("XTENSION")
+	zimage, _ := header.get("ZIMAGE")
+	return xtension == "BINTABLE" && zimage == "T"
+}
+
+// paddedSize rounds "size" to the next multiple of the size of a FITS block
+func paddedSize(size int) int {
+	return (size + fitsBlockSize - 1) / fitsBlockSize * fitsBlockSize
+}
+
+// writeRawFitsHeader writes the cards of the header, followed by END and by
+// the padding
+func writeRawFitsHeader(w io.Writer, header rawFitsHeader) error {
+	var buf bytes.Buffer
+	for _, card := range header {
+		buf.WriteString(card)
+	}
+	buf.WriteString(fmt.Sprintf("%-80s", "END"))
+	for buf.Len()%fitsBlockSize != 0 {
+		buf.WriteByte(' ')
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// intCard returns a card containing an integer value
+func intCard(keyword string, value int, comment string) string {
+	return fmt.Sprintf("%-8s= %20d / %-47s", keyword, value, comment)[:fitsCardSize]
+}
+
+// A tableColumn describes a column in a binary table
+type tableColumn struct {
+	name string
+	// Offset of the column from the beginning of the row, in bytes
+	offset int
+	// Type of the column, as in TFORM (e.g., "B", "J", "PB")
+	dataType string
+}
+
+// tformRe matches the value of the TFORMn keywords
+var tformRe = regexp.MustCompile(`^([0-9]*)([LXBIJKAEDCMPQ])([A-Z]?)`)
+
+// tableColumns returns the columns of the binary table described by "header"
+func (header rawFitsHeader) tableColumns() ([]tableColumn, error) {
+	numOfFields, err := header.getInt("TFIELDS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[byte]int{
+		'L': 1, 'B': 1, 'I': 2, 'J': 4, 'K': 8, 'A': 1,
+		'E': 4, 'D': 8, 'C': 8, 'M': 16, 'P': 8, 'Q': 16,
+	}
+
+	var columns []tableColumn
+	offset := 0
+	for i := 1; i <= numOfFields; i++ {
+		tform, _ := header.get(fmt.Sprintf("TFORM%d", i))
+		matches := tformRe.FindStringSubmatch(strings.TrimSpace(tform))
+		if matches == nil {
+			return nil, fmt.Errorf("invalid format %q for column %d", tform, i)
+		}
+
+		repeat := 1
+		if matches[1] != "" {
+			repeat, _ = strconv.Atoi(matches[1])
+		}
+
+		name, _ := header.get(fmt.Sprintf("TTYPE%d", i))
+		columns = append(columns, tableColumn{
+			name:     strings.ToUpper(name),
+			offset:   offset,
+			dataType: matches[2] + matches[3],
+		})
+
+		if matches[2] == "X" {
+			offset += (repeat + 7) / 8
+		} else {
+			offset += repeat * sizes[matches[2][0]]
+		}
+	}
+
+	return columns, nil
+}
+
+// A tiledImage describes how a compressed image has been split in tiles
+type tiledImage struct {
+	bitpix    int
+	axes      []int
+	tileAxes  []int
+	algorithm string
+	// Parameters of the RICE_1 algorithm
+	blockSize int
+	bytePix   int
+}
+
+// newTiledImage reads the description of the compressed image from the
+// header of the binary table containing it. It returns an
+// UnsupportedCompressionError if the image cannot be decompressed.
+func newTiledImage(header rawFitsHeader) (*tiledImage, error) {
+	var image tiledImage
+	var err error
+
+	if image.bitpix, err = header.getInt("ZBITPIX", 0); err != nil {
+		return nil, err
+	}
+	switch image.bitpix {
+	case 8, 16, 32, 64, -32, -64:
+	default:
+		return nil, fmt.Errorf("invalid value %d for ZBITPIX", image.bitpix)
+	}
+
+	// Quantized images are not compressed losslessly
+	if _, ok := header.get("ZSCALE"); ok {
+		return nil, unsupportedCompression("quantized images are not supported")
+	}
+
+	naxis, err := header.getInt("ZNAXIS", 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i <= naxis; i++ {
+		n, err := header.getInt(fmt.Sprintf("ZNAXIS%d", i), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		// By default, each tile is a row of the image
+		def := 1
+		if i == 1 {
+			def = n
+		}
+		tile, err := header.getInt(fmt.Sprintf("ZTILE%d", i), def)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || tile <= 0 {
+			return nil, fmt.Errorf("invalid size for axis %d of the compressed image", i)
+		}
+
+		image.axes = append(image.axes, n)
+		image.tileAxes = append(image.tileAxes, tile)
+	}
+
+	image.algorithm, _ = header.get("ZCMPTYPE")
+	switch image.algorithm {
+	case "RICE_1", "RICE_ONE":
+		if image.bitpix < 0 || image.bitpix == 64 {
+			return nil, unsupportedCompression("RICE_1 compression of images with BITPIX=%d is not supported",
+				image.bitpix)
+		}
+
+		image.blockSize = 32
+		image.bytePix = image.bytesPerPixel()
+		for i := 1; ; i++ {
+			name, ok := header.get(fmt.Sprintf("ZNAME%d", i))
+			if !ok {
+				break
+			}
+
+			value, err := header.getInt(fmt.Sprintf("ZVAL%d", i), 0)
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToUpper(name) {
+			case "BLOCKSIZE":
+				image.blockSize = value
+			case "BYTEPIX":
+				image.bytePix = value
+			}
+		}
+
+		if image.blockSize <= 0 || (image.bytePix != 1 && image.bytePix != 2 && image.bytePix != 4) {
+			return nil, unsupportedCompression("unsupported parameters for RICE_1 compression")
+		}
+
+	case "GZIP_1", "GZIP_2", "NOCOMPRESS":
+
+	default:
+		return nil, unsupportedCompression("compression algorithm %q is not supported", image.algorithm)
+	}
+
+	return &image, nil
+}
+
+// bytesPerPixel returns the size of one pixel of the decompressed image
+func (image *tiledImage) bytesPerPixel() int {
+	if image.bitpix < 0 {
+		return -image.bitpix / 8
+	}
+	return image.bitpix / 8
+}
+
+// numOfPixels returns the number of pixels in the image
+func (image *tiledImage) numOfPixels() int {
+	if len(image.axes) == 0 {
+		return 0
+	}
+
+	result := 1
+	for _, n := range image.axes {
+		result *= n
+	}
+	return result
+}
+
+// numOfTiles returns the number of tiles in the image
+func (image *tiledImage) numOfTiles() int {
+	if len(image.axes) == 0 {
+		return 0
+	}
+
+	result := 1
+	for i, n := range image.axes {
+		result *= (n + image.tileAxes[i] - 1) / image.tileAxes[i]
+	}
+	return result
+}
+
+// tileShape returns the position of the first pixel of the tile with index
+// "tileIdx" and the size of the tile. Tiles at the border of the image can be
+// smaller than the others.
+func (image *tiledImage) tileShape(tileIdx int) ([]int, []int) {
+	origin := make([]int, len(image.axes))
+	shape := make([]int, len(image.axes))
+	for i, n := range image.axes {
+		numOfTiles := (n + image.tileAxes[i] - 1) / image.tileAxes[i]
+		origin[i] = (tileIdx % numOfTiles) * image.tileAxes[i]
+		tileIdx /= numOfTiles
+
+		shape[i] = image.tileAxes[i]
+		if origin[i]+shape[i] > n {
+			shape[i] = n - origin[i]
+		}
+	}
+
+	return origin, shape
+}
+
+// copyTile copies the pixels of a tile into the image
+func (image *tiledImage) copyTile(pixels []byte, tile []byte, origin []int, shape []int) {
+	bpp := image.bytesPerPixel()
+
+	// Position of the current pixel within the tile
+	pos := make([]int, len(shape))
+	for src := 0; src+bpp <= len(tile); src += bpp {
+		dest := 0
+		stride := 1
+		for i := range pos {
+			dest += (origin[i] + pos[i]) * stride
+			stride *= image.axes[i]
+		}
+		copy(pixels[dest*bpp:(dest+1)*bpp], tile[src:src+bpp])
+
+		for i := range pos {
+			pos[i]++
+			if pos[i] < shape[i] {
+				break
+			}
+			pos[i] = 0
+		}
+	}
+}
+
+// decompressTile decompresses the data of a tile containing "numOfPixels"
+// pixels, and returns them as big-endian values of the size specified by
+// ZBITPIX
+func (image *tiledImage) decompressTile(data []byte, numOfPixels int) ([]byte, error) {
+	bpp := image.bytesPerPixel()
+
+	var result []byte
+	switch image.algorithm {
+	case "RICE_1", "RICE_ONE":
+		values, err := riceDecompress(data, numOfPixels, image.blockSize, image.bytePix)
+		if err != nil {
+			return nil, err
+		}
+
+		result = make([]byte, numOfPixels*bpp)
+		for i, value := range values {
+			switch bpp {
+			case 1:
+				result[i] = byte(value)
+			case 2:
+				binary.BigEndian.PutUint16(result[2*i:], uint16(value))
+			case 4:
+				binary.BigEndian.PutUint32(result[4*i:], uint32(value))
+			}
+		}
+
+	case "GZIP_1", "GZIP_2":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if result, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+
+		if image.algorithm == "GZIP_2" && len(result) == numOfPixels*bpp {
+			// The bytes of the pixels have been shuffled, so that the most
+			// significant bytes of all the pixels come first
+			shuffled := result
+			result = make([]byte, len(shuffled))
+			for i := 0; i < numOfPixels; i++ {
+				for j := 0; j < bpp; j++ {
+					result[i*bpp+j] = shuffled[j*numOfPixels+i]
+				}
+			}
+		}
+
+	case "NOCOMPRESS":
+		result = data
+	}
+
+	if len(result) != numOfPixels*bpp {
+		return nil, fmt.Errorf("wrong size of decompressed tile: %d bytes instead of %d",
+			len(result), numOfPixels*bpp)
+	}
+
+	return result, nil
+}
+
+// riceParameters contains the parameters of the RICE_1 algorithm that depend
+// on the number of bytes per pixel
+var riceParameters = map[int]struct {
+	fsBits int
+	fsMax  int
+}{
+	1: {fsBits: 3, fsMax: 6},
+	2: {fsBits: 4, fsMax: 14},
+	4: {fsBits: 5, fsMax: 25},
+}
+
+// A bitReader reads a stream of bits, starting from the most significant
+// bit of each byte
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	if r.pos >= 8*len(r.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	bit := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint64(bit), nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var result uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		result = result<<1 | bit
+	}
+
+	return result, nil
+}
+
+// riceDecompress decodes "numOfPixels" values compressed using the RICE_1
+// algorithm, with "bytePix" bytes per pixel. Values are returned as unsigned
+// integers: they must be converted to signed integers of the proper size.
+func riceDecompress(data []byte, numOfPixels int, blockSize int, bytePix int) ([]uint64, error) {
+	params := riceParameters[bytePix]
+	bbits := 8 * bytePix
+	mask := uint64(1)<<bbits - 1
+
+	if len(data) < bytePix {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// The first value is stored as it is
+	r := bitReader{data: data}
+	lastPix, _ := r.readBits(bbits)
+
+	result := make([]uint64, 0, numOfPixels)
+	for len(result) < numOfPixels {
+		fsPlusOne, err := r.readBits(params.fsBits)
+		if err != nil {
+			return nil, err
+		}
+		fs := int(fsPlusOne) - 1
+
+		end := len(result) + blockSize
+		if end > numOfPixels {
+			end = numOfPixels
+		}
+
+		for len(result) < end {
+			var diff uint64
+			switch {
+			case fs < 0:
+				// Low-entropy block: all the differences are zero
+				diff = 0
+
+			case fs == params.fsMax:
+				// High-entropy block: differences are stored as they are
+				if diff, err = r.readBits(bbits); err != nil {
+					return nil, err
+				}
+
+			default:
+				// The high bits of the difference are encoded as a
+				// sequence of zeros ended by a one, followed by the "fs"
+				// lowest bits
+				numOfZeros := uint64(0)
+				for {
+					bit, err := r.readBit()
+					if err != nil {
+						return nil, err
+					}
+					if bit == 1 {
+						break
+					}
+					numOfZeros++
+				}
+
+				low, err := r.readBits(fs)
+				if err != nil {
+					return nil, err
+				}
+				diff = numOfZeros<<fs | low
+			}
+
+			// Undo the mapping of negative differences to odd numbers
+			if diff&1 == 0 {
+				diff >>= 1
+			} else {
+				diff = ^(diff >> 1)
+			}
+
+			lastPix = (lastPix + diff) & mask
+			result = append(result, lastPix)
+		}
+	}
+
+	return result, nil
+}
+
+// reservedCompressionRe matches the keywords in the header of a compressed
+// image that must not be copied in the header of the decompressed image
+var reservedCompressionRe = regexp.MustCompile(
+	`^(XTENSION|BITPIX|NAXIS[0-9]*|PCOUNT|GCOUNT|TFIELDS|THEAP|CHECKSUM|DATASUM|` +
+		`(TTYPE|TFORM|TUNIT|TDIM|TNULL|TSCAL|TZERO|TDISP)[0-9]+|` +
+		`ZIMAGE|ZSIMPLE|ZTENSION|ZBITPIX|ZNAXIS[0-9]*|ZTILE[0-9]+|ZCMPTYPE|ZNAME[0-9]+|ZVAL[0-9]+|` +
+		`ZMASKCMP|ZQUANTIZ|ZDITHER0|ZPCOUNT|ZGCOUNT|ZEXTEND|ZBLOCKED|ZHECKSUM|ZDATASUM|ZBLANK)$`)
+
+// decompressedHeader returns the header of the image stored in the binary
+// table whose header is "header"
+func (image *tiledImage) decompressedHeader(header rawFitsHeader) rawFitsHeader {
+	result := rawFitsHeader{
+		fmt.Sprintf("%-8s= %-70s", "XTENSION", "'IMAGE   '           / image extension"),
+		intCard("BITPIX", image.bitpix, "number of bits per data pixel"),
+		intCard("NAXIS", len(image.axes), "number of data axes"),
+	}
+	for i, n := range image.axes {
+		result = append(result, intCard(fmt.Sprintf("NAXIS%d", i+1), n, fmt.Sprintf("length of data axis %d", i+1)))
+	}
+	result = append(result,
+		intCard("PCOUNT", 0, "required keyword; must = 0"),
+		intCard("GCOUNT", 1, "required keyword; must = 1"),
+	)
+
+	for _, card := range header {
+		keyword := cardKeyword(card)
+		if keyword == "ZBLANK" {
+			result = append(result, "BLANK   "+card[8:])
+			continue
+		}
+		if reservedCompressionRe.MatchString(keyword) {
+			continue
+		}
+
+		result = append(result, card)
+	}
+
+	return result
+}
+
+// decompressImage returns the pixels of the image stored in the data unit of
+// a binary table, as they would appear in the data unit of an image HDU
+func (image *tiledImage) decompressImage(header rawFitsHeader, data []byte) ([]byte, error) {
+	columns, err := header.tableColumns()
+	if err != nil {
+		return nil, err
+	}
+
+	rowSize, err := header.getInt("NAXIS1", 0)
+	if err != nil {
+		return nil, err
+	}
+	numOfRows, err := header.getInt("NAXIS2", 0)
+	if err != nil {
+		return nil, err
+	}
+	heapStart, err := header.getInt("THEAP", rowSize*numOfRows)
+	if err != nil {
+		return nil, err
+	}
+	if numOfRows != image.numOfTiles() || rowSize*numOfRows > len(data) || heapStart > len(data) {
+		return nil, fmt.Errorf("the table does not match the size of the compressed image")
+	}
+
+	// Tiles that cannot be compressed are stored in UNCOMPRESSED_DATA or, for
+	// floating-point images, in GZIP_COMPRESSED_DATA
+	var compressedCol, uncompressedCol, gzipCol *tableColumn
+	for i := range columns {
+		col := &columns[i]
+		switch col.name {
+		case "COMPRESSED_DATA":
+			compressedCol = col
+		case "UNCOMPRESSED_DATA":
+			uncompressedCol = col
+		case "GZIP_COMPRESSED_DATA":
+			gzipCol = col
+		case "ZSCALE", "ZZERO", "ZBLANK", "NULL_PIXEL_MASK":
+			return nil, unsupportedCompression("column %q is not supported", col.name)
+		}
+	}
+	if compressedCol == nil {
+		return nil, fmt.Errorf("no COMPRESSED_DATA column found")
+	}
+
+	// readArray returns the contents of the variable-length array in
+	// column "col" of row "row"
+	heap := data[heapStart:]
+	readArray := func(col *tableColumn, row int) ([]byte, error) {
+		if col == nil {
+			return nil, nil
+		}
+
+		descriptor := data[row*rowSize+col.offset:]
+		var length, offset uint64
+		switch col.dataType[0] {
+		case 'P':
+			length = uint64(binary.BigEndian.Uint32(descriptor))
+			offset = uint64(binary.BigEndian.Uint32(descriptor[4:]))
+		case 'Q':
+			length = binary.BigEndian.Uint64(descriptor)
+			offset = binary.BigEndian.Uint64(descriptor[8:])
+		default:
+			return nil, fmt.Errorf("column %q is not a variable-length array", col.name)
+		}
+
+		// Arrays of numbers are returned as sequences of big-endian values
+		elementSizes := map[string]uint64{"B": 1, "I": 2, "J": 4, "K": 8, "E": 4, "D": 8}
+		elementSize, ok := elementSizes[col.dataType[1:]]
+		if !ok {
+			return nil, unsupportedCompression("column %q has type %q", col.name, col.dataType)
+		}
+		length *= elementSize
+
+		if offset+length > uint64(len(heap)) {
+			return nil, fmt.Errorf("invalid descriptor in column %q", col.name)
+		}
+
+		return heap[offset : offset+length], nil
+	}
+
+	bpp := image.bytesPerPixel()
+	pixels := make([]byte, image.numOfPixels()*bpp)
+	for row := 0; row < numOfRows; row++ {
+		origin, shape := image.tileShape(row)
+		numOfPixels := 1
+		for _, n := range shape {
+			numOfPixels *= n
+		}
+
+		compressed, err := readArray(compressedCol, row)
+		if err != nil {
+			return nil, err
+		}
+
+		var tile []byte
+		if len(compressed) > 0 {
+			if tile, err = image.decompressTile(compressed, numOfPixels); err != nil {
+				return nil, fmt.Errorf("unable to decompress tile %d: %s", row+1, err)
+			}
+		} else if gzipped, err := readArray(gzipCol, row); err != nil {
+			return nil, err
+		} else if len(gzipped) > 0 {
+			gzipImage := *image
+			gzipImage.algorithm = "GZIP_1"
+			if tile, err = gzipImage.decompressTile(gzipped, numOfPixels); err != nil {
+				return nil, fmt.Errorf("unable to decompress tile %d: %s", row+1, err)
+			}
+		} else if uncompressed, err := readArray(uncompressedCol, row); err != nil {
+			return nil, err
+		} else if len(uncompressed) == numOfPixels*bpp {
+			tile = uncompressed
+		} else {
+			return nil, fmt.Errorf("no data for tile %d", row+1)
+		}
+
+		image.copyTile(pixels, tile, origin, shape)
+	}
+
+	return pixels, nil
+}
+
+// checkTiledFits reads the headers of the FITS file in "r" and returns an
+// error if any of its compressed images cannot be decompressed
+func checkTiledFits(r io.ReadSeeker) error {
+	for {
+		header, err := readRawFitsHeader(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.isCompressedImage() {
+			if _, err := newTiledImage(header); err != nil {
+				return err
+			}
+		}
+
+		size, err := header.dataSize()
+		if err != nil {
+			return err
+		}
+		if _, err := r.Seek(int64(paddedSize(size)), io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+// decompressTiledFits writes the FITS file in "r" into "w", decompressing the
+// images that have been compressed using the tiled image convention. The
+// other HDUs are copied as they are. Nothing is written if some image cannot
+// be decompressed.
+func decompressTiledFits(w io.Writer, r io.ReadSeeker) error {
+	if err := checkTiledFits(r); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	for {
+		header, err := readRawFitsHeader(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		size, err := header.dataSize()
+		if err != nil {
+			return err
+		}
+
+		if !header.isCompressedImage() {
+			if err := writeRawFitsHeader(w, header); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, int64(paddedSize(size))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data := make([]byte, paddedSize(size))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		image, err := newTiledImage(header)
+		if err != nil {
+			return err
+		}
+		pixels, err := image.decompressImage(header, data[:size])
+		if err != nil {
+			return err
+		}
+
+		if err := writeRawFitsHeader(w, image.decompressedHeader(header)); err != nil {
+			return err
+		}
+		if _, err := w.Write(pixels); err != nil {
+			return err
+		}
+		if _, err := w.Write(make([]byte, paddedSize(len(pixels))-len(pixels))); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,280 @@
+/*
+The MIT License
+
+Copyright (c) 2018 Maurizio Tomasi
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// This file implements the watcher that keeps the database in sync with the
+// repository while the server is running
+
+package qutedb
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Watcher monitors a repository for new acquisition folders and for files
+// that are added to or removed from them. Each folder is passed to refreshFolder only once no
+// event has been received for it for a while, so that folders which are
+// still being copied are not ingested prematurely.
+type Watcher struct {
+	db         *gorm.DB
+	repository Repository
+	delay      time.Duration
+
+	fsWatcher *fsnotify.Watcher
+
+	// Timers of the folders that are waiting to be ingested, indexed by the
+	// path of the folder
+	mutex   sync.Mutex
+	pending map[string]*time.Timer
+
+	done chan struct{}
+}
+
+// NewWatcher creates a Watcher that monitors "repository". Folders are
+// ingested after "delay" has passed since the last event related to them. The
+// watcher does not process any event until Start is called.
+func NewWatcher(db *gorm.DB, repository Repository, delay time.Duration) (*Watcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	watcher := Watcher{
+		db:         db,
+		repository: repository,
+		delay:      delay,
+		fsWatcher:  fsWatcher,
+		pending:    map[string]*time.Timer{},
+		done:       make(chan struct{}),
+	}
+
+	if err := watcher.addTree(repository.Path, false); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+
+	return &watcher, nil
+}
+
+// Start makes the watcher process filesystem events in a separate goroutine
+func (w *Watcher) Start() {
+	go w.loop()
+}
+
+// Close stops the watcher and discards any folder that is still waiting to be
+// ingested
+func (w *Watcher) Close() error {
+	close(w.done)
+
+	w.mutex.Lock()
+	for folder, timer := range w.pending {
+		timer.Stop()
+		delete(w.pending, folder)
+	}
+	w.mutex.Unlock()
+
+	return w.fsWatcher.Close()
+}
+
+// addTree adds "root" and all its subdirectories to the list of watched paths.
+// If "schedule" is true, any acquisition folder found in the tree is scheduled
+// for ingestion: this is needed when a whole tree is moved into the
+// repository, as no event is generated for its contents.
+func (w *Watcher) addTree(root string, schedule bool) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory might have been removed in the meantime
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if err := w.fsWatcher.Add(path); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"folder_name": path,
+		}).Debug("Watching directory")
+
+		if schedule && isAcquisitionFolder(path) {
+			w.schedule(path)
+		}
+
+		return nil
+	})
+}
+
+// acquisitionFolderOf returns the acquisition folder containing "path", or ""
+// if "path" is not within an acquisition folder
+func (w *Watcher) acquisitionFolderOf(path string) string {
+	root := filepath.Clean(w.repository.Path)
+	for cur := filepath.Clean(path); cur != root; cur = filepath.Dir(cur) {
+		if isAcquisitionFolder(cur) {
+			return cur
+		}
+
+		if parent := filepath.Dir(cur); parent == cur {
+			break
+		}
+	}
+
+	return ""
+}
+
+// schedule (re)starts the timer that will trigger the ingestion of "folder"
+func (w *Watcher) schedule(folder string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if timer, ok := w.pending[folder]; ok {
+		timer.Reset(w.delay)
+		return
+	}
+
+	w.pending[folder] = time.AfterFunc(w.delay, func() {
+		w.ingest(folder)
+	})
+}
+
+// ingest passes "folder" to refreshFolder, once its timer has expired
+func (w *Watcher) ingest(folder string) {
+	w.mutex.Lock()
+	delete(w.pending, folder)
+	w.mutex.Unlock()
+
+	if !fileExists(folder) {
+		log.WithFields(log.Fields{
+			"folder_name": folder,
+		}).Warning("Folder has been removed from the repository")
+
+		if err := FlagMissingAcquisition(w.db, filepath.Base(folder)); err != nil {
+			log.WithFields(log.Fields{
+				"folder_name": folder,
+				"error":       err,
+			}).Error("Unable to flag acquisition as missing")
+		}
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"repository":  w.repository.Name,
+		"folder_name": folder,
+	}).Info("Ingesting folder after a change in the repository")
+
+	report := IngestionReport{
+		StartedAt: time.Now().UTC(),
+		Trigger:   "watcher",
+	}
+	changes, err := refreshFolder(w.db, w.repository.Name, folder)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"folder_name": folder,
+			"error":       err,
+		}).Error("Unable to ingest folder")
+		return
+	}
+	report.addFolder(changes)
+	report.FinishedAt = time.Now().UTC()
+
+	// Only the last reports are kept, so saving one for every event would
+	// soon remove the reports of the full scans
+	if !changes.Skipped && (!changes.IsEmpty() || len(changes.Problems) > 0) {
+		if err := saveIngestionReport(w.db, &report); err != nil {
+			log.WithFields(log.Fields{
+				"folder_name": folder,
+				"error":       err,
+			}).Error("Unable to save the ingestion report")
+		}
+	}
+
+	if !changes.Skipped {
+		log.WithFields(log.Fields{
+			"changes": changes,
+		}).Info("Folder has been ingested")
+	}
+}
+
+// handleEvent decides what to do with an event sent by fsnotify
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	log.WithFields(log.Fields{
+		"path":      event.Name,
+		"operation": event.Op.String(),
+	}).Debug("Filesystem event")
+
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if err := w.addTree(event.Name, true); err != nil {
+				log.WithFields(log.Fields{
+					"folder_name": event.Name,
+					"error":       err,
+				}).Error("Unable to watch new directory")
+			}
+		}
+	}
+
+	// Permission changes do not affect the database
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+
+	if folder := w.acquisitionFolderOf(event.Name); folder != "" {
+		w.schedule(folder)
+	}
+}
+
+// loop processes the events sent by fsnotify until the watcher is closed
+func (w *Watcher) loop() {
+	for {
+		select {
+		case <-w.done:
+			return
+
+		case event, ok := <-w.fsWatcher.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event)
+
+		case err, ok := <-w.fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Error while watching the repository")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package qutedb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForAcquisition polls the database until an acquisition with the given
+// directory name appears, or until the timeout expires
+func waitForAcquisition(t *testing.T, watcher *Watcher, dirname string) *Acquisition {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var acq Acquisition
+		if !watcher.db.Where("directoryname = ?", dirname).First(&acq).RecordNotFound() {
+			return &acq
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("Acquisition \"%s\" was not ingested by the watcher", dirname)
+	return nil
+}
+
+func TestWatcher(t *testing.T) {
+	db := createTemporaryDb(t)
+	repository := t.TempDir()
+
+	watcher, err := NewWatcher(db, Repository{Name: "lab", Path: repository}, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create the watcher: %s", err)
+	}
+	defer watcher.Close()
+	watcher.Start()
+
+	const dirname = "2018-05-22_13.33.56__mytest"
+	hkDir := filepath.Join(repository, dirname, "Hks")
+	if err := os.MkdirAll(hkDir, 0755); err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+
+	// Give the watcher the time to notice the new directories before
+	// creating files within them
+	time.Sleep(50 * time.Millisecond)
+	if err := copyFile(
+		filepath.Join(hkDir, "hk-extern-2018.05.22.133356.fits"),
+		filepath.Join("testdata", dirname, "Hks", "hk-extern-2018.05.22.133356.fits"),
+	); err != nil {
+		t.Fatalf("Unable to copy HK file: %s", err)
+	}
+
+	acq := waitForAcquisition(t, watcher, dirname)
+	if acq.Name != "mytest" {
+		t.Errorf("Wrong name for the acquisition: \"%s\"", acq.Name)
+	}
+	if acq.Repository != "lab" {
+		t.Errorf("Wrong repository for the acquisition: \"%s\"", acq.Repository)
+	}
+	if acq.ExternHkFileName == "" {
+		t.Errorf("External HK file was not ingested")
+	}
+}
+
+func TestWatcherIgnoresOtherFolders(t *testing.T) {
+	db := createTemporaryDb(t)
+	repository := t.TempDir()
+
+	watcher, err := NewWatcher(db, Repository{Name: "lab", Path: repository}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create the watcher: %s", err)
+	}
+	defer watcher.Close()
+	watcher.Start()
+
+	if err := os.MkdirAll(filepath.Join(repository, "not_an_acquisition", "Hks"), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	var count int
+	db.Model(&Acquisition{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Wrong number of acquisitions: %d", count)
+	}
+}
+
+func TestWatcherReports(t *testing.T) {
+	db := createTemporaryDb(t)
+	repository := t.TempDir()
+	createSyntheticRepository(t, repository, 1)
+
+	watcher, err := NewWatcher(db, Repository{Name: "lab", Path: repository}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create the watcher: %s", err)
+	}
+	defer watcher.Close()
+
+	// Events that do not change anything must not produce a report
+	folder := filepath.Join(repository, "2018-04-06_00.00.00__synthetic")
+	for i := 0; i < 3; i++ {
+		watcher.ingest(folder)
+	}
+
+	reports, err := QueryIngestionReports(db)
+	if err != nil {
+		t.Fatalf("Unable to retrieve the ingestion reports: %s", err)
+	}
+	if len(reports) != 1 || reports[0].NumOfNewAcquisitions != 1 || reports[0].Trigger != "watcher" {
+		t.Errorf("Wrong ingestion reports: %v", reports)
+	}
+}